@@ -6,6 +6,27 @@ import (
 	"math"
 )
 
+const (
+	defaultPlanarArcTurns = 2
+	maxArcTurns           = 1000
+	defaultArcStep        = 0.1 // Length, in mm, of each line of an arc without ArcTolerance.
+
+	// The distances of the start and the end of an arc from the center may differ by at most
+	// the larger of arcRadiusTolerance, in mm, and arcRelativeTolerance times the radius.
+	arcRadiusTolerance   = 0.002
+	arcRelativeTolerance = 0.001
+)
+
+// Arc is an arc (G2 or G3) passed to ArcHandler. The positions are machine positions in mm; the
+// center is in the plane of the arc through the start, and Turns is at least one.
+type Arc struct {
+	Start, End, Center Position
+	Radius             float64
+	Turns              uint
+	Clockwise          bool
+	Plane              Plane
+}
+
 func hypot(pos1, pos2 Position) float64 {
 	return math.Hypot(pos1.X-pos2.X, pos1.Y-pos2.Y)
 }
@@ -37,37 +58,59 @@ func radiusCenter(curPos, endPos Position, radius float64, clockwise bool) (Posi
 	}, nil
 }
 
-// arcTo expects the positions to be mapped to the XYZ plane, with Z being the axis of rotation
-// and the arc drawn in the XY plane
-func arcTo(curPos, endPos, centerPos Position, radius float64, turns uint, clockwise bool,
-	linearTo func(pos Position) error) error {
+// arcSteps returns the number of lines used to approximate an arc. With a tolerance, each line
+// spans the largest angle for which the chord height, r * (1 - cos(angle / 2)), is at most the
+// tolerance; otherwise, each line is about defaultArcStep long. At least one line is used.
+func arcSteps(angleTotal, radius, travelTotal, tolerance float64) float64 {
+	var numSteps float64
+	if tolerance > 0.0 {
+		// Lines span at most half a turn, even when the tolerance is larger than the radius.
+		stepAngle := 2 * math.Acos(math.Max(1.0-tolerance/radius, 0.0))
+		numSteps = math.Ceil(angleTotal / stepAngle)
+	} else {
+		numSteps = math.Floor(travelTotal / defaultArcStep)
+	}
+	if numSteps < 1.0 || math.IsNaN(numSteps) {
+		return 1.0
+	}
+	return numSteps
+}
+
+// arcCenter returns the center and the radius of an arc with either a center or a radius; the
+// positions are mapped to the XYZ plane, like arcTo.
+func arcCenter(curPos, endPos, centerPos Position, radius float64, clockwise bool) (Position,
+	float64, error) {
 
 	if radius != 0.0 {
 		if centerPos.X != curPos.X || centerPos.Y != curPos.Y {
-			return errors.New("both center point and radius specified for arc")
+			return Position{}, 0.0, errors.New("both center point and radius specified for arc")
 		}
 
 		var err error
 		centerPos, err = radiusCenter(curPos, endPos, radius, clockwise)
 		if err != nil {
-			return err
+			return Position{}, 0.0, err
 		}
 
 		radius = math.Abs(radius)
 	} else if centerPos.X != curPos.X || centerPos.Y != curPos.Y {
 		radius = hypot(curPos, centerPos)
-		// XXX: warn if hypot(endPos, centerPos) is significantly different than radius
+		endRadius := hypot(endPos, centerPos)
+		if math.Abs(endRadius-radius) > math.Max(arcRadiusTolerance, radius*arcRelativeTolerance) {
+			return Position{}, 0.0,
+				fmt.Errorf("arc endpoint not on circle (start radius %s, end radius %s)",
+					Number(radius), Number(endRadius))
+		}
 	} else {
-		return errors.New("expected center point or radius for arc")
+		return Position{}, 0.0, errors.New("expected center point or radius for arc")
 	}
+	return centerPos, radius, nil
+}
 
-	normal := endPos.Z - curPos.Z
-	if math.Abs(normal) < minimumDelta {
-		normal = 0.0
-		if turns > 2 {
-			turns = 2
-		}
-	}
+// arcAngles returns the angle, in radians, of the start of an arc around the center and the
+// total angle which the arc turns through; the positions are mapped to the XYZ plane, like arcTo.
+func arcAngles(curPos, endPos, centerPos Position, turns uint, clockwise bool) (float64,
+	float64) {
 
 	x := curPos.X - centerPos.X
 	y := curPos.Y - centerPos.Y
@@ -80,15 +123,11 @@ func arcTo(curPos, endPos, centerPos Position, radius float64, turns uint, clock
 		endAngle += math.Pi * 2
 	}
 
-	var angleDir float64
-	if clockwise {
-		angleDir = -1.0
-	} else {
-		angleDir = 1.0
-	}
-
 	angleTotal := float64(turns-1) * math.Pi * 2
-	if angle == endAngle {
+	if angle == endAngle ||
+		(math.Abs(endPos.X-curPos.X) < minimumDelta && math.Abs(endPos.Y-curPos.Y) < minimumDelta) {
+		// The arc ends where it starts, such as a helix which only changes Z, so it is a full
+		// turn.
 		angleTotal += math.Pi * 2
 	} else if angle < endAngle {
 		if clockwise {
@@ -103,9 +142,52 @@ func arcTo(curPos, endPos, centerPos Position, radius float64, turns uint, clock
 			angleTotal += math.Pi*2 - (angle - endAngle)
 		}
 	}
+	return angle, angleTotal
+}
+
+// arcLength returns the length, in mm, of an arc, including motion along the axis of rotation;
+// the positions are mapped to the XYZ plane, like arcTo.
+func arcLength(curPos, endPos, centerPos Position, radius float64, turns uint,
+	clockwise bool) (float64, error) {
+
+	centerPos, radius, err := arcCenter(curPos, endPos, centerPos, radius, clockwise)
+	if err != nil {
+		return 0.0, err
+	}
+	_, angleTotal := arcAngles(curPos, endPos, centerPos, turns, clockwise)
+	return math.Hypot(angleTotal*radius, endPos.Z-curPos.Z), nil
+}
+
+// arcTo expects the positions to be mapped to the XYZ plane, with Z being the axis of rotation
+// and the arc drawn in the XY plane
+func arcTo(curPos, endPos, centerPos Position, radius float64, turns uint, clockwise bool,
+	tolerance float64, linearTo func(pos Position) error) error {
+
+	centerPos, radius, err := arcCenter(curPos, endPos, centerPos, radius, clockwise)
+	if err != nil {
+		return err
+	}
+
+	normal := endPos.Z - curPos.Z
+	if math.Abs(normal) < minimumDelta {
+		normal = 0.0
+	}
+
+	angle, angleTotal := arcAngles(curPos, endPos, centerPos, turns, clockwise)
+
+	var angleDir float64
+	if clockwise {
+		angleDir = -1.0
+	} else {
+		angleDir = 1.0
+	}
 
 	travelTotal := math.Hypot(angleTotal*radius, math.Abs(normal))
-	numSteps := math.Floor(travelTotal / 0.1)
+	if travelTotal < minimumDelta {
+		// The arc is too short to step along.
+		return linearTo(endPos)
+	}
+	numSteps := arcSteps(angleTotal, radius, travelTotal, tolerance)
 	stepAngle := angleTotal / numSteps
 	stepNormal := normal / numSteps
 
@@ -150,6 +232,21 @@ func (eng *engine) fromArcPlane(pos Position) Position {
 	}
 }
 
+// ArcPlaneAxes returns the first and second axes of the current plane and the axis normal to it;
+// for example, X, Y, and Z for G17 and Z, X, and Y for G18.
+func (eng *engine) ArcPlaneAxes() (Letter, Letter, Letter) {
+	switch eng.arcPlane {
+	case XYPlane:
+		return 'X', 'Y', 'Z'
+	case ZXPlane:
+		return 'Z', 'X', 'Y'
+	case YZPlane:
+		return 'Y', 'Z', 'X'
+	default:
+		panic(fmt.Sprintf("unexpected arcPlane: %d", eng.arcPlane))
+	}
+}
+
 func (eng *engine) arcTo(codes []Code, useMachine bool) ([]Code, error) {
 	if useMachine {
 		return nil, errors.New("G53 not allowed with arcs")
@@ -157,7 +254,7 @@ func (eng *engine) arcTo(codes []Code, useMachine bool) ([]Code, error) {
 
 	var err error
 	var args []arg
-	args, codes, err = parseArgs(codes, fArg|iArg|jArg|kArg|pArg|rArg|xArg|yArg|zArg)
+	args, codes, err = eng.parseArgs(codes, fArg|iArg|jArg|kArg|pArg|rArg|xArg|yArg|zArg)
 	if err != nil {
 		return nil, err
 	}
@@ -169,7 +266,7 @@ func (eng *engine) arcTo(codes []Code, useMachine bool) ([]Code, error) {
 	for _, arg := range args {
 		switch arg.letter {
 		case 'F':
-			err = eng.setFeed(float64(arg.num) * eng.units)
+			err = eng.setFeed(float64(arg.num))
 			if err != nil {
 				return nil, err
 			}
@@ -189,10 +286,14 @@ func (eng *engine) arcTo(codes []Code, useMachine bool) ([]Code, error) {
 			}
 			centerPos.Z = eng.toMachineZ(float64(arg.num)*eng.units, eng.absoluteArcMode)
 		case 'P':
-			num, ok := arg.num.AsInteger()
-			if !ok || num < 1 {
+			num := arg.num.RoundToInteger()
+			if !arg.num.Equal(Number(num)) || num < 1 {
 				return nil, fmt.Errorf("expected a positive number of turns: P%s", arg.num)
 			}
+			if num > maxArcTurns {
+				return nil, fmt.Errorf("too many turns; expected at most %d: P%s", maxArcTurns,
+					arg.num)
+			}
 			turns = uint(num)
 		case 'R':
 			radius = float64(arg.num) * eng.units
@@ -228,8 +329,92 @@ func (eng *engine) arcTo(codes []Code, useMachine bool) ([]Code, error) {
 		panic(fmt.Sprintf("unexpected moveMode: %d", eng.moveMode))
 	}
 
+	if !centerPos.finite() {
+		return nil, fmt.Errorf("expected a finite position for the center of the arc: %s",
+			centerPos)
+	} else if math.IsNaN(radius) || math.IsInf(radius, 0) {
+		return nil, fmt.Errorf("expected a finite radius for the arc: R%s", Number(radius))
+	}
+
+	// The end of an arc may be off the circle by up to the tolerance checked by arcCenter; more
+	// than minimumDelta is likely a mistake, such as rounding the center, so warn.
+	if radius == 0.0 {
+		r := hypot(eng.toArcPlane(eng.curPos), eng.toArcPlane(centerPos))
+		endR := hypot(eng.toArcPlane(endPos), eng.toArcPlane(centerPos))
+		if delta := math.Abs(endR - r); delta > minimumDelta &&
+			delta <= math.Max(arcRadiusTolerance, r*arcRelativeTolerance) {
+
+			eng.warn(fmt.Sprintf("arc endpoint off circle (start radius %s, end radius %s)",
+				Number(r), Number(endR)))
+		}
+	}
+
+	// Without motion along the axis of rotation, each turn beyond the first retraces the same
+	// circle, so the turns are clamped.
+	if math.Abs(eng.toArcPlane(endPos).Z-eng.toArcPlane(eng.curPos).Z) < minimumDelta {
+		maxTurns := eng.PlanarArcTurns
+		if maxTurns == 0 {
+			maxTurns = defaultPlanarArcTurns
+		}
+		if turns > maxTurns {
+			eng.warn(fmt.Sprintf("turns clamped to %d for arc without helical motion: P%d",
+				maxTurns, turns))
+			turns = maxTurns
+		}
+	}
+
+	// In inverse time feed mode (G93), the whole arc, including any turns, takes 1/F minutes.
+	if eng.feedMode == InverseTimeFeed {
+		length, err := arcLength(eng.toArcPlane(eng.curPos), eng.toArcPlane(endPos),
+			eng.toArcPlane(centerPos), radius, turns, eng.moveMode == clockwiseArcMove)
+		if err != nil {
+			return nil, err
+		}
+		err = eng.inverseTimeFeed(args, length)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if eng.ArcHandler != nil {
+		err = eng.prepareFeedMove(endPos)
+		if err != nil {
+			return nil, err
+		}
+
+		start := eng.toArcPlane(eng.curPos)
+		center, r, err := arcCenter(start, eng.toArcPlane(endPos), eng.toArcPlane(centerPos),
+			radius, eng.moveMode == clockwiseArcMove)
+		if err != nil {
+			return nil, err
+		}
+		center.Z = start.Z
+
+		arc := Arc{
+			Start:     eng.curPos,
+			End:       endPos,
+			Center:    eng.fromArcPlane(center),
+			Radius:    r,
+			Turns:     turns,
+			Clockwise: eng.moveMode == clockwiseArcMove,
+			Plane:     eng.arcPlane,
+		}
+		handled, err := eng.ArcHandler(arc)
+		if err != nil {
+			return nil, err
+		} else if handled {
+			eng.trace("arc %s %s %s", arc.End, arc.Center, Number(arc.Radius))
+			eng.curPos = endPos
+			err = eng.updateSurfaceSpeed()
+			if err != nil {
+				return nil, err
+			}
+			return codes, nil
+		}
+	}
+
 	err = arcTo(eng.toArcPlane(eng.curPos), eng.toArcPlane(endPos), eng.toArcPlane(centerPos),
-		radius, turns, eng.moveMode == clockwiseArcMove,
+		radius, turns, eng.moveMode == clockwiseArcMove, eng.ArcTolerance,
 		func(pos Position) error {
 			return eng.linearTo(eng.fromArcPlane(pos))
 		})
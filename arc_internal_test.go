@@ -0,0 +1,48 @@
+package gcode
+
+import (
+	"testing"
+)
+
+func TestArcPlane(t *testing.T) {
+	positions := []Position{
+		{0, 0, 0},
+		{1, 2, 3},
+		{-1, 2, -3},
+		{1.5, -2.25, 3.125},
+		{100, 0, -0.001},
+	}
+
+	cases := []struct {
+		plane Plane
+		pos   Position // {1, 2, 3} in arc plane coordinates
+	}{
+		{plane: XYPlane, pos: Position{1, 2, 3}},
+		{plane: ZXPlane, pos: Position{3, 1, 2}},
+		{plane: YZPlane, pos: Position{2, 3, 1}},
+	}
+
+	for _, c := range cases {
+		eng := engine{arcPlane: c.plane}
+
+		pos := eng.toArcPlane(Position{1, 2, 3})
+		if pos != c.pos {
+			t.Errorf("toArcPlane(%d) got %s want %s", c.plane, pos, c.pos)
+		}
+		pos = eng.fromArcPlane(c.pos)
+		if pos != (Position{1, 2, 3}) {
+			t.Errorf("fromArcPlane(%d) got %s want %s", c.plane, pos, Position{1, 2, 3})
+		}
+
+		for _, p := range positions {
+			pos = eng.fromArcPlane(eng.toArcPlane(p))
+			if pos != p {
+				t.Errorf("fromArcPlane(toArcPlane(%d, %s)) got %s", c.plane, p, pos)
+			}
+			pos = eng.toArcPlane(eng.fromArcPlane(p))
+			if pos != p {
+				t.Errorf("toArcPlane(fromArcPlane(%d, %s)) got %s", c.plane, p, pos)
+			}
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package gcode_test
 
 import (
+	"errors"
+	"math"
 	"os"
 	"strings"
 	"testing"
@@ -702,6 +704,7 @@ func TestArcFail(t *testing.T) {
 		"G2 P0\n",
 		"G2 P-1\n",
 		"G2 P1.5\n",
+		"G2 P0.9\n",
 		"G90.1\nG17\nG2 I1\n",
 		"G90.1\nG17\nG2 J1\n",
 		"G90.1\nG18\nG2 I1\n",
@@ -718,3 +721,424 @@ func TestArcFail(t *testing.T) {
 		}
 	}
 }
+
+type countMachine struct {
+	machine
+	linearTos int
+}
+
+func (m *countMachine) LinearTo(pos gcode.Position) error {
+	m.linearTos += 1
+	return nil
+}
+
+func TestArcTurns(t *testing.T) {
+	cases := []struct {
+		s        string
+		maxTurns uint
+		warn     bool
+		same     string
+	}{
+		{s: "G21\nG0 X1 Y2\nG2 X2 Y1 R1 P5\n", warn: true, same: "G21\nG0 X1 Y2\nG2 X2 Y1 R1 P2\n"},
+		{s: "G21\nG0 X1 Y2\nG2 X2 Y1 R1 P2\n"},
+		{s: "G21\nG0 X1 Y2\nG2 X2 Y1 R1 P5\n", maxTurns: 5},
+		{s: "G21\nG0 X1 Y2\nG2 X2 Y1 R1 P5\n", maxTurns: 3, warn: true,
+			same: "G21\nG0 X1 Y2\nG2 X2 Y1 R1 P3\n"},
+		{s: "G21\nG0 X1 Y2\nG2 X2 Y1 Z5 R1 P5\n"},
+	}
+
+	count := func(s string, maxTurns uint) (int, []string) {
+		var warnings []string
+		m := countMachine{}
+		eng := gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+		eng.PlanarArcTurns = maxTurns
+		eng.Warn = func(line int, msg string) {
+			warnings = append(warnings, msg)
+		}
+		err := eng.Evaluate(strings.NewReader(s))
+		if err != nil {
+			t.Errorf("Evaluate(%s) failed: %s", s, err)
+		}
+		return m.linearTos, warnings
+	}
+
+	for _, c := range cases {
+		n, warnings := count(c.s, c.maxTurns)
+		if c.warn && len(warnings) != 1 {
+			t.Errorf("Evaluate(%s): got %d warnings want 1", c.s, len(warnings))
+		} else if !c.warn && len(warnings) != 0 {
+			t.Errorf("Evaluate(%s): got %v want no warnings", c.s, warnings)
+		}
+		if c.same != "" {
+			if sn, _ := count(c.same, c.maxTurns); n != sn {
+				t.Errorf("Evaluate(%s): got %d moves want %d", c.s, n, sn)
+			}
+		}
+	}
+
+	p2, _ := count("G21\nG0 X1 Y2\nG2 X2 Y1 Z5 R1 P2\n", 0)
+	p5, _ := count("G21\nG0 X1 Y2\nG2 X2 Y1 Z5 R1 P5\n", 0)
+	if p5 <= p2 {
+		t.Errorf("Evaluate(helical P5): got %d moves want more than %d", p5, p2)
+	}
+
+	eng := gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+	err := eng.Evaluate(strings.NewReader("G21\nG0 X1 Y2\nG2 X2 Y1 Z5 R1 P1001\n"))
+	if err == nil {
+		t.Errorf("Evaluate(P1001) did not fail")
+	}
+}
+
+type positionMachine struct {
+	machine
+	positions []gcode.Position
+}
+
+func (m *positionMachine) LinearTo(pos gcode.Position) error {
+	m.positions = append(m.positions, pos)
+	return nil
+}
+
+func TestHelix(t *testing.T) {
+	cases := []struct {
+		s      string
+		start  gcode.Position
+		center gcode.Position
+		endZ   float64
+	}{
+		{s: "G21\nG17\nG0 X1 Y0\nG2 X1 Y0 Z-2 I-1 J0 F10\n",
+			start: gcode.Position{X: 1.0}, endZ: -2.0},
+		{s: "G21\nG17\nG0 X1 Y0\nG3 Z2 I-1 J0 F10\n",
+			start: gcode.Position{X: 1.0}, endZ: 2.0},
+		{s: "G20\nG17\nG0 X0.3 Y0.1\nG2 X0.3 Y0.1 Z-0.1 I-0.2 J0 F10\n",
+			start:  gcode.Position{X: 0.3 * 25.4, Y: 0.1 * 25.4},
+			center: gcode.Position{X: 0.1 * 25.4, Y: 0.1 * 25.4}, endZ: -0.1 * 25.4},
+		{s: "G21\nG17\nG91\nG0 X1 Y0\nG2 X0 Y0 Z-2 I-1 J0 F10\n",
+			start: gcode.Position{X: 1.0}, endZ: -2.0},
+	}
+
+	for _, c := range cases {
+		m := positionMachine{}
+		eng := gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+		err := eng.Evaluate(strings.NewReader(c.s))
+		if err != nil {
+			t.Errorf("Evaluate(%s) failed: %s", c.s, err)
+			continue
+		}
+		if len(m.positions) < 10 {
+			t.Errorf("Evaluate(%s): got %d moves want a full turn", c.s, len(m.positions))
+			continue
+		}
+
+		radius := math.Hypot(c.start.X-c.center.X, c.start.Y-c.center.Y)
+		z := c.start.Z
+		for _, pos := range m.positions {
+			if (c.endZ < c.start.Z && pos.Z >= z) || (c.endZ > c.start.Z && pos.Z <= z) {
+				t.Errorf("Evaluate(%s): Z not monotonic: %s after %f", c.s, pos, z)
+				break
+			}
+			z = pos.Z
+			r := math.Hypot(pos.X-c.center.X, pos.Y-c.center.Y)
+			if math.Abs(r-radius) > 0.0001 {
+				t.Errorf("Evaluate(%s): got radius %f want %f: %s", c.s, r, radius, pos)
+				break
+			}
+		}
+
+		end := m.positions[len(m.positions)-1]
+		if math.Abs(end.X-c.start.X) > 0.0001 || math.Abs(end.Y-c.start.Y) > 0.0001 ||
+			math.Abs(end.Z-c.endZ) > 0.0001 {
+			t.Errorf("Evaluate(%s): got end %s want X%f Y%f Z%f", c.s, end, c.start.X, c.start.Y,
+				c.endZ)
+		}
+	}
+}
+
+func TestArcTolerance(t *testing.T) {
+	cases := []struct {
+		s         string
+		tolerance float64
+		moves     int
+	}{
+		{s: "G21\nG0 X10 Y0\nG3 X0 Y10 I-10 J0 F10\n", tolerance: 0.01, moves: 18},
+		{s: "G21\nG0 X10 Y0\nG3 X0 Y10 I-10 J0 F10\n", tolerance: 0.1, moves: 6},
+		{s: "G21\nG0 X10 Y0\nG3 X0 Y10 I-10 J0 F10\n", moves: 157},
+		{s: "G21\nG0 X1 Y0\nG2 X1 Y0 I-1 J0 F10\n", tolerance: 5.0, moves: 2},
+		{s: "G21\nG0 X0.001 Y0\nG3 X0 Y0.001 I-0.001 J0 F10\n", moves: 1},
+		{s: "G21\nG0 X0.001 Y0\nG3 X0 Y0.001 I-0.001 J0 F10\n", tolerance: 0.01, moves: 1},
+	}
+
+	for _, c := range cases {
+		m := positionMachine{}
+		eng := gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+		eng.ArcTolerance = c.tolerance
+		err := eng.Evaluate(strings.NewReader(c.s))
+		if err != nil {
+			t.Errorf("Evaluate(%s) failed: %s", c.s, err)
+			continue
+		}
+		if len(m.positions) != c.moves {
+			t.Errorf("Evaluate(%s, %f): got %d moves want %d", c.s, c.tolerance,
+				len(m.positions), c.moves)
+		}
+		for _, pos := range m.positions {
+			if math.IsNaN(pos.X) || math.IsNaN(pos.Y) || math.IsInf(pos.X, 0) ||
+				math.IsInf(pos.Y, 0) {
+
+				t.Errorf("Evaluate(%s): got %s want a finite position", c.s, pos)
+			}
+		}
+	}
+
+	m := positionMachine{}
+	eng := gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+	eng.ArcTolerance = 0.01
+	err := eng.Evaluate(strings.NewReader("G21\nG0 X10 Y0\nG2 X10 Y0 I-10 J0 F10\n"))
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	}
+	prev := gcode.Position{X: 10.0}
+	for _, pos := range m.positions {
+		mid := math.Hypot((prev.X+pos.X)/2, (prev.Y+pos.Y)/2)
+		if 10.0-mid > 0.01+0.0001 {
+			t.Errorf("Evaluate(): chord from %s to %s is %f from the arc", prev, pos, 10.0-mid)
+		}
+		prev = pos
+	}
+}
+
+func TestDegenerateArc(t *testing.T) {
+	cases := []struct {
+		s   string
+		end gcode.Position
+	}{
+		{s: "G21\nG0 X0.001 Y0\nG3 X0 Y0.001 I-0.001 J0 F10\n", end: gcode.Position{Y: 0.001}},
+		{s: "G21\nG0 X0.00001 Y0\nG3 X0 Y0.00001 R0.00001 F10\n",
+			end: gcode.Position{Y: 0.00001}},
+		{s: "G21\nG0 X0.00001 Y0\nG2 X0.00001 Y0 Z0.00001 I-0.00001 J0 F10\n",
+			end: gcode.Position{X: 0.00001, Z: 0.00001}},
+	}
+
+	for _, c := range cases {
+		m := positionMachine{}
+		eng := gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+		err := eng.Evaluate(strings.NewReader(c.s))
+		if err != nil {
+			t.Errorf("Evaluate(%s) failed: %s", c.s, err)
+		} else if len(m.positions) != 1 {
+			t.Errorf("Evaluate(%s): got %d moves want 1", c.s, len(m.positions))
+		} else if m.positions[0] != c.end {
+			t.Errorf("Evaluate(%s): got %s want %s", c.s, m.positions[0], c.end)
+		}
+	}
+
+	for _, s := range []string{
+		"G21\nG0 X10 Y0\nG2 X10 Y0 I-10 J0 F10\n",
+		"G21\nG0 X10 Y0\nG3 I-10 J0 F10\n",
+		"G21\nG18\nG0 X10 Z0\nG2 X10 Z0 I-10 K0 F10\n",
+	} {
+		m := positionMachine{}
+		eng := gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+		err := eng.Evaluate(strings.NewReader(s))
+		if err != nil {
+			t.Errorf("Evaluate(%s) failed: %s", s, err)
+			continue
+		}
+
+		// A full circle passes through the point opposite the start and ends at the start.
+		var far float64
+		for _, pos := range m.positions {
+			far = math.Max(far, math.Hypot(math.Hypot(pos.X-10.0, pos.Y), pos.Z))
+		}
+		if math.Abs(far-20.0) > 0.01 {
+			t.Errorf("Evaluate(%s): got farthest %f want 20", s, far)
+		}
+		end := m.positions[len(m.positions)-1]
+		if end != (gcode.Position{X: 10.0}) {
+			t.Errorf("Evaluate(%s): got end %s want start", s, end)
+		}
+	}
+}
+
+func TestArcEndpointRadius(t *testing.T) {
+	cases := []struct {
+		s    string
+		fail bool
+	}{
+		{s: "G21\nG0 X10 Y0\nG3 X0 Y10 I-10 J0\n"},
+		{s: "G21\nG0 X10 Y0\nG3 X0 Y10.005 I-10 J0\n"},
+		{s: "G21\nG0 X10 Y0\nG3 X0 Y10.02 I-10 J0\n", fail: true},
+		{s: "G21\nG0 X1000 Y0\nG3 X0 Y1000.5 I-1000 J0\n"},
+		{s: "G21\nG0 X1000 Y0\nG3 X0 Y1002 I-1000 J0\n", fail: true},
+		{s: "G21\nG0 X0.1 Y0\nG3 X0 Y0.1015 I-0.1 J0\n"},
+		{s: "G21\nG0 X0.1 Y0\nG3 X0 Y0.103 I-0.1 J0\n", fail: true},
+		{s: "G21\nG18\nG0 X0 Z5\nG2 X5 Z0 I0 K-5\n"},
+		{s: "G21\nG18\nG0 X0 Z5\nG2 X6 Z0 I0 K-5\n", fail: true},
+		{s: "G21\nG0 X10 Y0\nG3 X0 Y12 Z-3 I-10 J0\n", fail: true},
+	}
+
+	for _, c := range cases {
+		eng := gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+		err := eng.Evaluate(strings.NewReader(c.s))
+		if c.fail {
+			if err == nil {
+				t.Errorf("Evaluate(%s) did not fail", c.s)
+			} else if !strings.Contains(err.Error(), "arc endpoint not on circle") {
+				t.Errorf("Evaluate(%s): got %s want arc endpoint not on circle", c.s, err)
+			}
+		} else if err != nil {
+			t.Errorf("Evaluate(%s) failed: %s", c.s, err)
+		}
+	}
+}
+
+func TestArcHandler(t *testing.T) {
+	var arcs []gcode.Arc
+	m := countMachine{}
+	eng := gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+	eng.ArcHandler = func(arc gcode.Arc) (bool, error) {
+		if arc.Plane == gcode.XYPlane {
+			return false, nil
+		}
+		arcs = append(arcs, arc)
+		return true, nil
+	}
+	err := eng.Evaluate(strings.NewReader(`
+G21
+G19
+G0 X1 Y10 Z0
+G2 Y0 Z10 J-10 K0 F10
+G3 Y-10 Z0 R10 P2
+G17
+G0 X10 Y0 Z0
+G3 X0 Y10 I-10 J0
+`))
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	}
+
+	want := []gcode.Arc{
+		{
+			Start:     gcode.Position{X: 1.0, Y: 10.0},
+			End:       gcode.Position{X: 1.0, Z: 10.0},
+			Center:    gcode.Position{X: 1.0},
+			Radius:    10.0,
+			Turns:     1,
+			Clockwise: true,
+			Plane:     gcode.YZPlane,
+		},
+		{
+			Start:  gcode.Position{X: 1.0, Z: 10.0},
+			End:    gcode.Position{X: 1.0, Y: -10.0},
+			Center: gcode.Position{X: 1.0},
+			Radius: 10.0,
+			Turns:  2,
+			Plane:  gcode.YZPlane,
+		},
+	}
+	if len(arcs) != len(want) {
+		t.Fatalf("ArcHandler: got %d arcs want %d", len(arcs), len(want))
+	}
+	for adx := range arcs {
+		got := arcs[adx]
+		if got.Start != want[adx].Start || got.End != want[adx].End ||
+			math.Abs(got.Center.X-want[adx].Center.X) > 0.0001 ||
+			math.Abs(got.Center.Y-want[adx].Center.Y) > 0.0001 ||
+			math.Abs(got.Center.Z-want[adx].Center.Z) > 0.0001 ||
+			math.Abs(got.Radius-want[adx].Radius) > 0.0001 || got.Turns != want[adx].Turns ||
+			got.Clockwise != want[adx].Clockwise || got.Plane != want[adx].Plane {
+
+			t.Errorf("ArcHandler: got %#v want %#v", got, want[adx])
+		}
+	}
+	if m.linearTos < 10 {
+		t.Errorf("Evaluate(): got %d moves want the XY arc approximated by lines", m.linearTos)
+	}
+
+	eng = gcode.NewEngine(&countMachine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+	eng.ArcHandler = func(arc gcode.Arc) (bool, error) {
+		return false, errors.New("arcs not supported")
+	}
+	err = eng.Evaluate(strings.NewReader("G21\nG0 X10\nG3 X0 Y10 I-10 J0\n"))
+	if err == nil {
+		t.Errorf("Evaluate() did not fail")
+	}
+}
+
+func TestArcHandlerFeedMove(t *testing.T) {
+	handler := func(arc gcode.Arc) (bool, error) {
+		return true, nil
+	}
+	cases := []struct {
+		s           string
+		defaultFeed float64
+		requireFeed bool
+		lathe       bool
+		fail        bool
+		actions     []action
+	}{
+		{s: "G21\nG0 X10\nG3 X0 Y10 I-10 J0\n", requireFeed: true, fail: true},
+		{s: "G21\nG0 X10\nG3 X0 Y10 I-10 J0\n", defaultFeed: 300.0,
+			actions: []action{
+				{cmd: rapidTo, x: 10.0},
+				{cmd: setFeed, f: 300.0},
+			},
+		},
+		{s: "G21\nG95\nG0 X10\nG3 X0 Y10 I-10 J0 F1\n", fail: true},
+		{s: "G21\nG0 X10\nG3 X0 Y10 Z[LN[0]] I-10 J0 F100\n", fail: true},
+		{s: "G21 G18\nG0 X50\nG96 D2000 S100 M3\nG3 X25 Z-25 R25 F100\n", lathe: true,
+			actions: []action{
+				{cmd: rapidTo, x: 50.0},
+				{cmd: setSpindle, speed: 100000.0 / (2.0 * math.Pi * 50.0), clockwise: true},
+				{cmd: setFeed, f: 100.0},
+				{cmd: setSpindle, speed: 100000.0 / (2.0 * math.Pi * 25.0), clockwise: true},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		m := machine{actions: c.actions}
+		eng := gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+		eng.ArcHandler = handler
+		eng.DefaultFeed = c.defaultFeed
+		eng.RequireFeed = c.requireFeed
+		eng.Lathe = c.lathe
+		err := eng.Evaluate(strings.NewReader(c.s))
+		if c.fail {
+			if err == nil {
+				t.Errorf("Evaluate(%s) did not fail", c.s)
+			}
+		} else if err != nil {
+			t.Errorf("Evaluate(%s) failed: %s", c.s, err)
+		} else if m.adx != len(c.actions) {
+			t.Errorf("Evaluate(%s): got %d actions want %d", c.s, m.adx, len(c.actions))
+		}
+	}
+}
+
+func TestArcPlaneAxes(t *testing.T) {
+	cases := []struct {
+		s          string
+		a1, a2, an gcode.Letter
+	}{
+		{s: "", a1: 'X', a2: 'Y', an: 'Z'},
+		{s: "G17\n", a1: 'X', a2: 'Y', an: 'Z'},
+		{s: "G18\n", a1: 'Z', a2: 'X', an: 'Y'},
+		{s: "G19\n", a1: 'Y', a2: 'Z', an: 'X'},
+		{s: "G19\nG17\n", a1: 'X', a2: 'Y', an: 'Z'},
+	}
+
+	for _, c := range cases {
+		eng := gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+		err := eng.Evaluate(strings.NewReader(c.s))
+		if err != nil {
+			t.Errorf("Evaluate(%s) failed: %s", c.s, err)
+			continue
+		}
+		a1, a2, an := eng.ArcPlaneAxes()
+		if a1 != c.a1 || a2 != c.a2 || an != c.an {
+			t.Errorf("ArcPlaneAxes(%s) got %c, %c, %c want %c, %c, %c", c.s, a1, a2, an, c.a1,
+				c.a2, c.an)
+		}
+	}
+}
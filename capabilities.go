@@ -0,0 +1,160 @@
+package gcode
+
+import (
+	"io"
+	"io/ioutil"
+)
+
+// Capabilities is a set of the optional interfaces which a Machine may implement.
+type Capabilities uint
+
+const (
+	DwellerCapability Capabilities = 1 << iota
+	PauserCapability
+	ToolChangerCapability
+	CoolantSetterCapability
+	SpindleOrienterCapability
+	PathModeSetterCapability
+	ProberCapability
+	MultiSpindleCapability
+	OverrideEnablerCapability
+)
+
+// Missing returns the capabilities in c which m does not implement.
+func (c Capabilities) Missing(m Machine) Capabilities {
+	var missing Capabilities
+	if _, ok := m.(Dweller); !ok {
+		missing |= DwellerCapability
+	}
+	if _, ok := m.(Pauser); !ok {
+		missing |= PauserCapability
+	}
+	if _, ok := m.(ToolChanger); !ok {
+		missing |= ToolChangerCapability
+	}
+	if _, ok := m.(CoolantSetter); !ok {
+		missing |= CoolantSetterCapability
+	}
+	if _, ok := m.(SpindleOrienter); !ok {
+		missing |= SpindleOrienterCapability
+	}
+	if _, ok := m.(PathModeSetter); !ok {
+		missing |= PathModeSetterCapability
+	}
+	if _, ok := m.(Prober); !ok {
+		missing |= ProberCapability
+	}
+	if _, ok := m.(MultiSpindle); !ok {
+		missing |= MultiSpindleCapability
+	}
+	if _, ok := m.(OverrideEnabler); !ok {
+		missing |= OverrideEnablerCapability
+	}
+	return c & missing
+}
+
+// capabilityMachine implements all of the optional interfaces and records which of them are
+// used. Probes always make contact at the requested position.
+type capabilityMachine struct {
+	capabilities Capabilities
+}
+
+func (cm *capabilityMachine) SetFeed(feed float64) error {
+	return nil
+}
+
+func (cm *capabilityMachine) SetSpindle(speed float64, clockwise bool) error {
+	return nil
+}
+
+func (cm *capabilityMachine) SpindleOff() error {
+	return nil
+}
+
+func (cm *capabilityMachine) SelectTool(tool uint) error {
+	return nil
+}
+
+func (cm *capabilityMachine) RapidTo(pos Position) error {
+	return nil
+}
+
+func (cm *capabilityMachine) LinearTo(pos Position) error {
+	return nil
+}
+
+func (cm *capabilityMachine) HandleUnknown(code Code, codes []Code,
+	setCurPos func(pos Position) error) ([]Code, error) {
+
+	return nil, nil
+}
+
+func (cm *capabilityMachine) Dwell(seconds float64) error {
+	cm.capabilities |= DwellerCapability
+	return nil
+}
+
+func (cm *capabilityMachine) Pause(optional bool, message string) error {
+	cm.capabilities |= PauserCapability
+	return nil
+}
+
+func (cm *capabilityMachine) ChangeTool(tool uint) error {
+	cm.capabilities |= ToolChangerCapability
+	return nil
+}
+
+func (cm *capabilityMachine) SetCoolant(mist, flood bool) error {
+	cm.capabilities |= CoolantSetterCapability
+	return nil
+}
+
+func (cm *capabilityMachine) OrientSpindle(degrees float64) error {
+	cm.capabilities |= SpindleOrienterCapability
+	return nil
+}
+
+func (cm *capabilityMachine) SetPathMode(exactStop bool, tolerance,
+	naiveCAMTolerance float64) error {
+
+	cm.capabilities |= PathModeSetterCapability
+	return nil
+}
+
+func (cm *capabilityMachine) Probe(pos Position, towards bool, requireContact bool) (Position,
+	bool, error) {
+
+	cm.capabilities |= ProberCapability
+	return pos, true, nil
+}
+
+func (cm *capabilityMachine) SetSpindleN(index int, speed float64, clockwise bool) error {
+	// Spindle $0 does not require MultiSpindle.
+	if index > 0 {
+		cm.capabilities |= MultiSpindleCapability
+	}
+	return nil
+}
+
+func (cm *capabilityMachine) FeedOverrideEnable(enable bool) error {
+	cm.capabilities |= OverrideEnablerCapability
+	return nil
+}
+
+func (cm *capabilityMachine) SpeedOverrideEnable(enable bool) error {
+	cm.capabilities |= OverrideEnablerCapability
+	return nil
+}
+
+// RequiredCapabilities evaluates a program, without a machine, and returns the optional
+// interfaces which a machine would need to implement to run it; for example, G4 requires a
+// Dweller and M6 requires a ToolChanger. Probes are assumed to make contact, and the output
+// from MSG, DEBUG, and PRINT comments is discarded.
+func RequiredCapabilities(r io.ByteScanner, f Features) (Capabilities, error) {
+	var cm capabilityMachine
+	err := NewEngine(&cm, f, ioutil.Discard, ioutil.Discard).Evaluate(r)
+	if err != nil {
+		return 0, err
+	}
+	return cm.capabilities, nil
+}
@@ -0,0 +1,50 @@
+package gcode_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/leftmike/gcode"
+)
+
+func TestRequiredCapabilities(t *testing.T) {
+	cases := []struct {
+		s    string
+		c    gcode.Capabilities
+		fail bool
+	}{
+		{s: "G0 X1\nG1 X2 F10\nM3 S1000\nM2\n"},
+		{s: "G4 P1\nT2 M6\n", c: gcode.DwellerCapability | gcode.ToolChangerCapability},
+		{s: "#1=4\nG#1 P1\n", c: gcode.DwellerCapability},
+		{s: "M0\n", c: gcode.PauserCapability},
+		{s: "M7\nM9\n", c: gcode.CoolantSetterCapability},
+		{s: "M19 R90\n", c: gcode.SpindleOrienterCapability},
+		{s: "G64 P0.1\n", c: gcode.PathModeSetterCapability},
+		{s: "G38.2 Z-10 F100\n", c: gcode.ProberCapability},
+		{s: "M3 $1 S1000\n", c: gcode.MultiSpindleCapability},
+		{s: "M3 $0 S1000\n"},
+		{s: "M49\nM48\n", c: gcode.OverrideEnablerCapability},
+		{s: "G1 X[1\n", fail: true},
+	}
+
+	for _, c := range cases {
+		caps, err := gcode.RequiredCapabilities(strings.NewReader(c.s), gcode.AllFeatures)
+		if c.fail {
+			if err == nil {
+				t.Errorf("RequiredCapabilities(%s) did not fail", c.s)
+			}
+		} else if err != nil {
+			t.Errorf("RequiredCapabilities(%s) failed with %s", c.s, err)
+		} else if caps != c.c {
+			t.Errorf("RequiredCapabilities(%s) got %d want %d", c.s, caps, c.c)
+		}
+	}
+
+	caps := gcode.DwellerCapability | gcode.ToolChangerCapability
+	if missing := caps.Missing(&dwellMachine{}); missing != gcode.ToolChangerCapability {
+		t.Errorf("Missing(dwellMachine) got %d want %d", missing, gcode.ToolChangerCapability)
+	}
+	if missing := caps.Missing(&machine{}); missing != caps {
+		t.Errorf("Missing(machine) got %d want %d", missing, caps)
+	}
+}
@@ -166,38 +166,88 @@ new Zdog.Shape({
 
 let curPt = {x: 0, y: 0, z: 0}
 
-function rapidTo(pt) {
+function rapidTo(pt, outside) {
+  if (outside) {
+    console.log("outside envelope: rapid to ", pt)
+  }
   new Zdog.Shape({
     addTo: workspace,
     stroke: 0.02 * strokeScale,
-    color: 'red',
+    color: outside ? 'magenta' : 'red',
     path: [curPt, pt],
   })
   curPt = pt
 }
 
-function linearTo(pt) {
+function linearTo(pt, outside) {
+  if (outside) {
+    console.log("outside envelope: linear to ", pt)
+  }
   new Zdog.Shape({
     addTo: workspace,
     stroke: 0.02 * strokeScale,
-    color: 'green',
+    color: outside ? 'magenta' : 'green',
     path: [curPt, pt],
   })
   curPt = pt
 }
 
-for (cmd of cmds) {
-  if (cmd.rapidTo !== undefined) {
-    rapidTo(cmd.rapidTo)
-  } else if (cmd.linearTo !== undefined) {
-    linearTo(cmd.linearTo)
+function selectTool(tool) {
+  console.log("tool: ", tool, " at ", curPt)
+  new Zdog.Shape({
+    addTo: workspace,
+    stroke: 0.2 * strokeScale,
+    color: 'orange',
+    path: [curPt],
+  })
+}
+
+function dwell(seconds) {
+  console.log("dwell: ", seconds, " seconds at ", curPt)
+  new Zdog.Shape({
+    addTo: workspace,
+    stroke: 0.2 * strokeScale,
+    color: 'blue',
+    path: [curPt],
+  })
+}
+
+function setSpindle(spindle) {
+  if (spindle === null) {
+    console.log("spindle: off at ", curPt)
+  } else {
+    console.log("spindle: ", spindle.speed, spindle.clockwise ? "clockwise" : "counter-clockwise",
+      " at ", curPt)
   }
 }
 
+// Render the cmds one stage at a time; stages are separated by (VIEW,BREAK) comments.
+function renderStage(start) {
+  for (let cdx = start; cdx < cmds.length; cdx++) {
+    let cmd = cmds[cdx]
+    if (cmd.rapidTo !== undefined) {
+      rapidTo(cmd.rapidTo, cmd.outside)
+    } else if (cmd.linearTo !== undefined) {
+      linearTo(cmd.linearTo, cmd.outside)
+    } else if (cmd.selectTool !== undefined) {
+      selectTool(cmd.selectTool)
+    } else if (cmd.setSpindle !== undefined) {
+      setSpindle(cmd.setSpindle)
+    } else if (cmd.dwell !== undefined) {
+      dwell(cmd.dwell)
+    } else if (cmd.stage !== undefined) {
+      update()
+      setTimeout(function() { renderStage(cdx + 1) }, 0)
+      return
+    }
+  }
+  update()
+}
+
 function update() {
   illo.updateRenderGraph()
 }
-update()
+renderStage(0)
     </script>
  </body>
 </html>
@@ -6,16 +6,20 @@ package main
 To Do:
 - console.log the size and rendering time of the gcode
 - for gcode over a certain size, zoom and rotate the workspace, and rendering the drawing at the end
+-- (VIEW,BREAK) comments split the drawing into stages which are rendered one at a time
 */
 
 import (
 	"bufio"
 	"flag"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 
 	"github.com/leftmike/gcode"
@@ -26,6 +30,8 @@ var (
 	linuxCNCFeature = flag.Bool("linuxcnc", false, "enable LinuxCNC dialect")
 	repRapFeature   = flag.Bool("reprap", false, "enable RepRap dialect")
 	displayHtml     = flag.Bool("html", true, "start browser to display html")
+	envelopeFlag    = flag.String("envelope", "",
+		"X,Y,Z: flag moves with an axis beyond the envelope, from -X to X, -Y to Y, and -Z to Z")
 )
 
 func startBrowser(url string) {
@@ -44,11 +50,46 @@ func startBrowser(url string) {
 	cmd.Start()
 }
 
+func parseEnvelope(s string) (*gcode.Position, error) {
+	var vals []float64
+	for _, f := range strings.Split(s, ",") {
+		val, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil || val <= 0 {
+			return nil, fmt.Errorf("envelope: expected a positive number: %s", f)
+		}
+		vals = append(vals, val)
+	}
+	if len(vals) != 3 {
+		return nil, fmt.Errorf("envelope: expected X,Y,Z: %s", s)
+	}
+	return &gcode.Position{X: vals[0], Y: vals[1], Z: vals[2]}, nil
+}
+
 type machine struct {
-	w       strings.Builder
-	base    string
-	homePos gcode.Position
-	maxPos  gcode.Position
+	w        strings.Builder
+	errW     io.Writer
+	base     string
+	homePos  gcode.Position
+	maxPos   gcode.Position
+	envelope *gcode.Position
+}
+
+func (m *machine) outside(pos gcode.Position) bool {
+	if m.envelope == nil {
+		return false
+	}
+	return math.Abs(pos.X) > m.envelope.X || math.Abs(pos.Y) > m.envelope.Y ||
+		math.Abs(pos.Z) > m.envelope.Z
+}
+
+func (m *machine) writeMove(cmd string, pos gcode.Position) {
+	if m.outside(pos) {
+		fmt.Fprintf(m.errW, "%s: %s %s is outside the envelope %s\n", m.base, cmd, pos,
+			*m.envelope)
+		fmt.Fprintf(&m.w, "  {%s: %s, outside: true},\n", cmd, pos)
+	} else {
+		fmt.Fprintf(&m.w, "  {%s: %s},\n", cmd, pos)
+	}
 }
 
 func (m *machine) SetFeed(feed float64) error {
@@ -56,14 +97,32 @@ func (m *machine) SetFeed(feed float64) error {
 }
 
 func (m *machine) SetSpindle(speed float64, clockwise bool) error {
+	fmt.Fprintf(&m.w, "  {setSpindle: {speed: %.4f, clockwise: %v}},\n", speed, clockwise)
 	return nil
 }
 
 func (m *machine) SpindleOff() error {
+	fmt.Fprintf(&m.w, "  {setSpindle: null},\n")
 	return nil
 }
 
 func (m *machine) SelectTool(tool uint) error {
+	fmt.Fprintf(&m.w, "  {selectTool: %d},\n", tool)
+	return nil
+}
+
+func (m *machine) Dwell(seconds float64) error {
+	fmt.Fprintf(&m.w, "  {dwell: %.4f},\n", seconds)
+	return nil
+}
+
+// viewComment handles (VIEW,BREAK) comments, which end a stage of the path; the browser renders
+// the stages one at a time so that large programs are displayed progressively.
+func (m *machine) viewComment(body string) error {
+	if strings.ToLower(strings.TrimSpace(body)) != "break" {
+		return fmt.Errorf("expected (VIEW,BREAK): (VIEW,%s)", body)
+	}
+	fmt.Fprintf(&m.w, "  {stage: true},\n")
 	return nil
 }
 
@@ -89,13 +148,13 @@ func (m *machine) updateRange(pos gcode.Position) {
 }
 
 func (m *machine) RapidTo(pos gcode.Position) error {
-	fmt.Fprintf(&m.w, "  {rapidTo: %s},\n", pos)
+	m.writeMove("rapidTo", pos)
 	return nil
 }
 
 func (m *machine) LinearTo(pos gcode.Position) error {
 	m.updateRange(pos)
-	fmt.Fprintf(&m.w, "  {linearTo: %s},\n", pos)
+	m.writeMove("linearTo", pos)
 	return nil
 }
 
@@ -142,10 +201,14 @@ func (m *machine) htmlOutput(base string) (string, error) {
 	}
 	defer w.Close()
 
-	fmt.Fprintf(w, indexHTML, filepath.Base(w.Name()), m.config(), m.w.String())
+	m.writeHTML(w, filepath.Base(w.Name()))
 	return w.Name(), nil
 }
 
+func (m *machine) writeHTML(w io.Writer, title string) {
+	fmt.Fprintf(w, indexHTML, title, m.config(), m.w.String())
+}
+
 func main() {
 	flag.Parse()
 	args := flag.Args()
@@ -163,6 +226,16 @@ func main() {
 		features = gcode.AllFeatures
 	}
 
+	var envelope *gcode.Position
+	if *envelopeFlag != "" {
+		var err error
+		envelope, err = parseEnvelope(*envelopeFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "gcview: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
 	if len(args) < 1 {
 		fmt.Fprintln(os.Stderr, "gcview: no gcode file(s) specified")
 		os.Exit(1)
@@ -178,9 +251,12 @@ func main() {
 
 		base := filepath.Base(arg)
 		m := machine{
-			base: base,
+			errW:     os.Stderr,
+			base:     base,
+			envelope: envelope,
 		}
 		eng := gcode.NewEngine(&m, features, os.Stdout, os.Stderr)
+		eng.CommentHandlers = map[string]func(body string) error{"view": m.viewComment}
 		err = eng.Evaluate(bufio.NewReader(f))
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "gcview: %s: %s\n", base, err)
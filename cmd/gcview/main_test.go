@@ -0,0 +1,119 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/leftmike/gcode"
+)
+
+func TestAnnotations(t *testing.T) {
+	s := `
+G21
+T3
+S1000 M3
+G1 X1 F10
+G4 P1.5
+M5
+`
+
+	m := machine{base: "test.gcode"}
+	eng := gcode.NewEngine(&m, gcode.AllFeatures, nil, nil)
+	err := eng.Evaluate(strings.NewReader(s))
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	}
+
+	var w strings.Builder
+	m.writeHTML(&w, "test.gcode")
+	out := w.String()
+	for _, want := range []string{
+		"{selectTool: 3},\n  {setSpindle: {speed: 1000.0000, clockwise: true}},\n",
+		"{linearTo: ",
+		"{linearTo: {x: 1.0000, y: 0.0000, z: 0.0000}},\n  {dwell: 1.5000},\n",
+		"{setSpindle: null},\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("writeHTML() did not contain %q", want)
+		}
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	s := `
+G21
+G0 X1 Y1 Z1
+G1 X20 Y1 Z-1 F10
+G1 X1 Y1 Z-1
+`
+
+	envelope, err := parseEnvelope("10,10,5")
+	if err != nil {
+		t.Fatalf("parseEnvelope() failed: %s", err)
+	}
+	var errW strings.Builder
+	m := machine{errW: &errW, base: "test.gcode", envelope: envelope}
+	eng := gcode.NewEngine(&m, gcode.AllFeatures, nil, nil)
+	err = eng.Evaluate(strings.NewReader(s))
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	}
+
+	var w strings.Builder
+	m.writeHTML(&w, "test.gcode")
+	out := w.String()
+	if strings.Count(out, "outside: true") != 1 {
+		t.Errorf("writeHTML() did not flag exactly one move: %s", m.w.String())
+	}
+	if !strings.Contains(out, "{linearTo: {x: 20.0000, y: 1.0000, z: -1.0000}, outside: true},") {
+		t.Errorf("writeHTML() did not flag the move to X20")
+	}
+	if !strings.Contains(errW.String(), "test.gcode: linearTo") ||
+		!strings.Contains(errW.String(), "outside the envelope") {
+		t.Errorf("move outside the envelope not reported: %q", errW.String())
+	}
+
+	for _, s := range []string{"", "1,2", "1,2,x", "1,-2,3", "1,2,3,4"} {
+		_, err := parseEnvelope(s)
+		if err == nil {
+			t.Errorf("parseEnvelope(%q) did not fail", s)
+		}
+	}
+}
+
+func TestViewBreak(t *testing.T) {
+	s := `
+G21
+G1 X1 F10
+(VIEW,BREAK)
+G1 X2
+;view, break
+G1 X3
+`
+
+	m := machine{base: "test.gcode"}
+	eng := gcode.NewEngine(&m, gcode.AllFeatures, nil, nil)
+	eng.CommentHandlers = map[string]func(body string) error{"view": m.viewComment}
+	err := eng.Evaluate(strings.NewReader(s))
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	}
+
+	want := `  {linearTo: {x: 1.0000, y: 0.0000, z: 0.0000}},
+  {stage: true},
+  {linearTo: {x: 2.0000, y: 0.0000, z: 0.0000}},
+  {stage: true},
+  {linearTo: {x: 3.0000, y: 0.0000, z: 0.0000}},
+`
+	if m.w.String() != want {
+		t.Errorf("cmds: got %q want %q", m.w.String(), want)
+	}
+
+	m = machine{base: "test.gcode"}
+	eng = gcode.NewEngine(&m, gcode.AllFeatures, nil, nil)
+	eng.CommentHandlers = map[string]func(body string) error{"view": m.viewComment}
+	err = eng.Evaluate(strings.NewReader("(VIEW,STOP)\n"))
+	if err == nil {
+		t.Errorf("Evaluate(VIEW,STOP) did not fail")
+	}
+}
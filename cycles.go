@@ -0,0 +1,204 @@
+package gcode
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+const (
+	// peckClearance is how far above the bottom of the previous peck G83 rapids back down to.
+	peckClearance = 0.254 // 0.010 inches, like LinuxCNC.
+)
+
+// cannedCycle is the state of the canned cycles (G81, G82, and G83). Z, R, P, and Q are sticky:
+// once specified, they are used by later cycles until they are specified again.
+type cannedCycle struct {
+	z, r     float64 // Bottom of the hole and the retract plane, in machine coordinates.
+	dwell    float64 // P, in seconds.
+	peck     float64 // Q, in mm.
+	clearZ   float64 // Z before the cycles started; G98 retracts to here.
+	retractR bool    // G99 rather than G98.
+	hasZ     bool
+	hasR     bool
+	hasDwell bool
+	hasPeck  bool
+}
+
+func (mm moveMode) isCannedCycle() bool {
+	return mm == drillMove || mm == drillDwellMove || mm == peckDrillMove
+}
+
+// startCannedCycle sets the move mode to a canned cycle; if a canned cycle was not already
+// active, the current Z is saved for G98.
+func (eng *engine) startCannedCycle(mm moveMode) {
+	if !eng.moveMode.isCannedCycle() {
+		eng.cycle.clearZ = eng.curPos.Z
+	}
+	eng.moveMode = mm
+}
+
+// cancelCannedCycle clears the canned cycle, except for the retract mode, and leaves no motion
+// mode active, so axis words are rejected until a motion code is evaluated.
+func (eng *engine) cancelCannedCycle() {
+	eng.cycle = cannedCycle{retractR: eng.cycle.retractR}
+	eng.moveMode = noMove
+}
+
+func (eng *engine) dwellFor(seconds float64) error {
+	if d, ok := eng.machine.(Dweller); ok {
+		eng.trace("dwell %s", Number(seconds))
+		return d.Dwell(seconds)
+	}
+	_, err := eng.handleUnknown(Code{'G', Number(4)}, []Code{{'P', Number(seconds)}},
+		eng.setCurrentPosition)
+	return err
+}
+
+func (eng *engine) cannedCycle(codes []Code, useMachine bool) ([]Code, error) {
+	if useMachine {
+		return nil, errors.New("G53 not allowed with canned cycles")
+	}
+	if !eng.absoluteMode {
+		return nil, errors.New("canned cycles require absolute distance mode (G90)")
+	}
+	if eng.arcPlane != XYPlane {
+		return nil, errors.New("canned cycles require the XY plane (G17)")
+	}
+	if eng.feedMode == InverseTimeFeed {
+		return nil, errors.New("canned cycles not allowed in inverse time feed mode (G93)")
+	}
+
+	var err error
+	var args []arg
+	args, codes, err = eng.parseArgs(codes, fArg|pArg|qArg|rArg|xArg|yArg|zArg)
+	if err != nil {
+		return nil, err
+	}
+
+	pos := eng.curPos
+	var hasAxis bool
+	for _, arg := range args {
+		switch arg.letter {
+		case 'F':
+			err = eng.setFeed(float64(arg.num))
+			if err != nil {
+				return nil, err
+			}
+		case 'P':
+			if arg.num < 0 {
+				return nil, fmt.Errorf("expected a non-negative dwell: P%s", arg.num)
+			}
+			eng.cycle.dwell = float64(arg.num)
+			eng.cycle.hasDwell = true
+		case 'Q':
+			if arg.num <= 0 {
+				return nil, fmt.Errorf("expected a positive peck depth: Q%s", arg.num)
+			}
+			eng.cycle.peck = float64(arg.num) * eng.units
+			eng.cycle.hasPeck = true
+		case 'R':
+			eng.cycle.r = eng.toMachineZ(float64(arg.num)*eng.units, true)
+			eng.cycle.hasR = true
+		case 'X':
+			pos.X = eng.toMachineX(float64(arg.num)*eng.units, true)
+			hasAxis = true
+		case 'Y':
+			pos.Y = eng.toMachineY(float64(arg.num)*eng.units, true)
+			hasAxis = true
+		case 'Z':
+			eng.cycle.z = eng.toMachineZ(float64(arg.num)*eng.units, true)
+			eng.cycle.hasZ = true
+			hasAxis = true
+		}
+	}
+
+	// Like LinuxCNC, only drill a hole if the block has an axis word; otherwise, just remember
+	// the values for later holes.
+	if !hasAxis {
+		return codes, nil
+	}
+
+	if !eng.cycle.hasZ {
+		return nil, errors.New("expected Z for canned cycle")
+	} else if !eng.cycle.hasR {
+		return nil, errors.New("expected R for canned cycle")
+	} else if eng.cycle.r < eng.cycle.z {
+		return nil, fmt.Errorf("expected R at or above Z for canned cycle")
+	} else if eng.moveMode == drillDwellMove && !eng.cycle.hasDwell {
+		return nil, errors.New("expected P for G82")
+	} else if eng.moveMode == peckDrillMove && !eng.cycle.hasPeck {
+		return nil, errors.New("expected Q for G83")
+	}
+
+	clearZ := eng.cycle.r
+	if !eng.cycle.retractR && eng.cycle.clearZ > clearZ {
+		clearZ = eng.cycle.clearZ
+	}
+
+	// Move up to the R plane, if below it, then over to the hole, and then down to the R plane.
+	if eng.curPos.Z < eng.cycle.r {
+		err = eng.rapidTo(Position{X: eng.curPos.X, Y: eng.curPos.Y, Z: eng.cycle.r})
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = eng.rapidTo(Position{X: pos.X, Y: pos.Y, Z: eng.curPos.Z})
+	if err != nil {
+		return nil, err
+	}
+	err = eng.rapidTo(Position{X: pos.X, Y: pos.Y, Z: eng.cycle.r})
+	if err != nil {
+		return nil, err
+	}
+
+	switch eng.moveMode {
+	case drillMove:
+		err = eng.linearTo(Position{X: pos.X, Y: pos.Y, Z: eng.cycle.z})
+	case drillDwellMove:
+		err = eng.linearTo(Position{X: pos.X, Y: pos.Y, Z: eng.cycle.z})
+		if err == nil {
+			err = eng.dwellFor(eng.cycle.dwell)
+		}
+	case peckDrillMove:
+		err = eng.peckDrill(pos)
+	default:
+		panic(fmt.Sprintf("unexpected moveMode: %d", eng.moveMode))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = eng.rapidTo(Position{X: pos.X, Y: pos.Y, Z: clearZ})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// peckDrill feeds down from the R plane in pecks of Q, retracting to the R plane after each
+// peck, and then rapid moving back down to just above the bottom of the previous peck.
+func (eng *engine) peckDrill(pos Position) error {
+	depth := eng.cycle.r
+	for {
+		next := math.Max(depth-eng.cycle.peck, eng.cycle.z)
+		err := eng.linearTo(Position{X: pos.X, Y: pos.Y, Z: next})
+		if err != nil {
+			return err
+		}
+		if next <= eng.cycle.z {
+			return nil
+		}
+
+		err = eng.rapidTo(Position{X: pos.X, Y: pos.Y, Z: eng.cycle.r})
+		if err != nil {
+			return err
+		}
+		err = eng.rapidTo(Position{X: pos.X, Y: pos.Y,
+			Z: math.Min(next+peckClearance, eng.cycle.r)})
+		if err != nil {
+			return err
+		}
+		depth = next
+	}
+}
@@ -0,0 +1,195 @@
+package gcode_test
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/leftmike/gcode"
+)
+
+func TestCannedCycles(t *testing.T) {
+	cases := []struct {
+		s       string
+		actions []action
+		dwells  []float64
+	}{
+		{s: "G21\nG0 Z5\nG81 X1 Y2 Z-3 R1 F100\nX4\nG80\n",
+			actions: []action{
+				{cmd: rapidTo, z: 5.0},
+				{cmd: setFeed, f: 100.0},
+				{cmd: rapidTo, x: 1.0, y: 2.0, z: 5.0},
+				{cmd: rapidTo, x: 1.0, y: 2.0, z: 1.0},
+				{cmd: linearTo, x: 1.0, y: 2.0, z: -3.0},
+				{cmd: rapidTo, x: 1.0, y: 2.0, z: 5.0},
+				{cmd: rapidTo, x: 4.0, y: 2.0, z: 5.0},
+				{cmd: rapidTo, x: 4.0, y: 2.0, z: 1.0},
+				{cmd: linearTo, x: 4.0, y: 2.0, z: -3.0},
+				{cmd: rapidTo, x: 4.0, y: 2.0, z: 5.0},
+			},
+		},
+		{s: "G21\nG0 Z5\nG99 G81 X1 Y2 Z-3 R1 F100\nX4 Y3\n",
+			actions: []action{
+				{cmd: rapidTo, z: 5.0},
+				{cmd: setFeed, f: 100.0},
+				{cmd: rapidTo, x: 1.0, y: 2.0, z: 5.0},
+				{cmd: rapidTo, x: 1.0, y: 2.0, z: 1.0},
+				{cmd: linearTo, x: 1.0, y: 2.0, z: -3.0},
+				{cmd: rapidTo, x: 1.0, y: 2.0, z: 1.0},
+				{cmd: rapidTo, x: 4.0, y: 3.0, z: 1.0},
+				{cmd: linearTo, x: 4.0, y: 3.0, z: -3.0},
+				{cmd: rapidTo, x: 4.0, y: 3.0, z: 1.0},
+			},
+		},
+		{s: "G21\nG0 Z5\nG81 X1 Y1 Z-1 R1 F100\nF200\nR2\nX2\n",
+			actions: []action{
+				{cmd: rapidTo, z: 5.0},
+				{cmd: setFeed, f: 100.0},
+				{cmd: rapidTo, x: 1.0, y: 1.0, z: 5.0},
+				{cmd: rapidTo, x: 1.0, y: 1.0, z: 1.0},
+				{cmd: linearTo, x: 1.0, y: 1.0, z: -1.0},
+				{cmd: rapidTo, x: 1.0, y: 1.0, z: 5.0},
+				{cmd: setFeed, f: 200.0},
+				{cmd: rapidTo, x: 2.0, y: 1.0, z: 5.0},
+				{cmd: rapidTo, x: 2.0, y: 1.0, z: 2.0},
+				{cmd: linearTo, x: 2.0, y: 1.0, z: -1.0},
+				{cmd: rapidTo, x: 2.0, y: 1.0, z: 5.0},
+			},
+		},
+		{s: "G21\nG0 Z-1\nG81 X1 Z-3 R1 F100\n",
+			actions: []action{
+				{cmd: rapidTo, z: -1.0},
+				{cmd: setFeed, f: 100.0},
+				{cmd: rapidTo, z: 1.0},
+				{cmd: rapidTo, x: 1.0, z: 1.0},
+				{cmd: linearTo, x: 1.0, z: -3.0},
+				{cmd: rapidTo, x: 1.0, z: 1.0},
+			},
+		},
+		{s: "G21\nG0 Z5\nG82 X1 Y2 Z-3 R1 P0.5 F100\nY4\n",
+			actions: []action{
+				{cmd: rapidTo, z: 5.0},
+				{cmd: setFeed, f: 100.0},
+				{cmd: rapidTo, x: 1.0, y: 2.0, z: 5.0},
+				{cmd: rapidTo, x: 1.0, y: 2.0, z: 1.0},
+				{cmd: linearTo, x: 1.0, y: 2.0, z: -3.0},
+				{cmd: rapidTo, x: 1.0, y: 2.0, z: 5.0},
+				{cmd: rapidTo, x: 1.0, y: 4.0, z: 5.0},
+				{cmd: rapidTo, x: 1.0, y: 4.0, z: 1.0},
+				{cmd: linearTo, x: 1.0, y: 4.0, z: -3.0},
+				{cmd: rapidTo, x: 1.0, y: 4.0, z: 5.0},
+			},
+			dwells: []float64{0.5, 0.5},
+		},
+		{s: "G21\nG0 Z5\nG83 X1 Y2 Z-2.5 R1 Q1 F100\n",
+			actions: []action{
+				{cmd: rapidTo, z: 5.0},
+				{cmd: setFeed, f: 100.0},
+				{cmd: rapidTo, x: 1.0, y: 2.0, z: 5.0},
+				{cmd: rapidTo, x: 1.0, y: 2.0, z: 1.0},
+				{cmd: linearTo, x: 1.0, y: 2.0, z: 0.0},
+				{cmd: rapidTo, x: 1.0, y: 2.0, z: 1.0},
+				{cmd: rapidTo, x: 1.0, y: 2.0, z: 0.254},
+				{cmd: linearTo, x: 1.0, y: 2.0, z: -1.0},
+				{cmd: rapidTo, x: 1.0, y: 2.0, z: 1.0},
+				{cmd: rapidTo, x: 1.0, y: 2.0, z: -0.746},
+				{cmd: linearTo, x: 1.0, y: 2.0, z: -2.0},
+				{cmd: rapidTo, x: 1.0, y: 2.0, z: 1.0},
+				{cmd: rapidTo, x: 1.0, y: 2.0, z: -1.746},
+				{cmd: linearTo, x: 1.0, y: 2.0, z: -2.5},
+				{cmd: rapidTo, x: 1.0, y: 2.0, z: 5.0},
+			},
+		},
+		{s: "G20\nG0 Z1\nG81 X1 Z-0.5 R0.1 F10\n",
+			actions: []action{
+				{cmd: rapidTo, z: 25.4},
+				{cmd: setFeed, f: 254.0},
+				{cmd: rapidTo, x: 25.4, z: 25.4},
+				{cmd: rapidTo, x: 25.4, z: 2.54},
+				{cmd: linearTo, x: 25.4, z: -12.7},
+				{cmd: rapidTo, x: 25.4, z: 25.4},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		m := dwellMachine{machine: machine{actions: c.actions}}
+		eng := gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+		err := eng.Evaluate(strings.NewReader(c.s))
+		if err != nil {
+			t.Errorf("Evaluate(%s) failed: %s", c.s, err)
+		} else if m.adx != len(c.actions) {
+			t.Errorf("Evaluate(%s): got %d actions want %d", c.s, m.adx, len(c.actions))
+		} else if !reflect.DeepEqual(m.dwells, c.dwells) {
+			t.Errorf("Evaluate(%s): got dwells %v want %v", c.s, m.dwells, c.dwells)
+		}
+	}
+}
+
+func TestCannedCyclesFail(t *testing.T) {
+	cases := []string{
+		"G81 X1\n",
+		"G81 X1 Z-1\n",
+		"G81 X1 R1\n",
+		"G81 X1 Z1 R-1\n",
+		"G82 X1 Z-1 R1\n",
+		"G83 X1 Z-1 R1\n",
+		"G83 X1 Z-1 R1 Q0\n",
+		"G82 X1 Z-1 R1 P-1\n",
+		"G91 G81 X1 Z-1 R1\n",
+		"G18 G81 X1 Z-1 R1\n",
+		"G53 G81 X1 Z-1 R1\n",
+		"G81 X1 Z-1 R1 I1\n",
+		"G81 X1 Z-1 R1 F100\nG80\nX2\n",
+	}
+
+	for _, c := range cases {
+		eng := gcode.NewEngine(&dwellMachine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+		err := eng.Evaluate(strings.NewReader(c))
+		if err == nil {
+			t.Errorf("Evaluate(%s) did not fail", c)
+		}
+	}
+}
+
+func TestCancelCannedCycle(t *testing.T) {
+	cases := []struct {
+		s   string
+		msg string
+	}{
+		{s: "G21\nG81 X1 Z-1 R1 F100\nG80\nX1 Y1\n", msg: "4: no active motion mode: X1"},
+		{s: "G21\nG1 X1 F100\nG80\nY1\n", msg: "4: no active motion mode: Y1"},
+		{s: "G21\nG80\nZ1\n", msg: "3: no active motion mode: Z1"},
+		{s: "G21\nG81 X1 Z-1 R1 F100\nG80\nG81 X2\n", msg: "4: expected Z for canned cycle"},
+	}
+
+	for _, c := range cases {
+		eng := gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+		err := eng.Evaluate(strings.NewReader(c.s))
+		if err == nil {
+			t.Errorf("Evaluate(%s) did not fail", c.s)
+		} else if !strings.HasPrefix(err.Error(), c.msg) {
+			t.Errorf("Evaluate(%s): got %s want %s", c.s, err, c.msg)
+		}
+	}
+
+	m := machine{
+		actions: []action{
+			{cmd: setFeed, f: 100.0},
+			{cmd: rapidTo, z: 1.0},
+			{cmd: rapidTo, x: 1.0, z: 1.0},
+			{cmd: linearTo, x: 1.0, z: -1.0},
+			{cmd: rapidTo, x: 1.0, z: 1.0},
+			{cmd: rapidTo, x: 2.0, z: 1.0},
+			{cmd: linearTo, x: 3.0, z: 1.0},
+		},
+	}
+	eng := gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+	err := eng.Evaluate(strings.NewReader("G21\nG81 X1 Z-1 R1 F100\nG80\nG0 X2\nG1 X3\n"))
+	if err != nil {
+		t.Errorf("Evaluate(G80 G0) failed: %s", err)
+	} else if m.adx != len(m.actions) {
+		t.Errorf("Evaluate(G80 G0): got %d actions want %d", m.adx, len(m.actions))
+	}
+}
@@ -2,16 +2,7 @@ package gcode
 
 /*
 To Do:
-- RepRap:
--- parser: support {} instead of [] for expressions
-
 - LinuxCNC:
--- #1 to #30 are subroutine parameters and are local to the subroutine
--- #<name> are local to the scope where it is assigned; scoped to subroutines
--- #31 and above, and #<_name> are global
--- O codes
--- O codes can be followed by a number or a name
--- Subroutines can change the value of parameters above #30 and those changes will be visible to the calling code. Subroutines may also change the value of global named parameters.
 -- predefined named parameters
 
 - load and save persistent parameters
@@ -26,6 +17,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
+	"strings"
 )
 
 const (
@@ -40,10 +34,59 @@ func (pos Position) String() string {
 	return fmt.Sprintf("{x: %s, y: %s, z: %s}", Number(pos.X), Number(pos.Y), Number(pos.Z))
 }
 
+func (pos Position) finite() bool {
+	for _, f := range []float64{pos.X, pos.Y, pos.Z} {
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return false
+		}
+	}
+	return true
+}
+
 var (
 	zeroPosition = Position{0.0, 0.0, 0.0}
 )
 
+// FeedMode is how the feed of a move is specified.
+type FeedMode byte
+
+const (
+	UnitsPerMinuteFeed     FeedMode = iota // G94
+	InverseTimeFeed                        // G93: the move takes 1/feed minutes.
+	UnitsPerRevolutionFeed                 // G95
+)
+
+func distance(from, to Position) float64 {
+	return math.Sqrt((to.X-from.X)*(to.X-from.X) + (to.Y-from.Y)*(to.Y-from.Y) +
+		(to.Z-from.Z)*(to.Z-from.Z))
+}
+
+// MoveDuration returns the number of seconds a move from one position to another takes at a
+// feed; if the feed is not positive, the duration is infinite. For UnitsPerRevolutionFeed, the
+// duration depends on the spindle speed, so NaN is returned; instead, multiply the feed by the
+// spindle speed and use UnitsPerMinuteFeed.
+func MoveDuration(from, to Position, feed float64, mode FeedMode) float64 {
+	switch mode {
+	case UnitsPerMinuteFeed:
+		dist := distance(from, to)
+		if dist == 0.0 {
+			return 0.0
+		} else if feed <= 0.0 {
+			return math.Inf(1)
+		}
+		return dist / feed * 60.0
+	case InverseTimeFeed:
+		if feed <= 0.0 {
+			return math.Inf(1)
+		}
+		return 60.0 / feed
+	case UnitsPerRevolutionFeed:
+		return math.NaN()
+	default:
+		panic(fmt.Sprintf("unexpected feed mode: %d", mode))
+	}
+}
+
 type Machine interface {
 	SetFeed(feed float64) error
 	SetSpindle(speed float64, clockwise bool) error
@@ -54,6 +97,93 @@ type Machine interface {
 	HandleUnknown(code Code, codes []Code, setCurPos func(pos Position) error) ([]Code, error)
 }
 
+// MultiSpindle is optionally implemented by machines with more than one spindle. When a line
+// includes $n (LinuxCNC), the M3, M4, M5, and S codes on that line apply to spindle n and are
+// passed to SetSpindleN instead of SetSpindle and SpindleOff; a speed of zero turns the spindle
+// off.
+type MultiSpindle interface {
+	SetSpindleN(index int, speed float64, clockwise bool) error
+}
+
+// SpindleOrienter is optionally implemented by machines which can orient the spindle to an
+// angle, such as for a tool change. M19 R*n.n* is passed to OrientSpindle, with degrees
+// defaulting to zero; for machines which don't implement SpindleOrienter, M19 is passed to
+// HandleUnknown.
+type SpindleOrienter interface {
+	OrientSpindle(degrees float64) error
+}
+
+// Dweller is optionally implemented by machines which can dwell, pausing without moving. G4
+// P*n.n* is passed to Dwell, with P in seconds; when the RepRap feature is enabled without the
+// LinuxCNC feature, P is in milliseconds, and G4 S*n.n* dwells for S seconds. For machines which
+// don't implement Dweller, G4 is passed to HandleUnknown.
+type Dweller interface {
+	Dwell(seconds float64) error
+}
+
+// Pauser is optionally implemented by machines which can pause the program. M0 pauses and M1
+// pauses if the optional stop switch is on, which the machine decides; the message is the body
+// of a MSG comment on the same line, if any. Evaluation continues once Pause returns. For
+// machines which don't implement Pauser, M0 and M1 are passed to HandleUnknown.
+type Pauser interface {
+	Pause(optional bool, message string) error
+}
+
+// ToolChanger is optionally implemented by machines which change tools with M6. T selects a
+// tool, which is passed to SelectTool, and M6 passes the selected tool to ChangeTool. For
+// machines which don't implement ToolChanger, M6 is passed to HandleUnknown.
+type ToolChanger interface {
+	ChangeTool(tool uint) error
+}
+
+// CoolantSetter is optionally implemented by machines with mist or flood coolant. M7 turns mist
+// coolant on, M8 turns flood coolant on, and M9 turns both off; after each, SetCoolant is passed
+// the state of both. For machines which don't implement CoolantSetter, M7, M8, and M9 are passed
+// to HandleUnknown.
+type CoolantSetter interface {
+	SetCoolant(mist, flood bool) error
+}
+
+// PathModeSetter is optionally implemented by machines which support path control modes: G61
+// and G61.1 select exact stop mode and G64 selects continuous mode, with an optional blending
+// tolerance (P) and naive CAM tolerance (Q). Tolerances which are not specified are zero.
+type PathModeSetter interface {
+	SetPathMode(exactStop bool, tolerance, naiveCAMTolerance float64) error
+}
+
+// OverrideEnabler is optionally implemented by machines with feed and spindle speed overrides,
+// such as knobs on a control panel. M48 enables both overrides and M49 disables them; after
+// each, FeedOverrideEnable and SpeedOverrideEnable are called. Overrides are enabled again at
+// the end of the program.
+type OverrideEnabler interface {
+	FeedOverrideEnable(enable bool) error
+	SpeedOverrideEnable(enable bool) error
+}
+
+// CurrentPosition is passed to HandleUnknownAt to get and set the current position, in machine
+// coordinates and mm.
+type CurrentPosition interface {
+	Get() Position
+	Set(pos Position) error
+}
+
+// UnknownHandler is optionally implemented by machines which need the current position to
+// handle unknown codes, such as to implement canned cycles relative to it. For machines which
+// implement UnknownHandler, unknown codes are passed to HandleUnknownAt instead of
+// HandleUnknown.
+type UnknownHandler interface {
+	HandleUnknownAt(code Code, codes []Code, curPos CurrentPosition) ([]Code, error)
+}
+
+// PathMode is a path control mode.
+type PathMode byte
+
+const (
+	ContinuousPathMode PathMode = iota // G64 (the default): moves may be blended.
+	ExactPathMode                      // G61: the path is followed exactly.
+	ExactStopMode                      // G61.1: the machine stops at the end of each move.
+)
+
 type moveMode byte
 
 const (
@@ -61,8 +191,18 @@ const (
 	linearMove                              // G1
 	clockwiseArcMove                        // G2
 	counterClockwiseArcMove                 // G3
+	drillMove                               // G81
+	drillDwellMove                          // G82
+	peckDrillMove                           // G83
+	noMove                                  // G80
 )
 
+type spindleState struct {
+	on        bool
+	speed     float64
+	clockwise bool
+}
+
 type Plane byte
 
 const (
@@ -71,7 +211,158 @@ const (
 	YZPlane              // G19
 )
 
+// State is a snapshot of the modal state of the engine.
+type State struct {
+	Position         Position // Machine position, in mm.
+	Inches           bool     // G20 rather than G21.
+	Absolute         bool     // G90 rather than G91.
+	Plane            Plane
+	CoordinateSystem int // 1 is G54 and 9 is G59.3.
+
+	// The offsets, in mm, of the current coordinate system, from G52, and from G92.
+	CoordinateSystemOffset Position
+	LocalOffset            Position
+	WorkOffset             Position
+	ToolLengthOffset       float64 // From G43; zero after G49.
+
+	SpindleOn        bool
+	SpindleSpeed     float64 // In RPM, including in constant surface speed mode (G96).
+	SpindleClockwise bool
+	ConstantSurface  bool // G96 rather than G97.
+	Mist             bool // M7
+	Flood            bool // M8
+	Tool             uint
+	Feed             float64  // In the units of the feed mode, in mm rather than inches.
+	FeedMode         FeedMode // G94 (the default), G93, or G95.
+}
+
 type engine struct {
+	// RetainFeedOnZero causes an F0 to be ignored, retaining the previous feed, rather than
+	// being rejected with an error.
+	RetainFeedOnZero bool
+
+	// DefaultFeed, if set, is the feed, in mm per minute, passed to SetFeed before the first feed
+	// move in units per minute feed mode (G94) if no feed has been set with F.
+	DefaultFeed float64
+
+	// RequireFeed causes a feed move to fail if no feed has been set with F and DefaultFeed is
+	// not set; otherwise, the machine is left to use its own feed.
+	RequireFeed bool
+
+	// InitialTool is the tool loaded at startup, before any T code is evaluated.
+	InitialTool uint
+
+	// UnknownCodes, if set, is called with each unknown code passed to the machine's
+	// HandleUnknown, together with the following codes on the line which HandleUnknown did not
+	// return to the engine. This allows the codes which the engine did not evaluate to be
+	// audited, even when HandleUnknown silently drops them. If HandleUnknown returns codes
+	// other than a tail of the codes it was passed, only the unknown code is reported.
+	UnknownCodes func(codes []Code)
+
+	// CodeFilter, if set, is called with the codes of each line before they are evaluated; the
+	// returned codes are evaluated instead, so codes may be added, dropped, or rewritten. If an
+	// error is returned, evaluation stops.
+	CodeFilter func(codes []Code) ([]Code, error)
+
+	// Warn, if set, is called with the line number and the message of non-fatal diagnostics,
+	// such as when the turns of an arc are clamped or the end of an arc is slightly off the
+	// circle; otherwise, warnings are written to errW. Warn is also used by the parser.
+	Warn func(line int, msg string)
+
+	// PlanarArcTurns is the maximum number of turns (P) for an arc without helical motion;
+	// larger values are clamped with a warning. If zero, 2 is used.
+	PlanarArcTurns uint
+
+	// ArcHandler, if set, is called with each arc before it is approximated by lines, such as
+	// to handle arcs in the planes which the machine supports, or to reject arcs in the planes
+	// which it doesn't. If ArcHandler returns true, the arc has been handled and the current
+	// position is the end of the arc; otherwise, the arc is approximated by lines.
+	ArcHandler func(arc Arc) (bool, error)
+
+	// ArcTolerance is the maximum distance, in mm, between an arc and the lines which
+	// approximate it. If zero, arcs are approximated by lines about 0.1 mm long.
+	ArcTolerance float64
+
+	// Lathe enables G7 (diameter mode), in which X words of G0 and G1 are a diameter and are
+	// halved, and G8 (radius mode, the default), and G96 (constant surface speed) and G97 (RPM
+	// mode, the default). Otherwise, G7, G8, G96, and G97 are passed to HandleUnknown.
+	Lathe bool
+
+	// ZFirstHoming causes G28 and G30 to move Z to the predefined position, through the
+	// intermediate point if Z is given, before moving X and Y.
+	ZFirstHoming bool
+
+	// RequireProgramEnd causes Evaluate to fail if the program does not end with M2 or M30, such
+	// as when the input was truncated.
+	RequireProgramEnd bool
+
+	// TraceWriter, if set, is written a line for each operation dispatched to the machine,
+	// prefixed by the source line: moves are traced with the machine position and, for
+	// linearTo, the feed.
+	TraceWriter io.Writer
+
+	// LineNumberExpr allows N to be followed by an expression; see Parser.LineNumberExpr.
+	LineNumberExpr bool
+
+	// MaxReferences limits the number of leading # in a parameter reference; see
+	// Parser.MaxReferences.
+	MaxReferences int
+
+	// BeagleGComments evaluates MSG, DEBUG, and PRINT comments when the BeagleG feature is
+	// enabled; see Parser.BeagleGComments.
+	BeagleGComments bool
+
+	// PrefixedIntegers allows 0x and 0b integers in expressions; see Parser.PrefixedIntegers.
+	PrefixedIntegers bool
+
+	// BitwiseOperators allows &, |, and ~ in expressions; see Parser.BitwiseOperators.
+	BitwiseOperators bool
+
+	// LineTerminator ends each line written for MSG, DEBUG, and PRINT comments; see
+	// Parser.LineTerminator.
+	LineTerminator string
+
+	// RequireChecksum rejects lines without a checksum when the RepRap feature is enabled; see
+	// Parser.RequireChecksum.
+	RequireChecksum bool
+
+	// CommentHandlers are called with the body of matching comments; see
+	// Parser.CommentHandlers.
+	CommentHandlers map[string]func(body string) error
+
+	// DefaultsComment handles (DEFAULTS,F*n.n* S*n.n*) comments, which set the feed and the
+	// spindle speed, such as in the header of a program; the feed is used by moves until F is
+	// specified.
+	DefaultsComment bool
+
+	// WarnRedundantModes warns when a modal code, such as G90, selects the mode which is already
+	// active after an earlier code in the same group, such as G90 or G91, was evaluated; the
+	// modal codes at the start of a program are not redundant.
+	WarnRedundantModes bool
+
+	// WarnRedundantMoves warns when G0 or G1 moves to the current position; such moves are not
+	// passed to the machine.
+	WarnRedundantMoves bool
+
+	// IgnoreUnknownMCodes ignores M codes which the engine does not handle, together with the
+	// following codes on the line up to the next G or M code, rather than passing them to
+	// HandleUnknown.
+	IgnoreUnknownMCodes bool
+
+	// ParamProviders are consulted, in order, for global parameters which have not been set by
+	// the program, and are offered, in order, the parameters which the program sets; see
+	// ParamProvider. The predefined parameters, such as #5220, are handled by the engine.
+	ParamProviders []ParamProvider
+
+	// BreakBeforeMCodes causes Evaluate to stop, returning a BreakError, before evaluating a line
+	// with one of the M codes, such as 6 to pause before each tool change; Continue evaluates
+	// the line and the rest of the program.
+	BreakBeforeMCodes []float64
+
+	// LastWordWins causes the last of duplicate args, such as X in G0 X1 X2, to be used rather
+	// than rejecting the duplicate with an error.
+	LastWordWins bool
+
 	machine          Machine
 	features         Features
 	outW             io.Writer
@@ -85,15 +376,43 @@ type engine struct {
 	maxPos           Position
 	curCoordSys      int
 	coordSysPos      [9]Position
+	localPos         Position // G52 offset applied on top of the coordinate system.
 	workPos          Position
 	useWorkPos       bool
+	toolLengthOffset float64          // G43 offset in mm; zero after G49.
+	toolOffsets      map[uint]float64 // Tool length offsets in mm, keyed by tool number (H).
 	moveMode         moveMode
+	cycle            cannedCycle
+	probePos         Position // Last probe position in the coordinate system at the time, in mm.
+	probeContact     bool
 	absoluteMode     bool
 	absoluteArcMode  bool
+	diameterMode     bool    // G7 rather than G8.
+	constantSurface  bool    // G96 rather than G97.
+	surfaceSpeed     float64 // The surface speed for G96, in mm per minute; zero until S.
+	maxSpindleSpeed  float64 // The maximum spindle speed (D) for G96; zero if no maximum.
 	arcPlane         Plane
-	spindleOn        bool
-	spindleSpeed     float64
-	spindleClockwise bool
+	spindles         []spindleState // Spindle zero is the default spindle.
+	mist             bool
+	flood            bool
+	curTool          uint
+	toolSelected     bool // Set once a T code has been evaluated.
+	loadedTool       uint
+	toolChanged      bool // Set once M6 has changed the tool.
+	programEnded     bool // Set when M2 or M30 ends the program.
+	modalGroups      int  // Bit set of the modal groups evaluated; for WarnRedundantModes.
+	pathMode         PathMode
+	feed             float64  // The feed in the units of feedMode, converted to mm.
+	feedMode         FeedMode // G93, G94, or G95; for G93, SetFeed is called for each move.
+	programmedFeed   float64  // The feed as programmed by F, before converting to mm.
+	feedOverride     float64  // #<_feed_override> scales the feed passed to SetFeed.
+	noOverrides      bool     // M49 disables overrides and M48 enables them.
+	parser           *Parser  // The parser of the program being evaluated; used by Continue.
+	breakCodes       []Code   // The codes of the line at which evaluation stopped, if any.
+	line             string   // The source line being evaluated; used for tracing.
+	lineNum          int      // The physical line number of line; used for warnings.
+	pathTolerance    float64
+	naiveCAMTol      float64
 }
 
 func NewEngine(m Machine, f Features, outW, errW io.Writer) *engine {
@@ -115,254 +434,867 @@ func NewEngine(m Machine, f Features, outW, errW io.Writer) *engine {
 			zeroPosition, zeroPosition, zeroPosition,
 			zeroPosition, zeroPosition, zeroPosition,
 		},
-		workPos:          zeroPosition,
-		useWorkPos:       false,
-		moveMode:         linearMove,
-		absoluteMode:     true,
-		absoluteArcMode:  false,
-		arcPlane:         XYPlane,
-		spindleOn:        false,
-		spindleSpeed:     0.0,
-		spindleClockwise: true,
+		localPos:        zeroPosition,
+		workPos:         zeroPosition,
+		useWorkPos:      false,
+		moveMode:        linearMove,
+		absoluteMode:    true,
+		absoluteArcMode: false,
+		arcPlane:        XYPlane,
+		spindles:        []spindleState{{on: false, speed: 0.0, clockwise: true}},
+		feedOverride:    1.0,
 	}
 }
 
+// endProgram resets the modal state to the defaults at startup so that the engine may be reused
+// for another program; units are reset to mm.
 func (eng *engine) endProgram() error {
+	eng.units = 1.0
 	eng.moveMode = linearMove
 	eng.curCoordSys = 0
+	eng.localPos = zeroPosition
 	eng.arcPlane = XYPlane
 	eng.absoluteMode = true
-	if eng.spindleOn {
-		eng.spindleOn = false
-		return eng.spindleOff()
+	eng.setFeedMode(UnitsPerMinuteFeed)
+	if eng.noOverrides {
+		err := eng.enableOverrides(true)
+		if err != nil {
+			return err
+		}
+	}
+	for index := range eng.spindles {
+		if eng.spindles[index].on {
+			eng.spindles[index].on = false
+			err := eng.updateSpindle(index, index > 0)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if cs, ok := eng.machine.(CoolantSetter); ok && (eng.mist || eng.flood) {
+		return eng.setCoolant(cs, false, false)
 	}
 	return nil
 }
 
-func (eng *engine) setFeed(feed float64) error {
-	return eng.machine.SetFeed(feed)
-}
-
-func (eng *engine) setSpindle(speed float64, clockwise bool) error {
-	return eng.machine.SetSpindle(speed, clockwise)
-}
-
-func (eng *engine) spindleOff() error {
-	return eng.machine.SpindleOff()
-}
-
-func (eng *engine) selectTool(tool uint) error {
-	return eng.machine.SelectTool(tool)
-}
-
-func (eng *engine) handleUnknown(code Code, codes []Code,
-	setCurPos func(pos Position) error) ([]Code, error) {
-
-	return eng.machine.HandleUnknown(code, codes, setCurPos)
+func (eng *engine) enableOverrides(enable bool) error {
+	eng.noOverrides = !enable
+	if oe, ok := eng.machine.(OverrideEnabler); ok {
+		eng.trace("enableOverrides %v", enable)
+		err := oe.FeedOverrideEnable(enable)
+		if err != nil {
+			return err
+		}
+		return oe.SpeedOverrideEnable(enable)
+	}
+	return nil
 }
 
-func (eng *engine) rapidTo(pos Position) error {
-	if pos == eng.curPos {
-		return nil
-	}
-	err := eng.machine.RapidTo(pos)
+func (eng *engine) setCoolant(cs CoolantSetter, mist, flood bool) error {
+	eng.trace("setCoolant %v %v", mist, flood)
+	err := cs.SetCoolant(mist, flood)
 	if err != nil {
 		return err
 	}
-	eng.curPos = pos
+	eng.mist = mist
+	eng.flood = flood
 	return nil
 }
 
-func (eng *engine) linearTo(pos Position) error {
-	if pos == eng.curPos {
-		return nil
+// setFeed sets the feed to F num in the current units and feed mode. In inverse time feed mode
+// (G93), the feed is passed to the machine by each move, and in units per revolution feed mode
+// (G95), once the spindle speed is set.
+func (eng *engine) setFeed(num float64) error {
+	feed := num
+	if eng.feedMode != InverseTimeFeed {
+		feed *= eng.units
 	}
-	err := eng.machine.LinearTo(pos)
-	if err != nil {
-		return err
+	if Number(feed).Equal(0.0) {
+		if eng.RetainFeedOnZero {
+			return nil
+		}
+		return errors.New("feed must not be zero: F0")
 	}
-	eng.curPos = pos
+	if eng.feedMode == UnitsPerMinuteFeed ||
+		(eng.feedMode == UnitsPerRevolutionFeed && eng.spindleState(0).speed > 0.0) {
+
+		err := eng.updateFeed(eng.feedPerMinute(feed, 0.0))
+		if err != nil {
+			return err
+		}
+	}
+	eng.feed = feed
+	eng.programmedFeed = num
 	return nil
 }
 
-func (eng *engine) setCurrentPosition(pos Position) error {
-	eng.curPos = pos
-	return nil
+// feedPerMinute returns the feed, in mm per minute, for a feed in the units of the feed mode;
+// for inverse time feed mode (G93), dist is the length of the move, in mm.
+func (eng *engine) feedPerMinute(feed, dist float64) float64 {
+	switch eng.feedMode {
+	case InverseTimeFeed:
+		return feed * dist
+	case UnitsPerRevolutionFeed:
+		return feed * eng.spindleState(0).speed
+	default:
+		return feed
+	}
 }
 
-type arg struct {
-	letter Letter
-	num    Number
+// updateFeed passes a feed, in mm per minute, scaled by #<_feed_override>, to the machine.
+func (eng *engine) updateFeed(feed float64) error {
+	override := eng.feedOverride
+	if eng.noOverrides {
+		override = 1.0
+	}
+	eng.trace("setFeed %s", Number(feed*override))
+	return eng.machine.SetFeed(feed * override)
 }
 
-type argSet int
+// setFeedMode selects a feed mode; when the mode changes, the feed must be set again with F.
+func (eng *engine) setFeedMode(mode FeedMode) {
+	if eng.feedMode != mode {
+		eng.feedMode = mode
+		eng.feed = 0.0
+	}
+}
 
-const (
-	fArg = 1 << iota
-	iArg
-	jArg
-	kArg
-	lArg
-	pArg
-	rArg
-	xArg
-	yArg
-	zArg
-)
+// inverseTimeFeed passes the feed for a move of length dist, in mm, to the machine in inverse
+// time feed mode (G93), in which F is required for each feed move.
+func (eng *engine) inverseTimeFeed(args []arg, dist float64) error {
+	if eng.feedMode != InverseTimeFeed {
+		return nil
+	} else if !hasArg(args, 'F') {
+		return errors.New("expected F for each feed move in inverse time feed mode (G93)")
+	} else if dist < minimumDelta {
+		return nil
+	}
+	return eng.updateFeed(eng.feedPerMinute(eng.feed, dist))
+}
 
-func parseArgs(codes []Code, allowed argSet) ([]arg, []Code, error) {
-	var args []arg
-	for len(codes) > 0 {
-		code := codes[0]
-		switch code.Letter {
-		case 'F':
-			if (allowed & fArg) == 0 {
-				return nil, nil, fmt.Errorf("arg not allowed: %s", code)
-			}
-		case 'I':
-			if (allowed & iArg) == 0 {
-				return nil, nil, fmt.Errorf("arg not allowed: %s", code)
-			}
-		case 'J':
-			if (allowed & jArg) == 0 {
-				return nil, nil, fmt.Errorf("arg not allowed: %s", code)
-			}
-		case 'K':
-			if (allowed & kArg) == 0 {
-				return nil, nil, fmt.Errorf("arg not allowed: %s", code)
-			}
-		case 'L':
-			if (allowed & lArg) == 0 {
-				return nil, nil, fmt.Errorf("arg not allowed: %s", code)
-			}
-		case 'P':
-			if (allowed & pArg) == 0 {
-				return nil, nil, fmt.Errorf("arg not allowed: %s", code)
-			}
-		case 'R':
-			if (allowed & rArg) == 0 {
-				return nil, nil, fmt.Errorf("arg not allowed: %s", code)
-			}
-		case 'X':
-			if (allowed & xArg) == 0 {
-				return nil, nil, fmt.Errorf("arg not allowed: %s", code)
-			}
-		case 'Y':
-			if (allowed & yArg) == 0 {
-				return nil, nil, fmt.Errorf("arg not allowed: %s", code)
-			}
-		case 'Z':
-			if (allowed & zArg) == 0 {
-				return nil, nil, fmt.Errorf("arg not allowed: %s", code)
-			}
-		default:
-			return args, codes, nil
+func (eng *engine) trace(format string, args ...interface{}) {
+	if eng.TraceWriter != nil {
+		fmt.Fprintf(eng.TraceWriter, "%s: %s\n", eng.line, fmt.Sprintf(format, args...))
+	}
+}
+
+// selectSpindle removes $n from the codes and returns n, or -1 if no spindle was selected.
+func (eng *engine) selectSpindle(codes []Code) ([]Code, int, error) {
+	spindle := -1
+	for cdx := 0; cdx < len(codes); {
+		code := codes[cdx]
+		if code.Letter != '$' {
+			cdx += 1
+			continue
 		}
 
-		for _, arg := range args {
-			if arg.letter == code.Letter {
-				return nil, nil, fmt.Errorf("duplicate arg specified: %s", code)
-			}
+		if spindle >= 0 {
+			return nil, 0, fmt.Errorf("duplicate spindle specified: %s", code)
 		}
 		num, ok := code.Value.AsNumber()
 		if !ok {
-			return nil, nil, fmt.Errorf("expected a number: %v", code.Value)
+			return nil, 0, fmt.Errorf("expected a number: %s", code)
 		}
-
-		args = append(args, arg{code.Letter, num})
-		codes = codes[1:]
+		n, ok := num.AsInteger()
+		if !ok || n < 0 {
+			return nil, 0, fmt.Errorf("expected a non-negative integer: $%s", num)
+		}
+		if _, ok := eng.machine.(MultiSpindle); !ok && n > 0 {
+			return nil, 0, fmt.Errorf("machine does not support multiple spindles: $%d", n)
+		}
+		spindle = n
+		codes = append(codes[:cdx:cdx], codes[cdx+1:]...)
 	}
+	return codes, spindle, nil
+}
 
-	return args, codes, nil
+func (eng *engine) spindleState(spindle int) *spindleState {
+	if spindle < 0 {
+		spindle = 0
+	}
+	for len(eng.spindles) <= spindle {
+		eng.spindles = append(eng.spindles, spindleState{on: false, speed: 0.0, clockwise: true})
+	}
+	return &eng.spindles[spindle]
 }
 
-func requireArg(args []arg, letter Letter) (Number, error) {
-	for _, arg := range args {
-		if arg.letter == letter {
-			return arg.num, nil
+// updateSpindle tells the machine the state of a spindle; selected is true if the spindle was
+// explicitly selected using $n.
+func (eng *engine) updateSpindle(spindle int, selected bool) error {
+	ss := eng.spindleState(spindle)
+	if ms, ok := eng.machine.(MultiSpindle); ok && selected {
+		if !ss.on {
+			eng.trace("setSpindleN %d 0 %v", spindle, ss.clockwise)
+			return ms.SetSpindleN(spindle, 0.0, ss.clockwise)
 		}
+		eng.trace("setSpindleN %d %s %v", spindle, Number(ss.speed), ss.clockwise)
+		return ms.SetSpindleN(spindle, ss.speed, ss.clockwise)
 	}
 
-	return 0, fmt.Errorf("missing require arg: %c", letter)
+	if !ss.on {
+		eng.trace("spindleOff")
+		return eng.machine.SpindleOff()
+	}
+	eng.trace("setSpindle %s %v", Number(ss.speed), ss.clockwise)
+	return eng.machine.SetSpindle(ss.speed, ss.clockwise)
 }
 
-func hasArg(args []arg, letter Letter) bool {
-	for _, arg := range args {
-		if arg.letter == letter {
-			return true
+func (eng *engine) startSpindle(spindle int, clockwise bool) error {
+	ss := eng.spindleState(spindle)
+	ss.on = true
+	ss.clockwise = clockwise
+	return eng.updateSpindle(spindle, spindle >= 0)
+}
+
+func (eng *engine) stopSpindle(spindle int) error {
+	eng.spindleState(spindle).on = false
+	return eng.updateSpindle(spindle, spindle >= 0)
+}
+
+// setSpindleSpeed sets the speed of a spindle to S speed; in constant surface speed mode (G96),
+// S is the surface speed of spindle 0, in meters or feet per minute.
+func (eng *engine) setSpindleSpeed(spindle int, speed float64) error {
+	if eng.constantSurface && spindle <= 0 {
+		eng.surfaceSpeed = speed * 1000.0
+		if eng.units != 1.0 {
+			eng.surfaceSpeed = speed * 12.0 * mmPerInch
+		}
+		var err error
+		speed, err = eng.surfaceSpindleSpeed()
+		if err != nil {
+			return err
 		}
 	}
+	return eng.updateSpindleSpeed(spindle, speed)
+}
 
-	return false
+// surfaceSpindleSpeed returns the spindle speed, in RPM, for the surface speed of constant
+// surface speed mode (G96) at the current X, which is the radius of the work, limited to the
+// maximum spindle speed (D).
+func (eng *engine) surfaceSpindleSpeed() (float64, error) {
+	if eng.surfaceSpeed == 0.0 {
+		return 0.0, nil
+	}
+	x := eng.curPos.X + eng.coordSysPos[eng.curCoordSys].X + eng.localPos.X
+	if eng.useWorkPos {
+		x += eng.workPos.X
+	}
+	speed := math.Inf(1)
+	if r := math.Abs(x); r >= minimumDelta {
+		speed = eng.surfaceSpeed / (2.0 * math.Pi * r)
+	}
+	if eng.maxSpindleSpeed > 0.0 && speed > eng.maxSpindleSpeed {
+		speed = eng.maxSpindleSpeed
+	} else if math.IsInf(speed, 1) {
+		return 0.0, errors.New("expected a maximum spindle speed (D) for constant surface " +
+			"speed (G96) at X0")
+	}
+	return speed, nil
 }
 
-func (eng *engine) toMachineX(x float64, absolute bool) float64 {
-	if absolute {
-		if eng.useWorkPos {
-			return x - eng.coordSysPos[eng.curCoordSys].X - eng.workPos.X
-		}
-		return x - eng.coordSysPos[eng.curCoordSys].X
+// updateSurfaceSpeed updates the speed of spindle 0 after a move in constant surface speed mode
+// (G96), once S has set the surface speed.
+func (eng *engine) updateSurfaceSpeed() error {
+	if !eng.constantSurface || eng.surfaceSpeed == 0.0 {
+		return nil
 	}
-	// relative
-	return eng.curPos.X + x
+	speed, err := eng.surfaceSpindleSpeed()
+	if err != nil {
+		return err
+	} else if Number(speed).Equal(Number(eng.spindleState(0).speed)) {
+		return nil
+	}
+	return eng.updateSpindleSpeed(-1, speed)
 }
 
-func (eng *engine) toMachineY(y float64, absolute bool) float64 {
-	if absolute {
-		if eng.useWorkPos {
-			return y - eng.coordSysPos[eng.curCoordSys].Y - eng.workPos.Y
+// constantSurfaceSpeed selects constant surface speed mode (G96) with an optional maximum
+// spindle speed (D).
+func (eng *engine) constantSurfaceSpeed(codes []Code) ([]Code, error) {
+	var err error
+	var args []arg
+	args, codes, err = eng.parseArgs(codes, dArg)
+	if err != nil {
+		return nil, err
+	}
+
+	eng.maxSpindleSpeed = 0.0
+	if hasArg(args, 'D') {
+		d, _ := requireArg(args, 'D')
+		if d <= 0.0 {
+			return nil, fmt.Errorf("expected a positive maximum spindle speed: D%s", d)
 		}
-		return y - eng.coordSysPos[eng.curCoordSys].Y
+		eng.maxSpindleSpeed = float64(d)
 	}
-	// relative
-	return eng.curPos.Y + y
+	eng.constantSurface = true
+	eng.surfaceSpeed = 0.0
+	return codes, nil
 }
 
-func (eng *engine) toMachineZ(z float64, absolute bool) float64 {
-	if absolute {
-		if eng.useWorkPos {
-			return z - eng.coordSysPos[eng.curCoordSys].Z - eng.workPos.Z
+func (eng *engine) updateSpindleSpeed(spindle int, speed float64) error {
+	ss := eng.spindleState(spindle)
+	ss.speed = speed
+	if ss.on {
+		err := eng.updateSpindle(spindle, spindle >= 0)
+		if err != nil {
+			return err
 		}
-		return z - eng.coordSysPos[eng.curCoordSys].Z
 	}
-	// relative
-	return eng.curPos.Z + z
+	if spindle <= 0 && eng.feedMode == UnitsPerRevolutionFeed && eng.feed > 0.0 && speed > 0.0 {
+		return eng.updateFeed(eng.feedPerMinute(eng.feed, 0.0))
+	}
+	return nil
 }
 
-func (eng *engine) moveTo(codes []Code, useMachine bool) ([]Code, error) {
+func (eng *engine) orientSpindle(so SpindleOrienter, codes []Code) ([]Code, error) {
 	var err error
 	var args []arg
-	args, codes, err = parseArgs(codes, fArg|xArg|yArg|zArg)
+	args, codes, err = eng.parseArgs(codes, rArg)
 	if err != nil {
 		return nil, err
 	}
 
-	pos := eng.curPos
-	for _, arg := range args {
-		switch arg.letter {
-		case 'F':
-			err = eng.setFeed(float64(arg.num) * eng.units)
-			if err != nil {
-				return nil, err
-			}
-		case 'X':
-			if useMachine {
-				if eng.absoluteMode {
-					pos.X = float64(arg.num) * eng.units
-				} else {
-					pos.X = eng.curPos.X + float64(arg.num)*eng.units
-				}
-			} else {
-				pos.X = eng.toMachineX(float64(arg.num)*eng.units, eng.absoluteMode)
-			}
-		case 'Y':
-			if useMachine {
-				if eng.absoluteMode {
-					pos.Y = float64(arg.num) * eng.units
-				} else {
-					pos.Y = eng.curPos.Y + float64(arg.num)*eng.units
-				}
-			} else {
+	var degrees Number
+	if hasArg(args, 'R') {
+		degrees, _ = requireArg(args, 'R')
+	}
+	eng.trace("orientSpindle %s", degrees)
+	err = so.OrientSpindle(float64(degrees))
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (eng *engine) dwell(d Dweller, codes []Code) ([]Code, error) {
+	repRap := eng.features.HasRepRap() && !eng.features.HasLinuxCNC()
+	var allowed argSet = pArg
+	if repRap {
+		allowed |= sArg
+	}
+
+	var err error
+	var args []arg
+	args, codes, err = eng.parseArgs(codes, allowed)
+	if err != nil {
+		return nil, err
+	}
+
+	var seconds float64
+	if s, err := requireArg(args, 'S'); err == nil {
+		if hasArg(args, 'P') {
+			return nil, errors.New("G4 requires either P or S, not both")
+		} else if s < 0 {
+			return nil, fmt.Errorf("expected a non-negative dwell: S%s", s)
+		}
+		seconds = float64(s)
+	} else if p, err := requireArg(args, 'P'); err == nil {
+		if p < 0 {
+			return nil, fmt.Errorf("expected a non-negative dwell: P%s", p)
+		}
+		seconds = float64(p)
+		if repRap {
+			seconds /= 1000.0
+		}
+	} else if repRap {
+		return nil, errors.New("G4 requires a P or S argument")
+	} else {
+		return nil, errors.New("G4 requires a P argument")
+	}
+
+	eng.trace("dwell %s", Number(seconds))
+	err = d.Dwell(seconds)
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (eng *engine) selectTool(tool uint) error {
+	eng.trace("selectTool %d", tool)
+	err := eng.machine.SelectTool(tool)
+	if err != nil {
+		return err
+	}
+	eng.curTool = tool
+	eng.toolSelected = true
+	return nil
+}
+
+// CurrentTool returns the most recently selected tool, or InitialTool if no tool has been
+// selected.
+func (eng *engine) CurrentTool() uint {
+	if eng.toolSelected {
+		return eng.curTool
+	}
+	return eng.InitialTool
+}
+
+// LastProgrammedFeed returns the most recent feed set by F, in the units, inches or mm, in effect
+// when it was set; the feed passed to SetFeed is in mm and is scaled by #<_feed_override>.
+func (eng *engine) LastProgrammedFeed() float64 {
+	return eng.programmedFeed
+}
+
+// OverridesEnabled returns false if overrides, such as #<_feed_override>, have been disabled by
+// M49; they are enabled again by M48 and at the end of the program.
+func (eng *engine) OverridesEnabled() bool {
+	return !eng.noOverrides
+}
+
+// LoadedTool returns the tool most recently changed to with M6, or InitialTool if M6 has not
+// been evaluated.
+func (eng *engine) LoadedTool() uint {
+	if eng.toolChanged {
+		return eng.loadedTool
+	}
+	return eng.InitialTool
+}
+
+func (eng *engine) changeTool(tc ToolChanger) error {
+	if !eng.toolSelected && eng.LoadedTool() == 0 {
+		return errors.New("expected a tool to be selected with T before M6")
+	}
+	tool := eng.CurrentTool()
+	eng.trace("changeTool %d", tool)
+	err := tc.ChangeTool(tool)
+	if err != nil {
+		return err
+	}
+	eng.loadedTool = tool
+	eng.toolChanged = true
+	return nil
+}
+
+// PathControl returns the path control mode and, for G64, the blending (P) and naive CAM (Q)
+// tolerances, in mm; tolerances which were not specified are zero.
+func (eng *engine) PathControl() (PathMode, float64, float64) {
+	return eng.pathMode, eng.pathTolerance, eng.naiveCAMTol
+}
+
+// Tolerance returns the tolerance used when comparing numbers and positions: numbers which
+// differ by less than the tolerance are equal.
+func (eng *engine) Tolerance() float64 {
+	return minimumDelta
+}
+
+// HomePosition returns the home position (G28), in machine coordinates and mm; #5161 to #5163
+// are the same position in the current units.
+func (eng *engine) HomePosition() Position {
+	return eng.homePos
+}
+
+// SecondPosition returns the predefined position (G30), in machine coordinates and mm; #5181 to
+// #5183 are the same position in the current units.
+func (eng *engine) SecondPosition() Position {
+	return eng.secondPos
+}
+
+// CoordinateSystemOffset returns the offset, in mm, of coordinate system n, where 1 is G54 and
+// 9 is G59.3.
+func (eng *engine) CoordinateSystemOffset(n int) (Position, error) {
+	if n < 1 || n > len(eng.coordSysPos) {
+		return zeroPosition, fmt.Errorf("expected a coordinate system between 1 and 9: %d", n)
+	}
+	return eng.coordSysPos[n-1], nil
+}
+
+func (eng *engine) warn(msg string) {
+	if eng.Warn != nil {
+		eng.Warn(eng.lineNum, msg)
+	} else if eng.errW != nil {
+		fmt.Fprintf(eng.errW, "warning: %s: %s\n", eng.line, msg)
+	}
+}
+
+// modeActive returns true if G num selects the motion mode, plane, units, or distance mode
+// which is already active.
+func (eng *engine) modeActive(num Number) bool {
+	for _, m := range []struct {
+		num    Number
+		active bool
+	}{
+		{0, eng.moveMode == rapidMove},
+		{1, eng.moveMode == linearMove},
+		{2, eng.moveMode == clockwiseArcMove},
+		{3, eng.moveMode == counterClockwiseArcMove},
+		{80, eng.moveMode == noMove},
+		{81, eng.moveMode == drillMove},
+		{82, eng.moveMode == drillDwellMove},
+		{83, eng.moveMode == peckDrillMove},
+		{17, eng.arcPlane == XYPlane},
+		{18, eng.arcPlane == ZXPlane},
+		{19, eng.arcPlane == YZPlane},
+		{20, eng.units == mmPerInch},
+		{21, eng.units == 1.0},
+		{90, eng.absoluteMode},
+		{91, !eng.absoluteMode},
+		{90.1, eng.absoluteArcMode},
+		{91.1, !eng.absoluteArcMode},
+		{93, eng.feedMode == InverseTimeFeed},
+		{94, eng.feedMode == UnitsPerMinuteFeed},
+		{95, eng.feedMode == UnitsPerRevolutionFeed},
+	} {
+		if m.num.Equal(num) {
+			return m.active
+		}
+	}
+	return false
+}
+
+// checkRedundantMode warns if G num selects the mode which is already active, and an earlier
+// code in the same modal group has been evaluated.
+func (eng *engine) checkRedundantMode(num Number) {
+	group, ok := gCodeGroup(num)
+	if !ok {
+		return
+	}
+	if eng.modalGroups&(1<<group) != 0 && eng.modeActive(num) {
+		eng.warn(fmt.Sprintf("redundant modal code: %s", formatCode(Code{'G', num})))
+	}
+	eng.modalGroups |= 1 << group
+}
+
+func (eng *engine) handleUnknown(code Code, codes []Code,
+	setCurPos func(pos Position) error) ([]Code, error) {
+
+	eng.trace("handleUnknown %s", code)
+	var rest []Code
+	var err error
+	if uh, ok := eng.machine.(UnknownHandler); ok {
+		rest, err = uh.HandleUnknownAt(code, codes, currentPosition{eng, setCurPos})
+	} else {
+		rest, err = eng.machine.HandleUnknown(code, codes, setCurPos)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if eng.UnknownCodes != nil {
+		eng.UnknownCodes(append([]Code{code}, unhandledCodes(codes, rest)...))
+	}
+	return rest, nil
+}
+
+// unhandledCodes returns the codes which HandleUnknown did not return to the engine. If rest is
+// not the tail of codes, such as when codes were rewritten or injected, which of codes were
+// handled is not known, so none are returned.
+func unhandledCodes(codes, rest []Code) []Code {
+	if len(rest) == 0 {
+		return codes
+	} else if len(rest) <= len(codes) && &rest[len(rest)-1] == &codes[len(codes)-1] {
+		return codes[:len(codes)-len(rest)]
+	}
+	return nil
+}
+
+type currentPosition struct {
+	eng       *engine
+	setCurPos func(pos Position) error
+}
+
+func (cp currentPosition) Get() Position {
+	return cp.eng.curPos
+}
+
+func (cp currentPosition) Set(pos Position) error {
+	return cp.setCurPos(pos)
+}
+
+func (eng *engine) ignoreUnknown(code Code, codes []Code) []Code {
+	cdx := 0
+	for cdx < len(codes) && codes[cdx].Letter != 'G' && codes[cdx].Letter != 'M' {
+		cdx += 1
+	}
+
+	eng.trace("ignoreUnknown %s", code)
+	if eng.UnknownCodes != nil {
+		eng.UnknownCodes(append([]Code{code}, codes[:cdx]...))
+	}
+	return codes[cdx:]
+}
+
+func (eng *engine) rapidTo(pos Position) error {
+	if pos == eng.curPos {
+		return nil
+	}
+	if !pos.finite() {
+		return fmt.Errorf("expected a finite position: %s", pos)
+	}
+	eng.trace("rapidTo %s", pos)
+	err := eng.machine.RapidTo(pos)
+	if err != nil {
+		return err
+	}
+	eng.curPos = pos
+	return eng.updateSurfaceSpeed()
+}
+
+func (eng *engine) linearTo(pos Position) error {
+	if pos == eng.curPos {
+		return nil
+	}
+	err := eng.prepareFeedMove(pos)
+	if err != nil {
+		return err
+	}
+	eng.trace("linearTo %s feed %s", pos, Number(eng.feed))
+	err = eng.machine.LinearTo(pos)
+	if err != nil {
+		return err
+	}
+	eng.curPos = pos
+	return eng.updateSurfaceSpeed()
+}
+
+// prepareFeedMove checks a feed move to pos, either a line or an arc taken by the ArcHandler,
+// and sets the DefaultFeed if no feed has been set.
+func (eng *engine) prepareFeedMove(pos Position) error {
+	if !pos.finite() {
+		return fmt.Errorf("expected a finite position: %s", pos)
+	}
+	if eng.feedMode == UnitsPerRevolutionFeed && eng.spindleState(0).speed <= 0.0 {
+		return errors.New("expected a spindle speed (S) in units per revolution feed mode (G95)")
+	}
+	if eng.feed == 0.0 {
+		if eng.DefaultFeed > 0.0 && eng.feedMode == UnitsPerMinuteFeed {
+			return eng.setFeed(eng.DefaultFeed / eng.units)
+		} else if eng.RequireFeed {
+			return errors.New("expected a feed to be set with F before a feed move")
+		}
+	}
+	return nil
+}
+
+func (eng *engine) setCurrentPosition(pos Position) error {
+	eng.curPos = pos
+	return nil
+}
+
+type arg struct {
+	letter Letter
+	num    Number
+}
+
+type argSet int
+
+const (
+	fArg = 1 << iota
+	iArg
+	jArg
+	kArg
+	hArg
+	lArg
+	pArg
+	qArg
+	rArg
+	xArg
+	yArg
+	zArg
+	radiusArg // @
+	angleArg  // ^
+	dArg
+	sArg
+)
+
+// argNotAllowed returns an error for an arg which is not allowed by the active code; P has a
+// different meaning for each of the codes which take it, so they are listed.
+func argNotAllowed(code Code) error {
+	if code.Letter == 'P' {
+		return fmt.Errorf("arg not allowed: %s; P is the dwell for G4 and G82, the turns for G2 "+
+			"and G3, the tolerance for G64, and the coordinate system or tool for G10", code)
+	}
+	return fmt.Errorf("arg not allowed: %s", code)
+}
+
+func (eng *engine) parseArgs(codes []Code, allowed argSet) ([]arg, []Code, error) {
+	var args []arg
+	for len(codes) > 0 {
+		code := codes[0]
+		switch code.Letter {
+		case 'F':
+			if (allowed & fArg) == 0 {
+				return nil, nil, fmt.Errorf("arg not allowed: %s", code)
+			}
+		case 'I':
+			if (allowed & iArg) == 0 {
+				return nil, nil, fmt.Errorf("arg not allowed: %s", code)
+			}
+		case 'J':
+			if (allowed & jArg) == 0 {
+				return nil, nil, fmt.Errorf("arg not allowed: %s", code)
+			}
+		case 'K':
+			if (allowed & kArg) == 0 {
+				return nil, nil, fmt.Errorf("arg not allowed: %s", code)
+			}
+		case 'H':
+			if (allowed & hArg) == 0 {
+				return nil, nil, fmt.Errorf("arg not allowed: %s", code)
+			}
+		case 'L':
+			if (allowed & lArg) == 0 {
+				return nil, nil, fmt.Errorf("arg not allowed: %s", code)
+			}
+		case 'P':
+			if (allowed & pArg) == 0 {
+				return nil, nil, argNotAllowed(code)
+			}
+		case 'Q':
+			if (allowed & qArg) == 0 {
+				return nil, nil, fmt.Errorf("arg not allowed: %s", code)
+			}
+		case 'R':
+			if (allowed & rArg) == 0 {
+				return nil, nil, fmt.Errorf("arg not allowed: %s", code)
+			}
+		case 'X':
+			if (allowed & xArg) == 0 {
+				return nil, nil, fmt.Errorf("arg not allowed: %s", code)
+			}
+		case 'Y':
+			if (allowed & yArg) == 0 {
+				return nil, nil, fmt.Errorf("arg not allowed: %s", code)
+			}
+		case 'Z':
+			if (allowed & zArg) == 0 {
+				return nil, nil, fmt.Errorf("arg not allowed: %s", code)
+			}
+		case '@':
+			if (allowed & radiusArg) == 0 {
+				return nil, nil, fmt.Errorf("arg not allowed: %s", code)
+			}
+		case '^':
+			if (allowed & angleArg) == 0 {
+				return nil, nil, fmt.Errorf("arg not allowed: %s", code)
+			}
+		case 'D':
+			if (allowed & dArg) == 0 {
+				return nil, nil, fmt.Errorf("arg not allowed: %s", code)
+			}
+		case 'S':
+			// Unless S is an arg, it is the spindle speed.
+			if (allowed & sArg) == 0 {
+				return args, codes, nil
+			}
+		default:
+			return args, codes, nil
+		}
+
+		num, ok := code.Value.AsNumber()
+		if !ok {
+			return nil, nil, fmt.Errorf("expected a number: %v", code.Value)
+		}
+
+		dup := false
+		for adx := range args {
+			if args[adx].letter == code.Letter {
+				if !eng.LastWordWins {
+					return nil, nil, fmt.Errorf("duplicate arg specified: %s", code)
+				}
+				args[adx].num = num
+				dup = true
+			}
+		}
+		if !dup {
+			args = append(args, arg{code.Letter, num})
+		}
+		codes = codes[1:]
+	}
+
+	return args, codes, nil
+}
+
+func requireArg(args []arg, letter Letter) (Number, error) {
+	for _, arg := range args {
+		if arg.letter == letter {
+			return arg.num, nil
+		}
+	}
+
+	return 0, fmt.Errorf("missing require arg: %c", letter)
+}
+
+func hasArg(args []arg, letter Letter) bool {
+	for _, arg := range args {
+		if arg.letter == letter {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (eng *engine) toMachineX(x float64, absolute bool) float64 {
+	if absolute {
+		if eng.useWorkPos {
+			return x - eng.coordSysPos[eng.curCoordSys].X - eng.localPos.X - eng.workPos.X
+		}
+		return x - eng.coordSysPos[eng.curCoordSys].X - eng.localPos.X
+	}
+	// relative
+	return eng.curPos.X + x
+}
+
+func (eng *engine) toMachineY(y float64, absolute bool) float64 {
+	if absolute {
+		if eng.useWorkPos {
+			return y - eng.coordSysPos[eng.curCoordSys].Y - eng.localPos.Y - eng.workPos.Y
+		}
+		return y - eng.coordSysPos[eng.curCoordSys].Y - eng.localPos.Y
+	}
+	// relative
+	return eng.curPos.Y + y
+}
+
+func (eng *engine) toMachineZ(z float64, absolute bool) float64 {
+	if absolute {
+		if eng.useWorkPos {
+			return z - eng.coordSysPos[eng.curCoordSys].Z - eng.localPos.Z - eng.workPos.Z -
+				eng.toolLengthOffset
+		}
+		return z - eng.coordSysPos[eng.curCoordSys].Z - eng.localPos.Z - eng.toolLengthOffset
+	}
+	// relative
+	return eng.curPos.Z + z
+}
+
+func (eng *engine) moveTo(codes []Code, useMachine bool) ([]Code, error) {
+	var err error
+	var args []arg
+	args, codes, err = eng.parseArgs(codes, fArg|xArg|yArg|zArg|radiusArg|angleArg)
+	if err != nil {
+		return nil, err
+	}
+
+	pos := eng.curPos
+	for _, arg := range args {
+		switch arg.letter {
+		case 'F':
+			err = eng.setFeed(float64(arg.num))
+			if err != nil {
+				return nil, err
+			}
+		case 'X':
+			x := float64(arg.num) * eng.units
+			if eng.diameterMode {
+				x /= 2.0
+			}
+			if useMachine {
+				if eng.absoluteMode {
+					pos.X = x
+				} else {
+					pos.X = eng.curPos.X + x
+				}
+			} else {
+				pos.X = eng.toMachineX(x, eng.absoluteMode)
+			}
+		case 'Y':
+			if useMachine {
+				if eng.absoluteMode {
+					pos.Y = float64(arg.num) * eng.units
+				} else {
+					pos.Y = eng.curPos.Y + float64(arg.num)*eng.units
+				}
+			} else {
 				pos.Y = eng.toMachineY(float64(arg.num)*eng.units, eng.absoluteMode)
 			}
 		case 'Z':
@@ -378,10 +1310,32 @@ func (eng *engine) moveTo(codes []Code, useMachine bool) ([]Code, error) {
 		}
 	}
 
+	if !hasArg(args, 'X') && !hasArg(args, 'Y') && !hasArg(args, 'Z') && !hasArg(args, '@') &&
+		!hasArg(args, '^') {
+
+		// Without any axis words, such as G1 F100, only the feed is set.
+		return codes, nil
+	}
+
+	if hasArg(args, '@') || hasArg(args, '^') {
+		pos, err = eng.polarTo(args, pos)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if eng.WarnRedundantMoves && pos == eng.curPos {
+		eng.warn(fmt.Sprintf("redundant move to the current position: %s", pos))
+	}
+
 	switch eng.moveMode {
 	case rapidMove:
 		err = eng.rapidTo(pos)
 	case linearMove:
+		err = eng.inverseTimeFeed(args, distance(eng.curPos, pos))
+		if err != nil {
+			return nil, err
+		}
 		err = eng.linearTo(pos)
 	default:
 		panic(fmt.Sprintf("unexpected moveMode: %d", eng.moveMode))
@@ -393,15 +1347,44 @@ func (eng *engine) moveTo(codes []Code, useMachine bool) ([]Code, error) {
 	return codes, nil
 }
 
+// polarTo returns pos with X and Y replaced by the point at a radius (@) and angle (^, in
+// degrees counter-clockwise from the X axis) from the current position, which is the pole. Polar
+// moves are always relative to the current position, regardless of the distance mode.
+func (eng *engine) polarTo(args []arg, pos Position) (Position, error) {
+	if hasArg(args, 'X') || hasArg(args, 'Y') {
+		return Position{}, errors.New("X and Y not allowed with polar coordinates (@ and ^)")
+	}
+
+	var radius, angle float64
+	for _, arg := range args {
+		switch arg.letter {
+		case '@':
+			radius = float64(arg.num) * eng.units
+		case '^':
+			angle = toRadians(arg.num)
+		}
+	}
+
+	pos.X = eng.curPos.X + radius*math.Cos(angle)
+	pos.Y = eng.curPos.Y + radius*math.Sin(angle)
+	return pos, nil
+}
+
 func (eng *engine) moveToPredefined(codes []Code, pos Position) ([]Code, error) {
 	var err error
 	var args []arg
-	args, codes, err = parseArgs(codes, xArg|yArg|zArg)
+	args, codes, err = eng.parseArgs(codes, xArg|yArg|zArg)
 	if err != nil {
 		return nil, err
 	}
 
 	if len(args) == 0 {
+		if eng.ZFirstHoming {
+			err = eng.rapidTo(Position{X: eng.curPos.X, Y: eng.curPos.Y, Z: pos.Z})
+			if err != nil {
+				return nil, err
+			}
+		}
 		err = eng.rapidTo(pos)
 		if err != nil {
 			return nil, err
@@ -423,6 +1406,20 @@ func (eng *engine) moveToPredefined(codes []Code, pos Position) ([]Code, error)
 			}
 		}
 
+		if eng.ZFirstHoming && hasArg(args, 'Z') {
+			// Move Z through the intermediate point to the predefined position before moving X
+			// or Y.
+			err = eng.rapidTo(Position{X: eng.curPos.X, Y: eng.curPos.Y, Z: way.Z})
+			if err != nil {
+				return nil, err
+			}
+			err = eng.rapidTo(Position{X: eng.curPos.X, Y: eng.curPos.Y, Z: final.Z})
+			if err != nil {
+				return nil, err
+			}
+			way.Z = final.Z
+		}
+
 		err = eng.rapidTo(way)
 		if err != nil {
 			return nil, err
@@ -441,29 +1438,16 @@ func (eng *engine) setCoordinateSystemPosition(args []arg, machine bool) error {
 	if err != nil {
 		return err
 	}
-	var coordSys int
-	if p.Equal(0.0) {
+	n, ok := p.AsInteger()
+	if !ok {
+		return fmt.Errorf("expected a whole number for the coordinate system: P%s", p)
+	} else if n < 0 || n > len(eng.coordSysPos) {
+		return fmt.Errorf("expected a coordinate system between 0 and %d: P%s",
+			len(eng.coordSysPos), p)
+	}
+	coordSys := n - 1
+	if n == 0 {
 		coordSys = eng.curCoordSys
-	} else if p.Equal(1.0) {
-		coordSys = 0
-	} else if p.Equal(2.0) {
-		coordSys = 1
-	} else if p.Equal(3.0) {
-		coordSys = 2
-	} else if p.Equal(4.0) {
-		coordSys = 3
-	} else if p.Equal(5.0) {
-		coordSys = 4
-	} else if p.Equal(6.0) {
-		coordSys = 5
-	} else if p.Equal(7.0) {
-		coordSys = 6
-	} else if p.Equal(8.0) {
-		coordSys = 7
-	} else if p.Equal(9.0) {
-		coordSys = 8
-	} else {
-		return fmt.Errorf("expected a coordinate system: P%s", p)
 	}
 
 	for _, arg := range args {
@@ -472,19 +1456,22 @@ func (eng *engine) setCoordinateSystemPosition(args []arg, machine bool) error {
 			if machine {
 				eng.coordSysPos[coordSys].X = float64(arg.num) * eng.units
 			} else {
-				eng.coordSysPos[coordSys].X = float64(arg.num)*eng.units - eng.curPos.X
+				eng.coordSysPos[coordSys].X = float64(arg.num)*eng.units - eng.curPos.X -
+					eng.localPos.X - eng.workOffset().X
 			}
 		case 'Y':
 			if machine {
 				eng.coordSysPos[coordSys].Y = float64(arg.num) * eng.units
 			} else {
-				eng.coordSysPos[coordSys].Y = float64(arg.num)*eng.units - eng.curPos.Y
+				eng.coordSysPos[coordSys].Y = float64(arg.num)*eng.units - eng.curPos.Y -
+					eng.localPos.Y - eng.workOffset().Y
 			}
 		case 'Z':
 			if machine {
 				eng.coordSysPos[coordSys].Z = float64(arg.num) * eng.units
 			} else {
-				eng.coordSysPos[coordSys].Z = float64(arg.num)*eng.units - eng.curPos.Z
+				eng.coordSysPos[coordSys].Z = float64(arg.num)*eng.units - eng.curPos.Z -
+					eng.localPos.Z - eng.workOffset().Z - eng.toolLengthOffset
 			}
 		}
 	}
@@ -495,7 +1482,7 @@ func (eng *engine) setCoordinateSystemPosition(args []arg, machine bool) error {
 func (eng *engine) modifyPositions(codes []Code) ([]Code, error) {
 	var err error
 	var args []arg
-	args, codes, err = parseArgs(codes, lArg|pArg|xArg|yArg|zArg)
+	args, codes, err = eng.parseArgs(codes, lArg|pArg|xArg|yArg|zArg)
 	if err != nil {
 		return nil, err
 	}
@@ -504,291 +1491,879 @@ func (eng *engine) modifyPositions(codes []Code) ([]Code, error) {
 		return nil, err
 	}
 
-	if l.Equal(2.0) { // G10 L2: set coordinate system offset (machine)
-		err = eng.setCoordinateSystemPosition(args, true)
+	commands := []struct {
+		l  int
+		fn func(args []arg) error
+	}{
+		{1, func(args []arg) error { // G10 L1: set tool length offset
+			return eng.setToolTableOffset(args)
+		}},
+		{2, func(args []arg) error { // G10 L2: set coordinate system offset (machine)
+			return eng.setCoordinateSystemPosition(args, true)
+		}},
+		{20, func(args []arg) error { // G10 L20: set coordinate system offset (relative)
+			return eng.setCoordinateSystemPosition(args, false)
+		}},
+	}
+
+	var supported []string
+	for _, cmd := range commands {
+		if l.Equal(Number(cmd.l)) {
+			err = cmd.fn(args)
+			if err != nil {
+				return nil, err
+			}
+			return codes, nil
+		}
+		supported = append(supported, fmt.Sprintf("L%d", cmd.l))
+	}
+
+	return nil, fmt.Errorf("unexpected L value to G10: L%s; expected one of %s", l,
+		strings.Join(supported, ", "))
+}
+
+func (eng *engine) setToolTableOffset(args []arg) error {
+	p, err := requireArg(args, 'P')
+	if err != nil {
+		return err
+	}
+	tool, ok := p.AsInteger()
+	if !ok || tool < 0 {
+		return fmt.Errorf("expected a tool number: P%s", p)
+	}
+	if hasArg(args, 'X') || hasArg(args, 'Y') {
+		return errors.New("expected only a Z tool length offset")
+	}
+	z, err := requireArg(args, 'Z')
+	if err != nil {
+		return err
+	}
+	eng.SetToolLengthOffset(uint(tool), float64(z)*eng.units)
+	return nil
+}
+
+// SetToolLengthOffset sets the tool length offset, in mm, of tool h; G43 Hh applies it. The
+// offset is subtracted from Z, like the coordinate system offsets, except in machine
+// coordinates (G53). Setting the offset of the tool whose offset is in use does not change the
+// offset in use until G43 is evaluated again.
+func (eng *engine) SetToolLengthOffset(h uint, offset float64) {
+	if eng.toolOffsets == nil {
+		eng.toolOffsets = map[uint]float64{}
+	}
+	eng.toolOffsets[h] = offset
+}
+
+func (eng *engine) applyToolLengthOffset(codes []Code) ([]Code, error) {
+	var err error
+	var args []arg
+	args, codes, err = eng.parseArgs(codes, hArg)
+	if err != nil {
+		return nil, err
+	}
+
+	h := eng.CurrentTool()
+	if hasArg(args, 'H') {
+		num, _ := requireArg(args, 'H')
+		n, ok := num.AsInteger()
+		if !ok || n < 0 {
+			return nil, fmt.Errorf("expected a tool number: H%s", num)
+		}
+		h = uint(n)
+	}
+	// Tools without an offset have an offset of zero.
+	eng.toolLengthOffset = eng.toolOffsets[h]
+	return codes, nil
+}
+
+// workOffset returns the G92 offset if it is in use. Like LinuxCNC, the G92 offset is global: it
+// applies to every coordinate system and persists when switching between them.
+func (eng *engine) workOffset() Position {
+	if eng.useWorkPos {
+		return eng.workPos
+	}
+	return zeroPosition
+}
+
+func (eng *engine) setWorkPosition(codes []Code) ([]Code, error) {
+	var err error
+	var args []arg
+	args, codes, err = eng.parseArgs(codes, xArg|yArg|zArg)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, errors.New("expected at least one X, Y, or Z arg")
+	}
+
+	for _, arg := range args {
+		switch arg.letter {
+		case 'X':
+			eng.workPos.X += eng.toMachineX(float64(arg.num)*eng.units, true) - eng.curPos.X
+		case 'Y':
+			eng.workPos.Y += eng.toMachineY(float64(arg.num)*eng.units, true) - eng.curPos.Y
+		case 'Z':
+			eng.workPos.Z += eng.toMachineZ(float64(arg.num)*eng.units, true) - eng.curPos.Z
+		}
+	}
+	eng.useWorkPos = true
+
+	return codes, nil
+}
+
+func (eng *engine) setLocalPosition(codes []Code) ([]Code, error) {
+	var err error
+	var args []arg
+	args, codes, err = eng.parseArgs(codes, xArg|yArg|zArg)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		eng.localPos = zeroPosition
+		return codes, nil
+	}
+
+	for _, arg := range args {
+		switch arg.letter {
+		case 'X':
+			eng.localPos.X = float64(arg.num) * eng.units
+		case 'Y':
+			eng.localPos.Y = float64(arg.num) * eng.units
+		case 'Z':
+			eng.localPos.Z = float64(arg.num) * eng.units
+		}
+	}
+
+	return codes, nil
+}
+
+func (eng *engine) setPathMode(codes []Code, mode PathMode) ([]Code, error) {
+	var tolerance, naiveCAMTolerance float64
+	if mode == ContinuousPathMode {
+		var err error
+		var args []arg
+		args, codes, err = eng.parseArgs(codes, pArg|qArg)
 		if err != nil {
 			return nil, err
 		}
-		return codes, nil
-	} else if l.Equal(20.0) { // G10 L20: set coordinate system offset (relative)
-		err = eng.setCoordinateSystemPosition(args, false)
+		if hasArg(args, 'Q') && !hasArg(args, 'P') {
+			return nil, errors.New("expected P with Q: G64")
+		}
+
+		for _, arg := range args {
+			if arg.num < 0 {
+				return nil, fmt.Errorf("expected a non-negative tolerance: %c%s", arg.letter,
+					arg.num)
+			}
+			switch arg.letter {
+			case 'P':
+				tolerance = float64(arg.num) * eng.units
+			case 'Q':
+				naiveCAMTolerance = float64(arg.num) * eng.units
+			}
+		}
+	}
+
+	eng.pathMode = mode
+	eng.pathTolerance = tolerance
+	eng.naiveCAMTol = naiveCAMTolerance
+	if pms, ok := eng.machine.(PathModeSetter); ok {
+		exactStop := mode != ContinuousPathMode
+		eng.trace("setPathMode %v %s %s", exactStop, Number(tolerance), Number(naiveCAMTolerance))
+		err := pms.SetPathMode(exactStop, tolerance, naiveCAMTolerance)
 		if err != nil {
 			return nil, err
 		}
-		return codes, nil
 	}
-
-	return nil, fmt.Errorf("unexpected L value to G10: L%s", l)
+	return codes, nil
 }
 
-func (eng *engine) setWorkPosition(codes []Code) ([]Code, error) {
+// setMachinePosition sets the current position, in machine coordinates, of the given axes without
+// moving (G28.3).
+func (eng *engine) setMachinePosition(codes []Code) ([]Code, error) {
 	var err error
 	var args []arg
-	args, codes, err = parseArgs(codes, xArg|yArg|zArg)
+	args, codes, err = eng.parseArgs(codes, xArg|yArg|zArg)
 	if err != nil {
 		return nil, err
 	}
 	if len(args) == 0 {
-		return nil, errors.New("expected at least one X, Y, or Z arg")
+		return nil, errors.New("expected at least one of X, Y, or Z: G28.3")
 	}
 
+	pos := eng.curPos
 	for _, arg := range args {
 		switch arg.letter {
 		case 'X':
-			eng.workPos.X += eng.toMachineX(float64(arg.num)*eng.units, true) - eng.curPos.X
+			pos.X = float64(arg.num) * eng.units
 		case 'Y':
-			eng.workPos.Y += eng.toMachineY(float64(arg.num)*eng.units, true) - eng.curPos.Y
+			pos.Y = float64(arg.num) * eng.units
 		case 'Z':
-			eng.workPos.Z += eng.toMachineZ(float64(arg.num)*eng.units, true) - eng.curPos.Z
+			pos.Z = float64(arg.num) * eng.units
 		}
 	}
-	eng.useWorkPos = true
 
+	err = eng.setCurrentPosition(pos)
+	if err != nil {
+		return nil, err
+	}
 	return codes, nil
 }
 
+func (eng *engine) newParser(s io.ByteScanner) *Parser {
+	return &Parser{
+		Scanner:          s,
+		Features:         eng.features,
+		OutW:             eng.outW,
+		ErrW:             eng.errW,
+		GetNumParam:      eng.getNumParam,
+		SetNumParam:      eng.setNumParam,
+		GetNameParam:     eng.getNameParam,
+		SetNameParam:     eng.setNameParam,
+		LineNumberExpr:   eng.LineNumberExpr,
+		MaxReferences:    eng.MaxReferences,
+		BeagleGComments:  eng.BeagleGComments,
+		PrefixedIntegers: eng.PrefixedIntegers,
+		BitwiseOperators: eng.BitwiseOperators,
+		LineTerminator:   eng.LineTerminator,
+		RequireChecksum:  eng.RequireChecksum,
+		CommentHandlers:  eng.commentHandlers(),
+		Warn:             eng.Warn,
+	}
+}
+
+func (eng *engine) commentHandlers() map[string]func(body string) error {
+	if !eng.DefaultsComment {
+		return eng.CommentHandlers
+	}
+
+	handlers := map[string]func(body string) error{}
+	for cmd, fn := range eng.CommentHandlers {
+		handlers[cmd] = fn
+	}
+	handlers["defaults"] = eng.setDefaults
+	return handlers
+}
+
+// setDefaults sets the feed and the spindle speed from the body of a DEFAULTS comment.
+func (eng *engine) setDefaults(body string) error {
+	p := Parser{Scanner: strings.NewReader(body + "\n")}
+	codes, err := p.Parse()
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("DEFAULTS: %s", err)
+	}
+
+	for _, code := range codes {
+		num, ok := code.Value.AsNumber()
+		if !ok {
+			return fmt.Errorf("DEFAULTS: expected a number: %s", code)
+		}
+		switch code.Letter {
+		case 'F':
+			err = eng.setFeed(float64(num))
+		case 'S':
+			if num < 0.0 {
+				return fmt.Errorf("DEFAULTS: spindle speed must not be negative: %s", num)
+			}
+			err = eng.setSpindleSpeed(-1, float64(num))
+		default:
+			return fmt.Errorf("DEFAULTS: expected F or S: %s", code)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EvaluateString evaluates the program in s on a new engine for m; the output from MSG, DEBUG,
+// and PRINT comments is discarded.
+func EvaluateString(s string, m Machine, f Features) error {
+	return NewEngine(m, f, ioutil.Discard, ioutil.Discard).Evaluate(strings.NewReader(s))
+}
+
+// BreakError is returned by Evaluate and Continue when evaluation stops before a line with one
+// of BreakBeforeMCodes. Line is the number, starting at 1, of the line, and State is the state,
+// from MarshalState, before the line, so that the program may be restarted at the line by
+// another engine; the state of the parser, such as subroutines and loops, is not included.
+type BreakError struct {
+	Line  int
+	Code  Code
+	State []byte
+}
+
+func (be BreakError) Error() string {
+	return fmt.Sprintf("%d: break before %s", be.Line, formatCode(be.Code))
+}
+
 func (eng *engine) Evaluate(s io.ByteScanner) error {
-	p := Parser{
-		Scanner:      s,
-		Features:     eng.features,
-		OutW:         eng.outW,
-		ErrW:         eng.errW,
-		GetNumParam:  eng.getNumParam,
-		SetNumParam:  eng.setNumParam,
-		GetNameParam: eng.getNameParam,
-		SetNameParam: eng.setNameParam,
+	eng.parser = eng.newParser(s)
+	eng.breakCodes = nil
+	eng.programEnded = false
+	eng.modalGroups = 0
+	return eng.evaluate(nil)
+}
+
+// Continue continues evaluating the program, starting with the line at which Evaluate or
+// Continue stopped and returned a BreakError.
+func (eng *engine) Continue() error {
+	if eng.breakCodes == nil {
+		return errors.New("expected evaluation to have stopped at a break")
+	}
+	codes := eng.breakCodes
+	eng.breakCodes = nil
+	return eng.evaluate(codes)
+}
+
+// breakCode returns the first of the codes which is one of BreakBeforeMCodes.
+func (eng *engine) breakCode(codes []Code) (Code, bool) {
+	for _, code := range codes {
+		num, ok := code.Value.AsNumber()
+		if code.Letter != 'M' || !ok {
+			continue
+		}
+		for _, m := range eng.BreakBeforeMCodes {
+			if num.Equal(Number(m)) {
+				return code, true
+			}
+		}
+	}
+	return Code{}, false
+}
+
+// evaluate evaluates the rest of the program; if codes is not nil, it is the first line and is
+// evaluated without checking for a break.
+func (eng *engine) evaluate(codes []Code) error {
+	p := eng.parser
+	for {
+		if codes == nil {
+			var err error
+			codes, err = p.Parse()
+			if err == io.EOF {
+				return eng.checkProgramEnded()
+			} else if err != nil {
+				return err
+			}
+
+			if code, ok := eng.breakCode(codes); ok {
+				state, err := eng.MarshalState()
+				if err != nil {
+					return err
+				}
+				eng.breakCodes = append([]Code{}, codes...)
+				return BreakError{Line: p.physicalLine, Code: code, State: state}
+			}
+		}
+
+		done, err := eng.evaluateCodes(p, codes)
+		codes = nil
+		if pe, ok := err.(parseError); ok {
+			return pe.err
+		} else if err != nil {
+			return fmt.Errorf("%s: %s", p.where(), err)
+		} else if done {
+			return eng.checkProgramEnded()
+		}
+	}
+
+	// Never reached.
+}
+
+// EvaluateState evaluates a program like Evaluate, and returns the final modal state.
+func (eng *engine) EvaluateState(s io.ByteScanner) (State, error) {
+	err := eng.Evaluate(s)
+	if err != nil {
+		return State{}, err
+	}
+	return eng.State(), nil
+}
+
+// State returns a snapshot of the current modal state.
+func (eng *engine) State() State {
+	st := State{
+		Position:               eng.curPos,
+		Inches:                 eng.units != 1.0,
+		Absolute:               eng.absoluteMode,
+		Plane:                  eng.arcPlane,
+		CoordinateSystem:       eng.curCoordSys + 1,
+		CoordinateSystemOffset: eng.coordSysPos[eng.curCoordSys],
+		LocalOffset:            eng.localPos,
+		ToolLengthOffset:       eng.toolLengthOffset,
+		Tool:                   eng.CurrentTool(),
+		Feed:                   eng.feed,
+		FeedMode:               eng.feedMode,
+	}
+	if eng.useWorkPos {
+		st.WorkOffset = eng.workPos
 	}
+	ss := eng.spindleState(0)
+	st.SpindleOn = ss.on
+	st.SpindleSpeed = ss.speed
+	st.SpindleClockwise = ss.clockwise
+	st.ConstantSurface = eng.constantSurface
+	st.Mist = eng.mist
+	st.Flood = eng.flood
+	return st
+}
+
+// ProgramEnded returns true if the most recently evaluated program ended with M2 or M30, rather
+// than at the end of the input.
+func (eng *engine) ProgramEnded() bool {
+	return eng.programEnded
+}
+
+func (eng *engine) checkProgramEnded() error {
+	if eng.RequireProgramEnd && !eng.programEnded {
+		return errors.New("expected M2 or M30 at the end of the program")
+	}
+	return nil
+}
+
+// EvaluateCollect evaluates a program like Evaluate, except that when evaluating a line fails,
+// the error, prefixed by the line number, is collected and evaluation continues with the next
+// line. An error from the parser is also collected, but stops evaluation.
+func (eng *engine) EvaluateCollect(s io.ByteScanner) []error {
+	eng.parser = eng.newParser(s)
+	eng.breakCodes = nil
+	eng.programEnded = false
+	eng.modalGroups = 0
 
+	var errs []error
 	for {
+		p := eng.parser
 		codes, err := p.Parse()
 		if err == io.EOF {
-			return nil
+			if err = eng.checkProgramEnded(); err != nil {
+				errs = append(errs, err)
+			}
+			return errs
 		} else if err != nil {
-			return err
+			return append(errs, err)
 		}
 
-		useMachine := false
-		for len(codes) > 0 {
-			code := codes[0]
-			num, ok := code.Value.AsNumber()
-			if !ok {
-				return fmt.Errorf("expected a number: %s", code)
+		done, err := eng.evaluateCodes(p, codes)
+		if pe, ok := err.(parseError); ok {
+			return append(errs, pe.err)
+		} else if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", p.where(), err))
+		} else if done {
+			if err = eng.checkProgramEnded(); err != nil {
+				errs = append(errs, err)
 			}
+			return errs
+		}
+	}
 
-			switch code.Letter {
-			case 'G':
-				codes = codes[1:]
+	// Never reached.
+}
 
-				if num.Equal(0.0) { // G0: rapid move
-					eng.moveMode = rapidMove
-					codes, err = eng.moveTo(codes, useMachine)
-					if err != nil {
-						return err
-					}
-				} else if num.Equal(1.0) { // G1: linear move
-					eng.moveMode = linearMove
-					codes, err = eng.moveTo(codes, useMachine)
-					if err != nil {
-						return err
-					}
-				} else if num.Equal(2.0) { // G2: clockwise arc move
-					eng.moveMode = clockwiseArcMove
-					codes, err = eng.arcTo(codes, useMachine)
-					if err != nil {
-						return err
-					}
-				} else if num.Equal(3.0) { // G3: counter-clockwise arc move
-					eng.moveMode = counterClockwiseArcMove
-					codes, err = eng.arcTo(codes, useMachine)
-					if err != nil {
-						return err
-					}
-				} else if num.Equal(10.0) { // G10
-					codes, err = eng.modifyPositions(codes)
-					if err != nil {
-						return err
-					}
-				} else if num.Equal(17.0) { // G17: XY plane selection
-					eng.arcPlane = XYPlane
-				} else if num.Equal(18.0) { // G18: ZX plane selection
-					eng.arcPlane = ZXPlane
-				} else if num.Equal(19.0) { // G19: YZ plane selection
-					eng.arcPlane = YZPlane
-				} else if num.Equal(20.0) { // G20: coordinates in inches
-					eng.units = mmPerInch
-				} else if num.Equal(21.0) { // G21: coordinates in mm
-					eng.units = 1.0
-				} else if num.Equal(28.0) { // G28: go home
-					codes, err = eng.moveToPredefined(codes, eng.homePos)
-					if err != nil {
-						return err
-					}
-				} else if num.Equal(28.1) { // G28.1: set home
-					eng.homePos = eng.curPos
-				} else if num.Equal(30.0) { // G30: go predefined position
-					codes, err = eng.moveToPredefined(codes, eng.secondPos)
-					if err != nil {
-						return err
-					}
-				} else if num.Equal(30.1) { // G30.1: set predefined position
-					eng.secondPos = eng.curPos
-				} else if num.Equal(53.0) { // G53: move in machine coordinates
-					useMachine = true
-					if len(codes) == 0 {
-						codes, err = p.Parse()
-						if err == io.EOF {
-							return nil
-						} else if err != nil {
-							return err
-						}
-					}
-				} else if num.Equal(54.0) { // G54: use coordinate system one
-					eng.curCoordSys = 0
-				} else if num.Equal(55.0) { // G55: use coordinate system two
-					eng.curCoordSys = 1
-				} else if num.Equal(56.0) { // G56: use coordinate system three
-					eng.curCoordSys = 2
-				} else if num.Equal(57.0) { // G57: use coordinate system four
-					eng.curCoordSys = 3
-				} else if num.Equal(58.0) { // G58: use coordinate system five
-					eng.curCoordSys = 4
-				} else if num.Equal(59.0) { // G59: use coordinate system six
-					eng.curCoordSys = 5
-				} else if num.Equal(59.1) { // G59.1: use coordinate system seven
-					eng.curCoordSys = 6
-				} else if num.Equal(59.2) { // G59.2: use coordinate system eight
-					eng.curCoordSys = 7
-				} else if num.Equal(59.3) { // G59.3: use coordinate system nine
-					eng.curCoordSys = 8
-				} else if num.Equal(90.0) { // G90: absolute distance mode
-					eng.absoluteMode = true
-				} else if num.Equal(90.1) { // G90.1: absolute arc mode
-					eng.absoluteArcMode = true
-				} else if num.Equal(91.0) { // G91: incremental distance mode
-					eng.absoluteMode = false
-				} else if num.Equal(91.1) { // G91.1: incremental arc mode
-					eng.absoluteArcMode = false
-				} else if num.Equal(92.0) { // G92: set work position
-					codes, err = eng.setWorkPosition(codes)
-					if err != nil {
-						return err
-					}
-				} else if num.Equal(92.1) { // G92.1: zero work position
-					eng.useWorkPos = false
-					eng.workPos = zeroPosition
-				} else if num.Equal(92.2) { // G92.2: save work position, then zero
-					eng.useWorkPos = false
-				} else if num.Equal(92.3) { // G92.3: restore saved work position
-					eng.useWorkPos = true
-				} else {
-					codes, err = eng.handleUnknown(code, codes, eng.setCurrentPosition)
-					if err != nil {
-						return err
+// parseError is an error from the parser, rather than from evaluating codes.
+type parseError struct {
+	err error
+}
+
+func (pe parseError) Error() string {
+	return pe.err.Error()
+}
+
+// evaluateCodes evaluates one line of codes and returns true if the program has ended.
+func (eng *engine) evaluateCodes(p *Parser, codes []Code) (bool, error) {
+	eng.line = p.where()
+	eng.lineNum = p.physicalLine
+
+	var err error
+	if eng.CodeFilter != nil {
+		codes, err = eng.CodeFilter(codes)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	var spindle int
+	codes, spindle, err = eng.selectSpindle(codes)
+	if err != nil {
+		return false, err
+	}
+
+	useMachine := false
+	for len(codes) > 0 {
+		code := codes[0]
+		num, ok := code.Value.AsNumber()
+		if !ok {
+			return false, fmt.Errorf("expected a number: %s", code)
+		}
+
+		switch code.Letter {
+		case 'G':
+			codes = codes[1:]
+			if eng.WarnRedundantModes {
+				eng.checkRedundantMode(num)
+			}
+
+			if num.Equal(0.0) { // G0: rapid move
+				eng.moveMode = rapidMove
+				codes, err = eng.moveTo(codes, useMachine)
+				if err != nil {
+					return false, err
+				}
+			} else if num.Equal(1.0) { // G1: linear move
+				eng.moveMode = linearMove
+				codes, err = eng.moveTo(codes, useMachine)
+				if err != nil {
+					return false, err
+				}
+			} else if num.Equal(2.0) { // G2: clockwise arc move
+				eng.moveMode = clockwiseArcMove
+				codes, err = eng.arcTo(codes, useMachine)
+				if err != nil {
+					return false, err
+				}
+			} else if num.Equal(3.0) { // G3: counter-clockwise arc move
+				eng.moveMode = counterClockwiseArcMove
+				codes, err = eng.arcTo(codes, useMachine)
+				if err != nil {
+					return false, err
+				}
+			} else if d, ok := eng.machine.(Dweller); ok && num.Equal(4.0) { // G4: dwell
+				codes, err = eng.dwell(d, codes)
+				if err != nil {
+					return false, err
+				}
+			} else if eng.Lathe && num.Equal(7.0) { // G7: lathe diameter mode
+				eng.diameterMode = true
+			} else if eng.Lathe && num.Equal(8.0) { // G8: lathe radius mode
+				eng.diameterMode = false
+			} else if num.Equal(10.0) { // G10
+				codes, err = eng.modifyPositions(codes)
+				if err != nil {
+					return false, err
+				}
+			} else if num.Equal(17.0) { // G17: XY plane selection
+				eng.arcPlane = XYPlane
+			} else if num.Equal(18.0) { // G18: ZX plane selection
+				eng.arcPlane = ZXPlane
+			} else if num.Equal(19.0) { // G19: YZ plane selection
+				eng.arcPlane = YZPlane
+			} else if num.Equal(20.0) { // G20: coordinates in inches
+				eng.units = mmPerInch
+			} else if num.Equal(21.0) { // G21: coordinates in mm
+				eng.units = 1.0
+			} else if num.Equal(28.0) { // G28: go home
+				codes, err = eng.moveToPredefined(codes, eng.homePos)
+				if err != nil {
+					return false, err
+				}
+			} else if num.Equal(28.1) { // G28.1: set home
+				eng.homePos = eng.curPos
+			} else if num.Equal(28.3) { // G28.3: set machine position
+				codes, err = eng.setMachinePosition(codes)
+				if err != nil {
+					return false, err
+				}
+			} else if num.Equal(30.0) { // G30: go predefined position
+				codes, err = eng.moveToPredefined(codes, eng.secondPos)
+				if err != nil {
+					return false, err
+				}
+			} else if num.Equal(30.1) { // G30.1: set predefined position
+				eng.secondPos = eng.curPos
+			} else if pr, ok := eng.machine.(Prober); ok &&
+				(num.Equal(38.2) || num.Equal(38.3) || num.Equal(38.4) || num.Equal(38.5)) {
+
+				// G38.2, G38.3, G38.4, G38.5: probe
+				codes, err = eng.probe(pr, codes, useMachine, num.Equal(38.2) || num.Equal(38.3),
+					num.Equal(38.2) || num.Equal(38.4))
+				if err != nil {
+					return false, err
+				}
+			} else if num.Equal(43.0) { // G43: apply tool length offset
+				codes, err = eng.applyToolLengthOffset(codes)
+				if err != nil {
+					return false, err
+				}
+			} else if num.Equal(49.0) { // G49: cancel tool length offset
+				eng.toolLengthOffset = 0.0
+			} else if num.Equal(52.0) { // G52: set local offset
+				codes, err = eng.setLocalPosition(codes)
+				if err != nil {
+					return false, err
+				}
+			} else if num.Equal(53.0) { // G53: move in machine coordinates
+				useMachine = true
+				if len(codes) == 0 {
+					codes, err = p.Parse()
+					if err == io.EOF {
+						return true, nil
+					} else if err != nil {
+						return false, parseError{err}
 					}
 				}
-			case 'M':
-				codes = codes[1:]
+			} else if num.Equal(54.0) { // G54: use coordinate system one
+				eng.curCoordSys = 0
+			} else if num.Equal(55.0) { // G55: use coordinate system two
+				eng.curCoordSys = 1
+			} else if num.Equal(56.0) { // G56: use coordinate system three
+				eng.curCoordSys = 2
+			} else if num.Equal(57.0) { // G57: use coordinate system four
+				eng.curCoordSys = 3
+			} else if num.Equal(58.0) { // G58: use coordinate system five
+				eng.curCoordSys = 4
+			} else if num.Equal(59.0) { // G59: use coordinate system six
+				eng.curCoordSys = 5
+			} else if num.Equal(59.1) { // G59.1: use coordinate system seven
+				eng.curCoordSys = 6
+			} else if num.Equal(59.2) { // G59.2: use coordinate system eight
+				eng.curCoordSys = 7
+			} else if num.Equal(59.3) { // G59.3: use coordinate system nine
+				eng.curCoordSys = 8
+			} else if num.Equal(61.0) { // G61: exact path mode
+				codes, err = eng.setPathMode(codes, ExactPathMode)
+				if err != nil {
+					return false, err
+				}
+			} else if num.Equal(61.1) { // G61.1: exact stop mode
+				codes, err = eng.setPathMode(codes, ExactStopMode)
+				if err != nil {
+					return false, err
+				}
+			} else if num.Equal(64.0) { // G64: continuous mode
+				codes, err = eng.setPathMode(codes, ContinuousPathMode)
+				if err != nil {
+					return false, err
+				}
+			} else if num.Equal(80.0) { // G80: cancel canned cycle
+				eng.cancelCannedCycle()
+			} else if num.Equal(81.0) { // G81: drilling cycle
+				eng.startCannedCycle(drillMove)
+				codes, err = eng.cannedCycle(codes, useMachine)
+				if err != nil {
+					return false, err
+				}
+			} else if num.Equal(82.0) { // G82: drilling cycle with dwell
+				eng.startCannedCycle(drillDwellMove)
+				codes, err = eng.cannedCycle(codes, useMachine)
+				if err != nil {
+					return false, err
+				}
+			} else if num.Equal(83.0) { // G83: peck drilling cycle
+				eng.startCannedCycle(peckDrillMove)
+				codes, err = eng.cannedCycle(codes, useMachine)
+				if err != nil {
+					return false, err
+				}
+			} else if num.Equal(90.0) { // G90: absolute distance mode
+				eng.absoluteMode = true
+			} else if num.Equal(90.1) { // G90.1: absolute arc mode
+				eng.absoluteArcMode = true
+			} else if num.Equal(91.0) { // G91: incremental distance mode
+				eng.absoluteMode = false
+			} else if num.Equal(91.1) { // G91.1: incremental arc mode
+				eng.absoluteArcMode = false
+			} else if num.Equal(92.0) { // G92: set work position
+				codes, err = eng.setWorkPosition(codes)
+				if err != nil {
+					return false, err
+				}
+			} else if num.Equal(92.1) { // G92.1: zero work position
+				eng.useWorkPos = false
+				eng.workPos = zeroPosition
+			} else if num.Equal(92.2) { // G92.2: save work position, then zero
+				eng.useWorkPos = false
+			} else if num.Equal(92.3) { // G92.3: restore saved work position
+				eng.useWorkPos = true
+			} else if num.Equal(93.0) { // G93: inverse time feed mode
+				eng.setFeedMode(InverseTimeFeed)
+			} else if num.Equal(94.0) { // G94: units per minute feed mode
+				eng.setFeedMode(UnitsPerMinuteFeed)
+			} else if num.Equal(95.0) { // G95: units per revolution feed mode
+				eng.setFeedMode(UnitsPerRevolutionFeed)
+			} else if eng.Lathe && num.Equal(96.0) { // G96: constant surface speed
+				codes, err = eng.constantSurfaceSpeed(codes)
+				if err != nil {
+					return false, err
+				}
+			} else if eng.Lathe && num.Equal(97.0) { // G97: RPM mode
+				eng.constantSurface = false
+			} else if num.Equal(98.0) { // G98: retract to initial Z for canned cycles
+				eng.cycle.retractR = false
+			} else if num.Equal(99.0) { // G99: retract to R for canned cycles
+				eng.cycle.retractR = true
+			} else {
+				codes, err = eng.handleUnknown(code, codes, eng.setCurrentPosition)
+				if err != nil {
+					return false, err
+				}
+			}
+		case 'M':
+			codes = codes[1:]
 
-				if num.Equal(2.0) || num.Equal(30.0) { // M2, M3: end program
-					return eng.endProgram()
-				} else if num.Equal(3.0) { // M3: spindle on clockwise
-					eng.spindleOn = true
-					eng.spindleClockwise = true
-					err = eng.setSpindle(eng.spindleSpeed, eng.spindleClockwise)
-					if err != nil {
-						return err
-					}
-				} else if num.Equal(4.0) { // M4: spindle on counter-clockwise
-					eng.spindleOn = true
-					eng.spindleClockwise = false
-					err = eng.setSpindle(eng.spindleSpeed, eng.spindleClockwise)
-					if err != nil {
-						return err
-					}
-				} else if num.Equal(5.0) { // M5: spindle off
-					eng.spindleOn = false
-					err = eng.spindleOff()
-					if err != nil {
-						return err
-					}
+			if pr, ok := eng.machine.(Pauser); ok && (num.Equal(0.0) || num.Equal(1.0)) {
+				// M0: pause; M1: optional pause
+				eng.trace("pause %v %q", num.Equal(1.0), p.message)
+				err = pr.Pause(num.Equal(1.0), p.message)
+				if err != nil {
+					return false, err
+				}
+			} else if num.Equal(2.0) || num.Equal(30.0) { // M2, M3: end program
+				eng.programEnded = true
+				return true, eng.endProgram()
+			} else if num.Equal(3.0) { // M3: spindle on clockwise
+				err = eng.startSpindle(spindle, true)
+				if err != nil {
+					return false, err
+				}
+			} else if num.Equal(4.0) { // M4: spindle on counter-clockwise
+				err = eng.startSpindle(spindle, false)
+				if err != nil {
+					return false, err
+				}
+			} else if num.Equal(5.0) { // M5: spindle off
+				err = eng.stopSpindle(spindle)
+				if err != nil {
+					return false, err
+				}
+			} else if tc, ok := eng.machine.(ToolChanger); ok && num.Equal(6.0) {
+				// M6: change tool
+				err = eng.changeTool(tc)
+				if err != nil {
+					return false, err
+				}
+			} else if cs, ok := eng.machine.(CoolantSetter); ok &&
+				(num.Equal(7.0) || num.Equal(8.0) || num.Equal(9.0)) {
+
+				// M7: mist coolant on; M8: flood coolant on; M9: coolant off
+				if num.Equal(7.0) {
+					err = eng.setCoolant(cs, true, eng.flood)
+				} else if num.Equal(8.0) {
+					err = eng.setCoolant(cs, eng.mist, true)
 				} else {
-					codes, err = eng.handleUnknown(code, codes, eng.setCurrentPosition)
-					if err != nil {
-						return err
-					}
+					err = eng.setCoolant(cs, false, false)
 				}
-			case 'F':
-				switch eng.moveMode {
-				case linearMove:
-					codes, err = eng.moveTo(codes, useMachine)
-					if err != nil {
-						return err
-					}
-				case clockwiseArcMove, counterClockwiseArcMove:
-					codes, err = eng.arcTo(codes, useMachine)
-					if err != nil {
-						return err
-					}
-				default:
-					return fmt.Errorf("arg not allowed: %s", code)
-				}
-			case 'I', 'J', 'K', 'P', 'R':
-				switch eng.moveMode {
-				case clockwiseArcMove, counterClockwiseArcMove:
-					codes, err = eng.arcTo(codes, useMachine)
-					if err != nil {
-						return err
-					}
-				default:
-					return fmt.Errorf("arg not allowed: %s", code)
+				if err != nil {
+					return false, err
 				}
-			case 'S':
-				if num < 0.0 {
-					return fmt.Errorf("spindle speed must not be negative: %s", num)
+			} else if so, ok := eng.machine.(SpindleOrienter); ok && num.Equal(19.0) {
+				// M19: orient spindle
+				codes, err = eng.orientSpindle(so, codes)
+				if err != nil {
+					return false, err
 				}
-
-				codes = codes[1:]
-				eng.spindleSpeed = float64(num)
-				if eng.spindleOn {
-					err = eng.setSpindle(eng.spindleSpeed, eng.spindleClockwise)
-					if err != nil {
-						return err
-					}
+			} else if num.Equal(48.0) || num.Equal(49.0) {
+				// M48: enable overrides; M49: disable overrides
+				err = eng.enableOverrides(num.Equal(48.0))
+				if err != nil {
+					return false, err
 				}
-			case 'T':
-				codes = codes[1:]
-				tool, ok := num.AsInteger()
-				if !ok || tool < 0 {
-					return fmt.Errorf("expected a non-negative integer: T%s", num)
+			} else if eng.IgnoreUnknownMCodes {
+				codes = eng.ignoreUnknown(code, codes)
+			} else {
+				codes, err = eng.handleUnknown(code, codes, eng.setCurrentPosition)
+				if err != nil {
+					return false, err
 				}
-				err = eng.selectTool(uint(tool))
+			}
+		case 'F':
+			switch eng.moveMode {
+			case linearMove:
+				codes, err = eng.moveTo(codes, useMachine)
 				if err != nil {
-					return err
+					return false, err
 				}
-			case 'X', 'Y', 'Z':
-				switch eng.moveMode {
-				case rapidMove, linearMove:
-					codes, err = eng.moveTo(codes, useMachine)
-					if err != nil {
-						return err
-					}
-				case clockwiseArcMove, counterClockwiseArcMove:
-					codes, err = eng.arcTo(codes, useMachine)
-					if err != nil {
-						return err
-					}
-				default:
-					return fmt.Errorf("arg not allowed: %s", code)
+			case clockwiseArcMove, counterClockwiseArcMove:
+				codes, err = eng.arcTo(codes, useMachine)
+				if err != nil {
+					return false, err
 				}
+			case drillMove, drillDwellMove, peckDrillMove:
+				codes, err = eng.cannedCycle(codes, useMachine)
+				if err != nil {
+					return false, err
+				}
+			default:
+				return false, fmt.Errorf("arg not allowed: %s", code)
+			}
+		case 'I', 'J', 'K', 'P', 'R':
+			switch eng.moveMode {
+			case clockwiseArcMove, counterClockwiseArcMove:
+				codes, err = eng.arcTo(codes, useMachine)
+				if err != nil {
+					return false, err
+				}
+			case drillMove, drillDwellMove, peckDrillMove:
+				if code.Letter != 'P' && code.Letter != 'R' {
+					return false, fmt.Errorf("arg not allowed: %s", code)
+				}
+				codes, err = eng.cannedCycle(codes, useMachine)
+				if err != nil {
+					return false, err
+				}
+			default:
+				return false, argNotAllowed(code)
+			}
+		case 'S':
+			if num < 0.0 {
+				return false, fmt.Errorf("spindle speed must not be negative: %s", num)
+			}
+
+			codes = codes[1:]
+			err = eng.setSpindleSpeed(spindle, float64(num))
+			if err != nil {
+				return false, err
+			}
+		case 'T':
+			codes = codes[1:]
+			tool := num.RoundToInteger()
+			if !num.Equal(Number(tool)) || tool < 0 {
+				return false, fmt.Errorf("expected a non-negative integer: T%s", num)
+			}
+			err = eng.selectTool(uint(tool))
+			if err != nil {
+				return false, err
+			}
+		case 'X', 'Y', 'Z', '@', '^':
+			switch eng.moveMode {
+			case rapidMove, linearMove:
+				codes, err = eng.moveTo(codes, useMachine)
+				if err != nil {
+					return false, err
+				}
+			case clockwiseArcMove, counterClockwiseArcMove:
+				codes, err = eng.arcTo(codes, useMachine)
+				if err != nil {
+					return false, err
+				}
+			case drillMove, drillDwellMove, peckDrillMove:
+				codes, err = eng.cannedCycle(codes, useMachine)
+				if err != nil {
+					return false, err
+				}
+			case noMove:
+				return false, fmt.Errorf("no active motion mode: %s", code)
 			default:
+				return false, fmt.Errorf("arg not allowed: %s", code)
+			}
+		case 'Q':
+			if !eng.moveMode.isCannedCycle() {
 				codes = codes[1:]
 				codes, err = eng.handleUnknown(code, codes, eng.setCurrentPosition)
 				if err != nil {
-					return err
+					return false, err
 				}
+				break
+			}
+			codes, err = eng.cannedCycle(codes, useMachine)
+			if err != nil {
+				return false, err
+			}
+		default:
+			codes = codes[1:]
+			codes, err = eng.handleUnknown(code, codes, eng.setCurrentPosition)
+			if err != nil {
+				return false, err
 			}
 		}
 	}
 
-	// Never reached.
+	return false, nil
 }
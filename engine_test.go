@@ -3,7 +3,9 @@ package gcode_test
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"os"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -17,6 +19,8 @@ const (
 	selectTool
 	rapidTo
 	linearTo
+	setSpindleN
+	changeTool
 )
 
 type action struct {
@@ -25,6 +29,7 @@ type action struct {
 	speed      float64
 	clockwise  bool
 	tool       uint
+	spindle    int
 }
 
 func (act1 action) equal(act2 action) bool {
@@ -35,7 +40,8 @@ func (act1 action) equal(act2 action) bool {
 		gcode.Number(act1.f).Equal(gcode.Number(act2.f)) &&
 		gcode.Number(act1.speed).Equal(gcode.Number(act2.speed)) &&
 		act1.clockwise == act2.clockwise &&
-		act1.tool == act2.tool
+		act1.tool == act2.tool &&
+		act1.spindle == act2.spindle
 }
 
 type machine struct {
@@ -90,6 +96,15 @@ func (m *machine) HandleUnknown(code gcode.Code, codes []gcode.Code,
 	return nil, fmt.Errorf("unexpected code: %s: %v", code, codes)
 }
 
+type multiSpindleMachine struct {
+	machine
+}
+
+func (m *multiSpindleMachine) SetSpindleN(index int, speed float64, clockwise bool) error {
+	return m.checkAction(action{cmd: setSpindleN, spindle: index, speed: speed,
+		clockwise: clockwise})
+}
+
 func TestEvaluate(t *testing.T) {
 	cases := []struct {
 		s       string
@@ -1335,6 +1350,9 @@ func TestEvaluateFail(t *testing.T) {
 		"S-1\n",
 		"T-1\n",
 		"T1.1\n",
+		"G-1 X1\n",
+		"G-91.1\n",
+		"M-3\n",
 		"#5420=123\n",
 		"#5421=123\n",
 		"#5422=123\n",
@@ -1355,3 +1373,2697 @@ func TestMisc(t *testing.T) {
 		t.Errorf("Position.String() got %s", pos)
 	}
 }
+
+func TestZeroFeed(t *testing.T) {
+	s := `
+G21
+G1 F2 X1
+F0 X2
+G1 X3 F0
+`
+
+	eng := gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+	err := eng.Evaluate(strings.NewReader(s))
+	if err == nil {
+		t.Errorf("Evaluate(F0) did not fail")
+	}
+
+	eng = gcode.NewEngine(
+		&machine{
+			actions: []action{
+				{cmd: setFeed, f: 2.0},
+				{cmd: linearTo, x: 1.0},
+				{cmd: linearTo, x: 2.0},
+				{cmd: linearTo, x: 3.0},
+			},
+		}, gcode.AllFeatures, os.Stdout, os.Stderr)
+	eng.RetainFeedOnZero = true
+	err = eng.Evaluate(strings.NewReader(s))
+	if err != nil {
+		t.Errorf("Evaluate(F0) failed: %s", err)
+	}
+}
+
+func TestMultiSpindle(t *testing.T) {
+	s := `
+S100 M3
+$1 S200 M4
+M3 S300 $0
+M5 $1
+$1 M3
+S400
+M2
+`
+
+	eng := gcode.NewEngine(
+		&multiSpindleMachine{
+			machine: machine{
+				actions: []action{
+					{cmd: setSpindle, speed: 100.0, clockwise: true},
+					{cmd: setSpindleN, spindle: 1, speed: 200.0, clockwise: false},
+					{cmd: setSpindleN, spindle: 0, speed: 100.0, clockwise: true},
+					{cmd: setSpindleN, spindle: 0, speed: 300.0, clockwise: true},
+					{cmd: setSpindleN, spindle: 1, speed: 0.0, clockwise: false},
+					{cmd: setSpindleN, spindle: 1, speed: 200.0, clockwise: true},
+					{cmd: setSpindle, speed: 400.0, clockwise: true},
+					{cmd: spindleOff},
+					{cmd: setSpindleN, spindle: 1, speed: 0.0, clockwise: true},
+				},
+			},
+		}, gcode.AllFeatures, os.Stdout, os.Stderr)
+	err := eng.Evaluate(strings.NewReader(s))
+	if err != nil {
+		t.Errorf("Evaluate(multi spindle) failed: %s", err)
+	}
+
+	for _, c := range []string{"$1 M3\n", "$0 $0 M3\n", "$-1 M3\n", "$1.5 M3\n"} {
+		eng = gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+		err = eng.Evaluate(strings.NewReader(c))
+		if err == nil {
+			t.Errorf("Evaluate(%s) did not fail", c)
+		}
+	}
+
+	eng = gcode.NewEngine(&machine{}, gcode.BeagleG, os.Stdout, os.Stderr)
+	err = eng.Evaluate(strings.NewReader("$0 M3\n"))
+	if err == nil {
+		t.Errorf("Evaluate($0 M3) did not fail without LinuxCNC")
+	}
+}
+
+func TestLocalOffset(t *testing.T) {
+	cases := []struct {
+		s       string
+		actions []action
+		out     string
+	}{
+		{s: `
+(debug,)
+G21
+G90
+G0 X1 Y1
+G52 X2 Y3
+G0 X1 Y1
+(debug,#5420 #5421)
+G52
+G0 X1 Y1
+(debug,#5420 #5421)
+`,
+			actions: []action{
+				{cmd: rapidTo, x: 1.0, y: 1.0},
+				{cmd: rapidTo, x: -1.0, y: -2.0},
+				{cmd: rapidTo, x: 1.0, y: 1.0},
+			},
+			out: `
+1.0000 1.0000
+1.0000 1.0000
+`,
+		},
+		{s: `
+G21
+G10 L2 P1 X-1 Y-1
+G90
+G54
+G0 X1 Y1
+G52 X-2 Z1
+G0 X1 Y1 Z0
+G91
+G1 F1 X1
+G90
+G52 X0 Y0 Z0
+G0 X0 Y0 Z0
+G55
+G52 X-1
+G0 X0 Y0
+M2
+G0 X0 Y0
+`,
+			actions: []action{
+				{cmd: rapidTo, x: 2.0, y: 2.0},
+				{cmd: rapidTo, x: 4.0, y: 2.0, z: -1.0},
+				{cmd: setFeed, f: 1.0},
+				{cmd: linearTo, x: 5.0, y: 2.0, z: -1.0},
+				{cmd: rapidTo, x: 1.0, y: 1.0, z: 0.0},
+				{cmd: rapidTo, x: 1.0, y: 0.0, z: 0.0},
+			},
+		},
+		{s: `
+G20
+G52 X-1
+G0 X0
+`,
+			actions: []action{
+				{cmd: rapidTo, x: 25.4},
+			},
+		},
+	}
+
+	for i, c := range cases {
+		var outW bytes.Buffer
+		eng := gcode.NewEngine(&machine{actions: c.actions}, gcode.AllFeatures, &outW, &outW)
+		err := eng.Evaluate(strings.NewReader(c.s))
+		if err != nil {
+			t.Errorf("Evaluate(%d) failed: %s", i, err)
+		}
+		out := outW.String()
+		if out != c.out {
+			t.Errorf("Evaluate(%d) outW: got %s want %s", i, out, c.out)
+		}
+	}
+}
+
+func TestSelectTool(t *testing.T) {
+	eng := gcode.NewEngine(
+		&machine{
+			actions: []action{
+				{cmd: selectTool, tool: 2},
+				{cmd: selectTool, tool: 2},
+				{cmd: selectTool, tool: 3},
+			},
+		}, gcode.AllFeatures, os.Stdout, os.Stderr)
+	err := eng.Evaluate(strings.NewReader("T2.0\nT1.9999999\nT3.0000001\n"))
+	if err != nil {
+		t.Errorf("Evaluate(T) failed: %s", err)
+	}
+}
+
+func TestCurrentTool(t *testing.T) {
+	eng := gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+	if eng.CurrentTool() != 0 {
+		t.Errorf("CurrentTool() got %d want 0", eng.CurrentTool())
+	}
+
+	eng = gcode.NewEngine(
+		&machine{
+			actions: []action{
+				{cmd: rapidTo, x: 1.0},
+				{cmd: selectTool, tool: 3},
+			},
+		}, gcode.AllFeatures, os.Stdout, os.Stderr)
+	eng.InitialTool = 7
+	if eng.CurrentTool() != 7 {
+		t.Errorf("CurrentTool() got %d want 7", eng.CurrentTool())
+	}
+	err := eng.Evaluate(strings.NewReader("G0 X1\n"))
+	if err != nil {
+		t.Errorf("Evaluate(G0 X1) failed: %s", err)
+	} else if eng.CurrentTool() != 7 {
+		t.Errorf("CurrentTool() got %d want 7", eng.CurrentTool())
+	}
+	err = eng.Evaluate(strings.NewReader("T3\n"))
+	if err != nil {
+		t.Errorf("Evaluate(T3) failed: %s", err)
+	} else if eng.CurrentTool() != 3 {
+		t.Errorf("CurrentTool() got %d want 3", eng.CurrentTool())
+	}
+}
+
+func TestWorkPosition(t *testing.T) {
+	cases := []struct {
+		s       string
+		actions []action
+		out     string
+	}{
+		{s: `
+(debug,)
+G21
+G90
+G10 L2 P1 X0 Y0
+G10 L2 P2 X-1 Y-1
+G54
+G0 X0 Y0
+G92 X-2
+(debug,#5210 #5211 #5420 #5421)
+G0 X0 Y0
+G55
+(debug,#5210 #5211 #5420 #5421)
+G0 X0 Y0
+G54
+(debug,#5210 #5211 #5420 #5421)
+G0 X0 Y0
+`,
+			actions: []action{
+				{cmd: rapidTo, x: 2.0, y: 0.0},
+				{cmd: rapidTo, x: 3.0, y: 1.0},
+				{cmd: rapidTo, x: 2.0, y: 0.0},
+			},
+			out: `
+1.0000 -2.0000 -2.0000 0.0000
+1.0000 -2.0000 -1.0000 -1.0000
+1.0000 -2.0000 1.0000 1.0000
+`,
+		},
+		{s: `
+(debug,)
+G21
+G90
+G0 X1 Y1
+G92 X0 Y0
+G10 L20 P2 X5 Y5
+G55
+(debug,#5420 #5421)
+G0 X5 Y5
+G0 X0 Y0
+G54
+(debug,#5420 #5421)
+G0 X0 Y0
+`,
+			actions: []action{
+				{cmd: rapidTo, x: 1.0, y: 1.0},
+				{cmd: rapidTo, x: -4.0, y: -4.0},
+				{cmd: rapidTo, x: 1.0, y: 1.0},
+			},
+			out: `
+5.0000 5.0000
+-5.0000 -5.0000
+`,
+		},
+		{s: `
+G21
+G90
+G10 L2 P2 X-1 Y-1
+G92 X-2 Y-2
+G55
+G0 X0 Y0
+G92.2
+G0 X0 Y0
+G54
+G0 X0 Y0
+G92.3
+G0 X0 Y0
+G55
+G92.1
+G0 X0 Y0
+G54
+G0 X0 Y0
+`,
+			actions: []action{
+				{cmd: rapidTo, x: 3.0, y: 3.0},
+				{cmd: rapidTo, x: 1.0, y: 1.0},
+				{cmd: rapidTo, x: 0.0, y: 0.0},
+				{cmd: rapidTo, x: 2.0, y: 2.0},
+				{cmd: rapidTo, x: 1.0, y: 1.0},
+				{cmd: rapidTo, x: 0.0, y: 0.0},
+			},
+		},
+	}
+
+	for i, c := range cases {
+		var outW bytes.Buffer
+		eng := gcode.NewEngine(&machine{actions: c.actions}, gcode.AllFeatures, &outW, &outW)
+		err := eng.Evaluate(strings.NewReader(c.s))
+		if err != nil {
+			t.Errorf("Evaluate(%d) failed: %s", i, err)
+		}
+		out := outW.String()
+		if out != c.out {
+			t.Errorf("Evaluate(%d) outW: got %s want %s", i, out, c.out)
+		}
+	}
+}
+
+type dropMachine struct {
+	machine
+}
+
+func (m *dropMachine) HandleUnknown(code gcode.Code, codes []gcode.Code,
+	setCurPos func(pos gcode.Position) error) ([]gcode.Code, error) {
+
+	return nil, nil
+}
+
+type skipMachine struct {
+	machine
+}
+
+func (m *skipMachine) HandleUnknown(code gcode.Code, codes []gcode.Code,
+	setCurPos func(pos gcode.Position) error) ([]gcode.Code, error) {
+
+	return codes, nil
+}
+
+type injectMachine struct {
+	machine
+}
+
+func (m *injectMachine) HandleUnknown(code gcode.Code, codes []gcode.Code,
+	setCurPos func(pos gcode.Position) error) ([]gcode.Code, error) {
+
+	return append([]gcode.Code{{'G', gcode.Number(0)}}, codes...), nil
+}
+
+func TestUnknownCodes(t *testing.T) {
+	s := `
+G140 X1
+G0 X2
+M100 P1 Q2
+D3 G0 X3
+`
+
+	var unknown [][]gcode.Code
+	eng := gcode.NewEngine(
+		&dropMachine{
+			machine: machine{
+				actions: []action{
+					{cmd: rapidTo, x: 2.0},
+				},
+			},
+		}, gcode.AllFeatures, os.Stdout, os.Stderr)
+	eng.UnknownCodes = func(codes []gcode.Code) {
+		unknown = append(unknown, codes)
+	}
+	err := eng.Evaluate(strings.NewReader(s))
+	if err != nil {
+		t.Errorf("Evaluate(drop) failed: %s", err)
+	}
+	want := [][]gcode.Code{
+		{{'G', gcode.Number(140)}, {'X', gcode.Number(1)}},
+		{{'M', gcode.Number(100)}, {'P', gcode.Number(1)}, {'Q', gcode.Number(2)}},
+		{{'D', gcode.Number(3)}, {'G', gcode.Number(0)}, {'X', gcode.Number(3)}},
+	}
+	if !reflect.DeepEqual(unknown, want) {
+		t.Errorf("UnknownCodes(drop) got %v want %v", unknown, want)
+	}
+
+	unknown = nil
+	eng = gcode.NewEngine(
+		&skipMachine{
+			machine: machine{
+				actions: []action{
+					{cmd: rapidTo, x: 1.0},
+					{cmd: rapidTo, x: 2.0},
+					{cmd: rapidTo, x: 3.0},
+				},
+			},
+		}, gcode.AllFeatures, os.Stdout, os.Stderr)
+	eng.UnknownCodes = func(codes []gcode.Code) {
+		unknown = append(unknown, codes)
+	}
+	err = eng.Evaluate(strings.NewReader("G0\n" + s))
+	if err == nil {
+		t.Errorf("Evaluate(skip) did not fail")
+	}
+	want = [][]gcode.Code{
+		{{'G', gcode.Number(140)}},
+		{{'M', gcode.Number(100)}},
+	}
+	if !reflect.DeepEqual(unknown, want) {
+		t.Errorf("UnknownCodes(skip) got %v want %v", unknown, want)
+	}
+
+	unknown = nil
+	m := injectMachine{
+		machine: machine{
+			actions: []action{
+				{cmd: rapidTo, x: 1.0},
+			},
+		},
+	}
+	eng = gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+	eng.UnknownCodes = func(codes []gcode.Code) {
+		unknown = append(unknown, codes)
+	}
+	err = eng.Evaluate(strings.NewReader("G21\nG99.5 X1\n"))
+	if err != nil {
+		t.Errorf("Evaluate(inject) failed: %s", err)
+	} else if m.adx != len(m.actions) {
+		t.Errorf("Evaluate(inject): got %d actions want %d", m.adx, len(m.actions))
+	}
+	want = [][]gcode.Code{
+		{{'G', gcode.Number(99.5)}},
+	}
+	if !reflect.DeepEqual(unknown, want) {
+		t.Errorf("UnknownCodes(inject) got %v want %v", unknown, want)
+	}
+}
+
+func TestEndProgram(t *testing.T) {
+	eng := gcode.NewEngine(
+		&machine{
+			actions: []action{
+				{cmd: rapidTo, x: 25.4},
+				{cmd: setSpindle, speed: 100.0, clockwise: true},
+				{cmd: spindleOff},
+				{cmd: setFeed, f: 1.0},
+				{cmd: linearTo, x: 1.0, y: 1.0},
+			},
+		}, gcode.AllFeatures, os.Stdout, os.Stderr)
+	err := eng.Evaluate(strings.NewReader("G20\nG91\nG0 X1\nG18\nS100 M3\nM30\nG0 X2\n"))
+	if err != nil {
+		t.Errorf("Evaluate(M30) failed: %s", err)
+	}
+	err = eng.Evaluate(strings.NewReader("F1 X1 Y1\n"))
+	if err != nil {
+		t.Errorf("Evaluate(after M30) failed: %s", err)
+	}
+}
+
+func TestCommentParameters(t *testing.T) {
+	cases := []struct {
+		s   string
+		out string
+	}{
+		{s: "G10 L2 P1 X-1\n(debug,#5221 #5222 #5223)\n", out: "-1.0000 0.0000 0.0000\n"},
+		{s: "G10 L2 P2 Y2\n(debug,#5241 #5242 #5243)\n", out: "0.0000 2.0000 0.0000\n"},
+		{s: "G10 L2 P9 Z3\n(debug,#5381 #5382 #5383)\n", out: "0.0000 0.0000 3.0000\n"},
+		{s: "G20\nG10 L2 P1 X-1\n(debug,#5221)\n", out: "-1.0000\n"},
+		{s: "#5500=12\n#6000=34\n(debug,#5500 #6000)\n", out: "12.0000 34.0000\n"},
+		{s: "#5501=56\n(debug,#5501)\n", out: "56.0000\n"},
+	}
+
+	for i, c := range cases {
+		var outW bytes.Buffer
+		eng := gcode.NewEngine(&machine{}, gcode.AllFeatures, &outW, &outW)
+		err := eng.Evaluate(strings.NewReader(c.s))
+		if err != nil {
+			t.Errorf("Evaluate(%d) failed: %s", i, err)
+		}
+		out := outW.String()
+		if out != c.out {
+			t.Errorf("Evaluate(%d) outW: got %s want %s", i, out, c.out)
+		}
+	}
+}
+
+func TestPolar(t *testing.T) {
+	s := `
+G21
+G90
+G0 X1 Y1
+G1 F1 @2 ^0
+@2 ^90
+G91 @1 ^180 Z1
+G90
+^-90 @1
+G0 @1
+`
+
+	eng := gcode.NewEngine(
+		&machine{
+			actions: []action{
+				{cmd: rapidTo, x: 1.0, y: 1.0},
+				{cmd: setFeed, f: 1.0},
+				{cmd: linearTo, x: 3.0, y: 1.0},
+				{cmd: linearTo, x: 3.0, y: 3.0},
+				{cmd: linearTo, x: 2.0, y: 3.0, z: 1.0},
+				{cmd: linearTo, x: 2.0, y: 2.0, z: 1.0},
+				{cmd: rapidTo, x: 3.0, y: 2.0, z: 1.0},
+			},
+		}, gcode.AllFeatures|gcode.Polar, os.Stdout, os.Stderr)
+	err := eng.Evaluate(strings.NewReader(s))
+	if err != nil {
+		t.Errorf("Evaluate(polar) failed: %s", err)
+	}
+
+	for _, c := range []string{"G0 X1 @1 ^45\n", "G0 Y1 @1\n", "G2 @1 ^90 R1\n"} {
+		eng = gcode.NewEngine(&machine{}, gcode.AllFeatures|gcode.Polar, os.Stdout, os.Stderr)
+		err = eng.Evaluate(strings.NewReader(c))
+		if err == nil {
+			t.Errorf("Evaluate(%s) did not fail", c)
+		}
+	}
+
+	eng = gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+	err = eng.Evaluate(strings.NewReader("G0 @1 ^45\n"))
+	if err == nil {
+		t.Errorf("Evaluate(G0 @1 ^45) did not fail without Polar")
+	}
+}
+
+func TestLastWordWins(t *testing.T) {
+	s := "G0 X1 Y1 X2\nG1 F1 X3 F2\n"
+
+	eng := gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+	err := eng.Evaluate(strings.NewReader(s))
+	if err == nil {
+		t.Errorf("Evaluate(duplicate X) did not fail")
+	}
+
+	eng = gcode.NewEngine(
+		&machine{
+			actions: []action{
+				{cmd: rapidTo, x: 2.0, y: 1.0},
+				{cmd: setFeed, f: 2.0},
+				{cmd: linearTo, x: 3.0, y: 1.0},
+			},
+		}, gcode.AllFeatures, os.Stdout, os.Stderr)
+	eng.LastWordWins = true
+	err = eng.Evaluate(strings.NewReader(s))
+	if err != nil {
+		t.Errorf("Evaluate(duplicate X) failed: %s", err)
+	}
+}
+
+func TestCoordinateSystemOffset(t *testing.T) {
+	eng := gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+	err := eng.Evaluate(strings.NewReader("G10 L2 P2 X-1 Y-1\nG20\nG10 L2 P9 Z1\n"))
+	if err != nil {
+		t.Fatalf("Evaluate(G10 L2) failed: %s", err)
+	}
+
+	cases := []struct {
+		n    int
+		fail bool
+		pos  gcode.Position
+	}{
+		{n: 1},
+		{n: 2, pos: gcode.Position{X: -1.0, Y: -1.0}},
+		{n: 9, pos: gcode.Position{Z: 25.4}},
+		{n: 0, fail: true},
+		{n: 10, fail: true},
+	}
+
+	for _, c := range cases {
+		pos, err := eng.CoordinateSystemOffset(c.n)
+		if c.fail {
+			if err == nil {
+				t.Errorf("CoordinateSystemOffset(%d) did not fail", c.n)
+			}
+		} else if err != nil {
+			t.Errorf("CoordinateSystemOffset(%d) failed with %s", c.n, err)
+		} else if pos != c.pos {
+			t.Errorf("CoordinateSystemOffset(%d): got %v want %v", c.n, pos, c.pos)
+		}
+	}
+}
+
+func TestFeedOnly(t *testing.T) {
+	cases := []struct {
+		s       string
+		actions []action
+	}{
+		{s: "G21\nG1 F100\n", actions: []action{{cmd: setFeed, f: 100.0}}},
+		{s: "G21\nG1 X1\nF100\n",
+			actions: []action{{cmd: linearTo, x: 1.0}, {cmd: setFeed, f: 100.0}}},
+		{s: "G21\nG91\nG1 F100\nF200\n",
+			actions: []action{{cmd: setFeed, f: 100.0}, {cmd: setFeed, f: 200.0}}},
+		{s: "G20\nG1 F10\nF10 X1\n",
+			actions: []action{
+				{cmd: setFeed, f: 254.0},
+				{cmd: setFeed, f: 254.0},
+				{cmd: linearTo, x: 25.4},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		m := machine{actions: c.actions}
+		eng := gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+		err := eng.Evaluate(strings.NewReader(c.s))
+		if err != nil {
+			t.Errorf("Evaluate(%s) failed: %s", c.s, err)
+		} else if m.adx != len(c.actions) {
+			t.Errorf("Evaluate(%s): got %d actions want %d", c.s, m.adx, len(c.actions))
+		}
+	}
+}
+
+func TestRangeParams(t *testing.T) {
+	s := `
+#300=3
+#100=1
+#5161=2
+#200=2
+#<zzz>=4
+#<aaa>="abc"
+#<mmm>=5
+G10 L2 P1 X1
+`
+
+	eng := gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+	err := eng.Evaluate(strings.NewReader(s))
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	}
+
+	var nums []int
+	var vals []gcode.Number
+	eng.RangeNumberParams(func(num int, val gcode.Number) bool {
+		nums = append(nums, num)
+		vals = append(vals, val)
+		return true
+	})
+	if !reflect.DeepEqual(nums, []int{100, 200, 300}) {
+		t.Errorf("RangeNumberParams(): got %v want [100 200 300]", nums)
+	}
+	if !reflect.DeepEqual(vals, []gcode.Number{1, 2, 3}) {
+		t.Errorf("RangeNumberParams(): got %v want [1 2 3]", vals)
+	}
+
+	var names []gcode.Name
+	var nameVals []gcode.Value
+	eng.RangeNameParams(func(name gcode.Name, val gcode.Value) bool {
+		names = append(names, name)
+		nameVals = append(nameVals, val)
+		return true
+	})
+	if !reflect.DeepEqual(names, []gcode.Name{"aaa", "mmm", "zzz"}) {
+		t.Errorf("RangeNameParams(): got %v want [aaa mmm zzz]", names)
+	}
+	if !reflect.DeepEqual(nameVals,
+		[]gcode.Value{gcode.String("abc"), gcode.Number(5), gcode.Number(4)}) {
+
+		t.Errorf("RangeNameParams(): got %v want [abc 5 4]", nameVals)
+	}
+
+	nums = nil
+	eng.RangeNumberParams(func(num int, val gcode.Number) bool {
+		nums = append(nums, num)
+		return num < 200
+	})
+	if !reflect.DeepEqual(nums, []int{100, 200}) {
+		t.Errorf("RangeNumberParams(): got %v want [100 200]", nums)
+	}
+}
+
+func TestSetMachinePosition(t *testing.T) {
+	cases := []struct {
+		s       string
+		fail    bool
+		actions []action
+	}{
+		{s: "G21\nG90\nG0 X5 Y5 Z5\nG28.3 X0 Y0\nG0 X1 Y1\n",
+			actions: []action{
+				{cmd: rapidTo, x: 5.0, y: 5.0, z: 5.0},
+				{cmd: rapidTo, x: 1.0, y: 1.0, z: 5.0},
+			},
+		},
+		{s: "G21\nG90\nG0 X5 Y5\nG28.3 X0 Y0\nG0 X0 Y0\nG1 F1 Z1\n",
+			actions: []action{
+				{cmd: rapidTo, x: 5.0, y: 5.0},
+				{cmd: setFeed, f: 1.0},
+				{cmd: linearTo, z: 1.0},
+			},
+		},
+		{s: "G20\nG90\nG0 X1\nG28.3 X2\nG28.1\nG0 X0\nG28\n",
+			actions: []action{
+				{cmd: rapidTo, x: 25.4},
+				{cmd: rapidTo, x: 0.0},
+				{cmd: rapidTo, x: 50.8},
+			},
+		},
+		{s: "G21\nG91\nG0 X5\nG28.3 X1\nG0 X1\n",
+			actions: []action{
+				{cmd: rapidTo, x: 5.0},
+				{cmd: rapidTo, x: 2.0},
+			},
+		},
+		{s: "G28.3\n", fail: true},
+		{s: "G28.3 F1\n", fail: true},
+	}
+
+	for _, c := range cases {
+		m := machine{actions: c.actions}
+		eng := gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+		err := eng.Evaluate(strings.NewReader(c.s))
+		if c.fail {
+			if err == nil {
+				t.Errorf("Evaluate(%s) did not fail", c.s)
+			}
+		} else if err != nil {
+			t.Errorf("Evaluate(%s) failed: %s", c.s, err)
+		} else if m.adx != len(c.actions) {
+			t.Errorf("Evaluate(%s): got %d actions want %d", c.s, m.adx, len(c.actions))
+		}
+	}
+}
+
+func TestModifyPositionsL(t *testing.T) {
+	eng := gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+	err := eng.Evaluate(strings.NewReader("G10 L99 P1 X1\n"))
+	if err == nil {
+		t.Fatalf("Evaluate(G10 L99) did not fail")
+	}
+	if !strings.Contains(err.Error(), "L99") || !strings.Contains(err.Error(), "L1, L2, L20") {
+		t.Errorf("Evaluate(G10 L99): got %s want supported L values", err)
+	}
+}
+
+func TestCoordinateSystemP(t *testing.T) {
+	cases := []struct {
+		s   string
+		msg string
+	}{
+		{s: "G10 L2 P1.5 X0\n",
+			msg: "1: expected a whole number for the coordinate system: P1.5000"},
+		{s: "G0 X1\nG10 L2 P12 X0\n",
+			msg: "2: expected a coordinate system between 0 and 9: P12.0000"},
+		{s: "G10 L20 P-1 X0\n",
+			msg: "1: expected a coordinate system between 0 and 9: P-1.0000"},
+	}
+
+	for _, c := range cases {
+		eng := gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+		err := eng.Evaluate(strings.NewReader(c.s))
+		if err == nil {
+			t.Errorf("Evaluate(%s) did not fail", c.s)
+		} else if err.Error() != c.msg {
+			t.Errorf("Evaluate(%s): got %s want %s", c.s, err, c.msg)
+		}
+	}
+}
+
+func TestCurrentCoordSysParam(t *testing.T) {
+	var outW bytes.Buffer
+	eng := gcode.NewEngine(
+		&machine{
+			actions: []action{
+				{cmd: rapidTo, x: 3.0, y: 4.0},
+				{cmd: rapidTo, x: 1.0, y: 1.0},
+			},
+		}, gcode.AllFeatures, &outW, &outW)
+	err := eng.Evaluate(strings.NewReader(`
+G21
+G90
+G10 L2 P3 X-3 Y-4
+#5220=3
+(debug,#5220)
+G0 X0 Y0
+G54
+(debug,#5220)
+G0 X1 Y1
+G56
+(debug,#5220)
+`))
+	if err != nil {
+		t.Fatalf("Evaluate(#5220=3) failed: %s", err)
+	}
+	if outW.String() != "3.0000\n1.0000\n3.0000\n" {
+		t.Errorf("Evaluate(#5220=3) outW: got %s want 3, 1, 3", outW.String())
+	}
+
+	for _, s := range []string{"#5220=10\n", "#5220=0\n", "#5220=2.5\n"} {
+		eng = gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+		err = eng.Evaluate(strings.NewReader(s))
+		if err == nil {
+			t.Errorf("Evaluate(%s) did not fail", s)
+		} else if !strings.Contains(err.Error(), "#5220") ||
+			!strings.Contains(err.Error(), strings.TrimSpace(s[6:])) {
+
+			t.Errorf("Evaluate(%s): got %s want parameter and value", s, err)
+		}
+	}
+}
+
+func TestCodeFilter(t *testing.T) {
+	s := `
+G21
+S1000 M3
+G0 X1
+S2000
+M4
+G1 X2 F10
+`
+
+	eng := gcode.NewEngine(
+		&machine{
+			actions: []action{
+				{cmd: rapidTo, x: 1.0},
+				{cmd: setFeed, f: 5.0},
+				{cmd: linearTo, x: 2.0},
+			},
+		}, gcode.AllFeatures, os.Stdout, os.Stderr)
+	eng.CodeFilter = func(codes []gcode.Code) ([]gcode.Code, error) {
+		var filtered []gcode.Code
+		for _, code := range codes {
+			if code.Letter == 'S' ||
+				(code.Letter == 'M' && (code.Value == gcode.Number(3) ||
+					code.Value == gcode.Number(4))) {
+
+				continue
+			} else if code.Letter == 'F' {
+				code.Value = gcode.Number(5)
+			}
+			filtered = append(filtered, code)
+		}
+		return filtered, nil
+	}
+	err := eng.Evaluate(strings.NewReader(s))
+	if err != nil {
+		t.Errorf("Evaluate(CodeFilter) failed: %s", err)
+	}
+
+	eng = gcode.NewEngine(&machine{actions: []action{}}, gcode.AllFeatures, os.Stdout,
+		os.Stderr)
+	eng.CodeFilter = func(codes []gcode.Code) ([]gcode.Code, error) {
+		for _, code := range codes {
+			if code.Letter == 'G' {
+				return nil, fmt.Errorf("filtered: %s", code)
+			}
+		}
+		return codes, nil
+	}
+	err = eng.Evaluate(strings.NewReader(s))
+	if err == nil {
+		t.Errorf("Evaluate(CodeFilter) did not fail")
+	}
+}
+
+func TestEvaluateCollect(t *testing.T) {
+	s := `G21
+G0 X1
+G0 X2 Q1
+G1 X3 F0
+G1 F1 X4
+G10 L99 P1 X1
+G0 X5
+`
+
+	m := machine{
+		actions: []action{
+			{cmd: rapidTo, x: 1.0},
+			{cmd: setFeed, f: 1.0},
+			{cmd: linearTo, x: 4.0},
+			{cmd: rapidTo, x: 5.0},
+		},
+	}
+	eng := gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+	errs := eng.EvaluateCollect(strings.NewReader(s))
+	if len(errs) != 3 {
+		t.Errorf("EvaluateCollect() got %d errors want 3: %v", len(errs), errs)
+	} else {
+		for i, line := range []string{"3: ", "4: ", "6: "} {
+			if !strings.HasPrefix(errs[i].Error(), line) {
+				t.Errorf("EvaluateCollect() error %d: got %s want line %s", i, errs[i], line)
+			}
+		}
+	}
+	if m.adx != len(m.actions) {
+		t.Errorf("EvaluateCollect(): got %d actions want %d", m.adx, len(m.actions))
+	}
+
+	m = machine{
+		actions: []action{
+			{cmd: rapidTo, x: 1.0},
+		},
+	}
+	eng = gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+	errs = eng.EvaluateCollect(strings.NewReader("G0 X1\nG0 X[1\nG0 X2\n"))
+	if len(errs) != 1 {
+		t.Errorf("EvaluateCollect() got %d errors want 1: %v", len(errs), errs)
+	}
+	if m.adx != len(m.actions) {
+		t.Errorf("EvaluateCollect(): got %d actions want %d", m.adx, len(m.actions))
+	}
+
+	// After a break, EvaluateCollect starts a new program.
+	eng = gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+	eng.BreakBeforeMCodes = []float64{6}
+	err := eng.Evaluate(strings.NewReader("G21\nG21\nG21\nM6\n"))
+	if _, ok := err.(gcode.BreakError); !ok {
+		t.Fatalf("Evaluate() got %v want a BreakError", err)
+	}
+	errs = eng.EvaluateCollect(strings.NewReader("G21\nG10 L99 P1 X1\nM2\n"))
+	if len(errs) != 1 {
+		t.Errorf("EvaluateCollect() got %d errors want 1: %v", len(errs), errs)
+	} else if !strings.HasPrefix(errs[0].Error(), "2: ") {
+		t.Errorf("EvaluateCollect() got %s want line 2: ", errs[0])
+	}
+	if !eng.ProgramEnded() {
+		t.Errorf("ProgramEnded() got false want true")
+	}
+	err = eng.Continue()
+	if err == nil || err.Error() != "expected evaluation to have stopped at a break" {
+		t.Errorf("Continue() got %v want not stopped at a break", err)
+	}
+}
+
+type orientMachine struct {
+	machine
+	orients []float64
+}
+
+func (m *orientMachine) OrientSpindle(degrees float64) error {
+	m.orients = append(m.orients, degrees)
+	return nil
+}
+
+func TestOrientSpindle(t *testing.T) {
+	m := orientMachine{machine: machine{actions: []action{{cmd: rapidTo, x: 1.0}}}}
+	eng := gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+	err := eng.Evaluate(strings.NewReader("M19 R90\nM19\nM19 R-45.5 G0 X1\n"))
+	if err != nil {
+		t.Errorf("Evaluate(M19) failed: %s", err)
+	} else if !reflect.DeepEqual(m.orients, []float64{90.0, 0.0, -45.5}) {
+		t.Errorf("Evaluate(M19): got %v want [90 0 -45.5]", m.orients)
+	}
+
+	err = eng.Evaluate(strings.NewReader("M19 X1\n"))
+	if err == nil {
+		t.Errorf("Evaluate(M19 X1) did not fail")
+	}
+
+	var unknown []gcode.Code
+	eng = gcode.NewEngine(&dropMachine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+	eng.UnknownCodes = func(codes []gcode.Code) {
+		unknown = append(unknown, codes...)
+	}
+	err = eng.Evaluate(strings.NewReader("M19 R90\n"))
+	if err != nil {
+		t.Errorf("Evaluate(M19) failed: %s", err)
+	} else if !reflect.DeepEqual(unknown,
+		[]gcode.Code{{'M', gcode.Number(19)}, {'R', gcode.Number(90)}}) {
+
+		t.Errorf("Evaluate(M19): got %v want [M19 R90]", unknown)
+	}
+}
+
+func TestNonFinitePosition(t *testing.T) {
+	cases := []struct {
+		s       string
+		actions []action
+		msg     string
+	}{
+		{s: "G21\nG0 X1 Y1\nG2 X2 Y1 I[0/0]\n",
+			actions: []action{{cmd: rapidTo, x: 1.0, y: 1.0}}},
+		{s: "G21\nG0 X1 Y1\nG3 X1 Y1 J[-1/0]\n",
+			actions: []action{{cmd: rapidTo, x: 1.0, y: 1.0}}},
+		{s: "G21\nG0 X1\nG0 X[1/0]\n", actions: []action{{cmd: rapidTo, x: 1.0}}},
+		{s: "G21\nG1 F1\nG1 Y[SQRT[-1]]\n", actions: []action{{cmd: setFeed, f: 1.0}}},
+		{s: "G21\nG0 X1 Y1\nG2 X2 Y1 R[1/0]\n", actions: []action{{cmd: rapidTo, x: 1.0, y: 1.0}},
+			msg: "3: expected a finite radius"},
+	}
+
+	for _, c := range cases {
+		m := machine{actions: c.actions}
+		eng := gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+		err := eng.Evaluate(strings.NewReader(c.s))
+		if err == nil {
+			t.Errorf("Evaluate(%s) did not fail", c.s)
+		} else if c.msg != "" && !strings.HasPrefix(err.Error(), c.msg) {
+			t.Errorf("Evaluate(%s) failed with %s", c.s, err)
+		} else if c.msg == "" && !strings.HasPrefix(err.Error(), "3: expected a finite position") {
+			t.Errorf("Evaluate(%s) failed with %s", c.s, err)
+		}
+		if m.adx != len(c.actions) {
+			t.Errorf("Evaluate(%s): got %d actions want %d", c.s, m.adx, len(c.actions))
+		}
+	}
+}
+
+func TestTolerance(t *testing.T) {
+	eng := gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+	tol := eng.Tolerance()
+	if tol != 0.0001 {
+		t.Errorf("Tolerance(): got %v want 0.0001", tol)
+	}
+	if !gcode.Number(1.0).Equal(gcode.Number(1.0 + tol/2)) {
+		t.Errorf("Equal(1, 1 + %v) got false want true", tol/2)
+	}
+	if gcode.Number(1.0).Equal(gcode.Number(1.0 + tol*2)) {
+		t.Errorf("Equal(1, 1 + %v) got true want false", tol*2)
+	}
+}
+
+func TestProgramEnded(t *testing.T) {
+	cases := []struct {
+		s     string
+		ended bool
+	}{
+		{s: "G21\nG0 X1\nM30\n", ended: true},
+		{s: "G21\nG0 X1\nM2\nG0 X2\n", ended: true},
+		{s: "G21\nG0 X1\n"},
+		{s: "G21\nG0 X1\nG53\n"},
+	}
+
+	for _, c := range cases {
+		eng := gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+		err := eng.Evaluate(strings.NewReader(c.s))
+		if err != nil {
+			t.Errorf("Evaluate(%s) failed: %s", c.s, err)
+		} else if eng.ProgramEnded() != c.ended {
+			t.Errorf("Evaluate(%s) ProgramEnded(): got %v want %v", c.s, eng.ProgramEnded(),
+				c.ended)
+		}
+
+		eng = gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+		eng.RequireProgramEnd = true
+		err = eng.Evaluate(strings.NewReader(c.s))
+		if c.ended && err != nil {
+			t.Errorf("Evaluate(%s) failed: %s", c.s, err)
+		} else if !c.ended && err == nil {
+			t.Errorf("Evaluate(%s) did not fail", c.s)
+		}
+	}
+
+	eng := gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+	err := eng.Evaluate(strings.NewReader("G0 X1\nM30\n"))
+	if err != nil || !eng.ProgramEnded() {
+		t.Errorf("Evaluate(M30) got %v, %v want nil, true", err, eng.ProgramEnded())
+	}
+	err = eng.Evaluate(strings.NewReader("G0 X2\n"))
+	if err != nil || eng.ProgramEnded() {
+		t.Errorf("Evaluate(G0 X2) got %v, %v want nil, false", err, eng.ProgramEnded())
+	}
+}
+
+type pathMode struct {
+	exactStop         bool
+	tolerance         float64
+	naiveCAMTolerance float64
+}
+
+type pathModeMachine struct {
+	machine
+	modes []pathMode
+}
+
+func (m *pathModeMachine) SetPathMode(exactStop bool, tolerance, naiveCAMTolerance float64) error {
+	m.modes = append(m.modes, pathMode{exactStop, tolerance, naiveCAMTolerance})
+	return nil
+}
+
+func TestPathMode(t *testing.T) {
+	cases := []struct {
+		s     string
+		fail  bool
+		modes []pathMode
+	}{
+		{s: "G21\nG64 P0.01 Q0.02\nG61\n",
+			modes: []pathMode{{false, 0.01, 0.02}, {true, 0.0, 0.0}}},
+		{s: "G20\nG64 P0.01\nG64\n",
+			modes: []pathMode{{false, 0.254, 0.0}, {false, 0.0, 0.0}}},
+		{s: "G61 G0 X1\n", modes: []pathMode{{true, 0.0, 0.0}}},
+		{s: "G61.1\nG64\n", modes: []pathMode{{true, 0.0, 0.0}, {false, 0.0, 0.0}}},
+		{s: "G61.1 P1\n", fail: true},
+		{s: "G64 Q0.02\n", fail: true},
+		{s: "G64 P-1\n", fail: true},
+		{s: "G61 P1\n", fail: true},
+	}
+
+	for _, c := range cases {
+		m := pathModeMachine{}
+		eng := gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+		err := eng.Evaluate(strings.NewReader(c.s))
+		if c.fail {
+			if err == nil {
+				t.Errorf("Evaluate(%s) did not fail", c.s)
+			}
+		} else if err != nil {
+			t.Errorf("Evaluate(%s) failed: %s", c.s, err)
+		} else if len(m.modes) != len(c.modes) {
+			t.Errorf("Evaluate(%s): got %v want %v", c.s, m.modes, c.modes)
+		} else {
+			for i := range c.modes {
+				if m.modes[i].exactStop != c.modes[i].exactStop ||
+					!gcode.Number(m.modes[i].tolerance).Equal(
+						gcode.Number(c.modes[i].tolerance)) ||
+					!gcode.Number(m.modes[i].naiveCAMTolerance).Equal(
+						gcode.Number(c.modes[i].naiveCAMTolerance)) {
+
+					t.Errorf("Evaluate(%s): got %v want %v", c.s, m.modes, c.modes)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestPathControl(t *testing.T) {
+	cases := []struct {
+		s                 string
+		mode              gcode.PathMode
+		tolerance         float64
+		naiveCAMTolerance float64
+	}{
+		{s: "G0 X1\n", mode: gcode.ContinuousPathMode},
+		{s: "G21\nG64 P0.01 Q0.02\n", mode: gcode.ContinuousPathMode, tolerance: 0.01,
+			naiveCAMTolerance: 0.02},
+		{s: "G20\nG64 P0.01\n", mode: gcode.ContinuousPathMode, tolerance: 0.254},
+		{s: "G64 P0.01 Q0.02\nG61\n", mode: gcode.ExactPathMode},
+		{s: "G61.1\n", mode: gcode.ExactStopMode},
+	}
+
+	for _, c := range cases {
+		eng := gcode.NewEngine(&pathModeMachine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+		err := eng.Evaluate(strings.NewReader(c.s))
+		if err != nil {
+			t.Errorf("Evaluate(%s) failed: %s", c.s, err)
+			continue
+		}
+		mode, tolerance, naiveCAMTolerance := eng.PathControl()
+		if mode != c.mode || !gcode.Number(tolerance).Equal(gcode.Number(c.tolerance)) ||
+			!gcode.Number(naiveCAMTolerance).Equal(gcode.Number(c.naiveCAMTolerance)) {
+
+			t.Errorf("PathControl(%s): got %d, %v, %v want %d, %v, %v", c.s, mode, tolerance,
+				naiveCAMTolerance, c.mode, c.tolerance, c.naiveCAMTolerance)
+		}
+	}
+}
+
+func TestZFirstHoming(t *testing.T) {
+	cases := []struct {
+		s       string
+		zFirst  bool
+		actions []action
+	}{
+		{s: "G21\nG0 X5 Y5 Z-2\n#5161=1\n#5163=10\nG28 X0 Z0\n",
+			actions: []action{
+				{cmd: rapidTo, x: 5.0, y: 5.0, z: -2.0},
+				{cmd: rapidTo, x: 0.0, y: 5.0, z: 0.0},
+				{cmd: rapidTo, x: 1.0, y: 5.0, z: 10.0},
+			},
+		},
+		{s: "G21\nG0 X5 Y5 Z-2\n#5161=1\n#5163=10\nG28 X0 Z0\n", zFirst: true,
+			actions: []action{
+				{cmd: rapidTo, x: 5.0, y: 5.0, z: -2.0},
+				{cmd: rapidTo, x: 5.0, y: 5.0, z: 0.0},
+				{cmd: rapidTo, x: 5.0, y: 5.0, z: 10.0},
+				{cmd: rapidTo, x: 0.0, y: 5.0, z: 10.0},
+				{cmd: rapidTo, x: 1.0, y: 5.0, z: 10.0},
+			},
+		},
+		{s: "G21\nG0 X5 Y5 Z-2\n#5161=1\n#5163=10\nG28\n", zFirst: true,
+			actions: []action{
+				{cmd: rapidTo, x: 5.0, y: 5.0, z: -2.0},
+				{cmd: rapidTo, x: 5.0, y: 5.0, z: 10.0},
+				{cmd: rapidTo, x: 1.0, y: 0.0, z: 10.0},
+			},
+		},
+		{s: "G21\nG0 X5 Y5 Z-2\n#5181=1\nG30 X0\n", zFirst: true,
+			actions: []action{
+				{cmd: rapidTo, x: 5.0, y: 5.0, z: -2.0},
+				{cmd: rapidTo, x: 0.0, y: 5.0, z: -2.0},
+				{cmd: rapidTo, x: 1.0, y: 5.0, z: -2.0},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		m := machine{actions: c.actions}
+		eng := gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+		eng.ZFirstHoming = c.zFirst
+		err := eng.Evaluate(strings.NewReader(c.s))
+		if err != nil {
+			t.Errorf("Evaluate(%s) failed: %s", c.s, err)
+		} else if m.adx != len(c.actions) {
+			t.Errorf("Evaluate(%s): got %d actions want %d", c.s, m.adx, len(c.actions))
+		}
+	}
+}
+
+func TestTraceWriter(t *testing.T) {
+	s := `G21
+T2
+S1000 M3
+G0 X1 Y2
+G1 Z-1 F100
+M5
+`
+
+	var trace strings.Builder
+	m := machine{}
+	eng := gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+	eng.TraceWriter = &trace
+	err := eng.Evaluate(strings.NewReader(s))
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	}
+
+	want := `2: selectTool 2
+3: setSpindle 1000.0000 true
+4: rapidTo {x: 1.0000, y: 2.0000, z: 0.0000}
+5: setFeed 100.0000
+5: linearTo {x: 1.0000, y: 2.0000, z: -1.0000} feed 100.0000
+6: spindleOff
+`
+	if trace.String() != want {
+		t.Errorf("TraceWriter: got\n%s\nwant\n%s", trace.String(), want)
+	}
+}
+
+func TestEvaluateState(t *testing.T) {
+	s := `G20
+G10 L2 P2 X1 Y2 Z0
+G55
+G18
+T4
+S500 M4
+G1 X1 Y1 Z-0.5 F10
+`
+
+	m := machine{}
+	eng := gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+	st, err := eng.EvaluateState(strings.NewReader(s))
+	if err != nil {
+		t.Fatalf("EvaluateState() failed: %s", err)
+	}
+
+	want := gcode.State{
+		Position:               gcode.Position{X: 0.0, Y: -25.4, Z: -12.7},
+		Inches:                 true,
+		Absolute:               true,
+		Plane:                  gcode.ZXPlane,
+		CoordinateSystem:       2,
+		CoordinateSystemOffset: gcode.Position{X: 25.4, Y: 50.8, Z: 0.0},
+		SpindleOn:              true,
+		SpindleSpeed:           500.0,
+		SpindleClockwise:       false,
+		Tool:                   4,
+		Feed:                   254.0,
+	}
+	if !gcode.Number(st.Position.X).Equal(gcode.Number(want.Position.X)) ||
+		!gcode.Number(st.Position.Y).Equal(gcode.Number(want.Position.Y)) ||
+		!gcode.Number(st.Position.Z).Equal(gcode.Number(want.Position.Z)) {
+		t.Errorf("EvaluateState() position: got %s want %s", st.Position, want.Position)
+	}
+	st.Position = want.Position
+	if st != want {
+		t.Errorf("EvaluateState(): got %+v want %+v", st, want)
+	}
+
+	_, err = eng.EvaluateState(strings.NewReader("G1 X1 F0\n"))
+	if err == nil {
+		t.Errorf("EvaluateState() did not fail")
+	}
+}
+
+func TestEvalProgram(t *testing.T) {
+	s := `
+#1=2
+#2=[#1 * 3]
+#3=[#1 + #2]
+#<abc>=[#3 / 2]
+G0 X#1 Y#2
+G1 Z[-#3] F100
+M2
+`
+
+	numParams, nameParams, err := gcode.EvalProgram(strings.NewReader(s), gcode.AllFeatures)
+	if err != nil {
+		t.Fatalf("EvalProgram() failed: %s", err)
+	}
+	if !reflect.DeepEqual(numParams, map[int]gcode.Number{1: 2, 2: 6, 3: 8}) {
+		t.Errorf("EvalProgram(): got %v want map[1:2 2:6 3:8]", numParams)
+	}
+	if !reflect.DeepEqual(nameParams, map[gcode.Name]gcode.Value{"abc": gcode.Number(4)}) {
+		t.Errorf("EvalProgram(): got %v want map[abc:4]", nameParams)
+	}
+
+	_, _, err = gcode.EvalProgram(strings.NewReader("#1=[#2 + 1]\n"), gcode.AllFeatures)
+	if err == nil {
+		t.Errorf("EvalProgram() did not fail")
+	}
+}
+
+type dwellMachine struct {
+	machine
+	dwells []float64
+}
+
+func (m *dwellMachine) Dwell(seconds float64) error {
+	m.dwells = append(m.dwells, seconds)
+	return nil
+}
+
+func TestDwell(t *testing.T) {
+	cases := []struct {
+		s      string
+		f      gcode.Features
+		dwells []float64
+		fail   string
+	}{
+		{s: "G4 P1.5\nG4 P0\n", f: gcode.AllFeatures, dwells: []float64{1.5, 0.0}},
+		{s: "G4 P2\n", f: gcode.LinuxCNC, dwells: []float64{2.0}},
+		{s: "G4 P250\n", f: gcode.RepRap, dwells: []float64{0.25}},
+		{s: "G4 P500\n", f: gcode.RepRap, dwells: []float64{0.5}},
+		{s: "G4 S1\nG4 S0.5\n", f: gcode.RepRap, dwells: []float64{1.0, 0.5}},
+		{s: "G4 P500 S1\n", f: gcode.RepRap, fail: "1: G4 requires either P or S, not both"},
+		{s: "G4 S-1\n", f: gcode.RepRap, fail: "1: expected a non-negative dwell: S-1"},
+		{s: "G4\n", f: gcode.RepRap, fail: "1: G4 requires a P or S argument"},
+		{s: "G4\n", f: gcode.AllFeatures, fail: "1: G4 requires a P argument"},
+		{s: "G4 P-1\n", f: gcode.AllFeatures, fail: "1: expected a non-negative dwell: P-1"},
+		{s: "G4 P1 X1\n", f: gcode.AllFeatures, fail: "1: arg not allowed: X"},
+	}
+
+	for _, c := range cases {
+		m := dwellMachine{machine: machine{actions: []action{{cmd: rapidTo, x: 1.0, y: 2.0}}}}
+		eng := gcode.NewEngine(&m, c.f, os.Stdout, os.Stderr)
+		err := eng.Evaluate(strings.NewReader("G21\nG0 X1 Y2\n"))
+		if err != nil {
+			t.Fatalf("Evaluate() failed: %s", err)
+		}
+		err = eng.Evaluate(strings.NewReader(c.s))
+		if c.fail != "" {
+			if err == nil {
+				t.Errorf("Evaluate(%s) did not fail", c.s)
+			} else if !strings.HasPrefix(err.Error(), c.fail) {
+				t.Errorf("Evaluate(%s): got %s want %s", c.s, err, c.fail)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Evaluate(%s) failed: %s", c.s, err)
+		} else if !reflect.DeepEqual(m.dwells, c.dwells) {
+			t.Errorf("Evaluate(%s): got %v want %v", c.s, m.dwells, c.dwells)
+		}
+		if st := eng.State(); st.Position != (gcode.Position{X: 1.0, Y: 2.0}) {
+			t.Errorf("Evaluate(%s): position changed to %s", c.s, st.Position)
+		}
+	}
+
+	var unknown []gcode.Code
+	eng := gcode.NewEngine(&dropMachine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+	eng.UnknownCodes = func(codes []gcode.Code) {
+		unknown = append(unknown, codes...)
+	}
+	err := eng.Evaluate(strings.NewReader("G4 P1\n"))
+	if err != nil {
+		t.Errorf("Evaluate(G4) failed: %s", err)
+	} else if !reflect.DeepEqual(unknown,
+		[]gcode.Code{{'G', gcode.Number(4)}, {'P', gcode.Number(1)}}) {
+
+		t.Errorf("Evaluate(G4): got %v want [G4 P1]", unknown)
+	}
+}
+
+func TestMoveDuration(t *testing.T) {
+	cases := []struct {
+		from, to gcode.Position
+		feed     float64
+		mode     gcode.FeedMode
+		secs     float64
+	}{
+		{to: gcode.Position{X: 100.0}, feed: 1000.0, mode: gcode.UnitsPerMinuteFeed, secs: 6.0},
+		{from: gcode.Position{X: 1.0, Y: 1.0, Z: 1.0}, to: gcode.Position{X: 4.0, Y: 5.0, Z: 1.0},
+			feed: 30.0, mode: gcode.UnitsPerMinuteFeed, secs: 10.0},
+		{to: gcode.Position{Z: -10.0}, feed: 100.0, mode: gcode.UnitsPerMinuteFeed, secs: 6.0},
+		{feed: 1000.0, mode: gcode.UnitsPerMinuteFeed, secs: 0.0},
+		{to: gcode.Position{X: 100.0}, feed: 2.0, mode: gcode.InverseTimeFeed, secs: 30.0},
+		{to: gcode.Position{X: 1.0}, feed: 0.5, mode: gcode.InverseTimeFeed, secs: 120.0},
+	}
+
+	for _, c := range cases {
+		secs := gcode.MoveDuration(c.from, c.to, c.feed, c.mode)
+		if math.Abs(secs-c.secs) > 0.0001 {
+			t.Errorf("MoveDuration(%s, %s, %f, %d): got %f want %f", c.from, c.to, c.feed, c.mode,
+				secs, c.secs)
+		}
+	}
+
+	if secs := gcode.MoveDuration(gcode.Position{}, gcode.Position{X: 1.0}, 0.0,
+		gcode.UnitsPerMinuteFeed); !math.IsInf(secs, 1) {
+
+		t.Errorf("MoveDuration(F0): got %f want +Inf", secs)
+	}
+	if secs := gcode.MoveDuration(gcode.Position{}, gcode.Position{X: 1.0}, 0.1,
+		gcode.UnitsPerRevolutionFeed); !math.IsNaN(secs) {
+
+		t.Errorf("MoveDuration(units per revolution): got %f want NaN", secs)
+	}
+}
+
+func TestToolLengthOffset(t *testing.T) {
+	var outW bytes.Buffer
+	m := machine{
+		actions: []action{
+			{cmd: rapidTo, z: 5.0},
+			{cmd: rapidTo, z: 10.0},
+			{cmd: rapidTo, z: -5.0},
+			{cmd: rapidTo, z: 0.0},
+			{cmd: rapidTo, z: 25.4},
+			{cmd: rapidTo, z: -25.4},
+			{cmd: selectTool, tool: 2},
+			{cmd: rapidTo, z: -5.0},
+			{cmd: rapidTo, z: -1.0},
+		},
+	}
+	eng := gcode.NewEngine(&m, gcode.AllFeatures, &outW, &outW)
+	err := eng.Evaluate(strings.NewReader(`
+G21
+G10 L1 P2 Z5
+G43 H2
+G0 Z10
+G53 G0 Z10
+G0 Z0
+(debug,#5422)
+G49
+G0 Z0
+G20
+G10 L1 P3 Z1
+G43 H3
+G0 Z2
+G21
+G0 Z0
+T2
+G43
+G0 Z0
+(debug,#5422)
+`))
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	}
+	if outW.String() != "0.0000\n0.0000\n" {
+		t.Errorf("Evaluate() outW: got %s want 0, 0", outW.String())
+	}
+	if st := eng.State(); st.ToolLengthOffset != 5.0 {
+		t.Errorf("State().ToolLengthOffset: got %f want 5", st.ToolLengthOffset)
+	}
+
+	eng.SetToolLengthOffset(4, 1.0)
+	err = eng.Evaluate(strings.NewReader("G43 H4\nG0 Z0\n"))
+	if err != nil {
+		t.Fatalf("Evaluate(G43 H4) failed: %s", err)
+	} else if m.adx != len(m.actions) {
+		t.Errorf("Evaluate(): got %d actions want %d", m.adx, len(m.actions))
+	}
+
+	for _, s := range []string{
+		"G43 H-1\n",
+		"G43 H1.5\n",
+		"G43 X1\n",
+		"G10 L1 P1 X1 Z1\n",
+		"G10 L1 P1\n",
+		"G10 L1 P-1 Z1\n",
+		"G0 X1 H1\n",
+	} {
+		eng := gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+		err := eng.Evaluate(strings.NewReader(s))
+		if err == nil {
+			t.Errorf("Evaluate(%s) did not fail", s)
+		}
+	}
+}
+
+func TestToolOffsetParams(t *testing.T) {
+	var outW bytes.Buffer
+	eng := gcode.NewEngine(&machine{}, gcode.AllFeatures, &outW, &outW)
+	err := eng.Evaluate(strings.NewReader(`
+G21
+G10 L1 P3 Z12.5
+(debug,#5400 #5403)
+T3 G43 H3
+(debug,#5400 #5401 #5402 #5403)
+G20
+(debug,#5403)
+G49
+(debug,#5403)
+`))
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	}
+	want := "0.0000 0.0000\n3.0000 0.0000 0.0000 12.5000\n0.4921\n0.0000\n"
+	if outW.String() != want {
+		t.Errorf("Evaluate() outW: got %q want %q", outW.String(), want)
+	}
+
+	for _, s := range []string{"#5400=1\n", "#5401=1\n", "#5402=1\n", "#5403=1\n"} {
+		eng := gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+		err := eng.Evaluate(strings.NewReader(s))
+		if err == nil {
+			t.Errorf("Evaluate(%s) did not fail", s)
+		}
+	}
+}
+
+func TestHomePosition(t *testing.T) {
+	var outW bytes.Buffer
+	eng := gcode.NewEngine(&machine{}, gcode.AllFeatures, &outW, &outW)
+	err := eng.Evaluate(strings.NewReader(`
+G21
+G0 X1 Y2 Z3
+G28.1
+G0 X4 Y5 Z6
+G30.1
+(debug,#5161 #5162 #5163 #5181 #5182 #5183)
+G20
+(debug,#5161)
+`))
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	}
+	if pos := eng.HomePosition(); pos != (gcode.Position{X: 1.0, Y: 2.0, Z: 3.0}) {
+		t.Errorf("HomePosition(): got %s want {1, 2, 3}", pos)
+	}
+	if pos := eng.SecondPosition(); pos != (gcode.Position{X: 4.0, Y: 5.0, Z: 6.0}) {
+		t.Errorf("SecondPosition(): got %s want {4, 5, 6}", pos)
+	}
+	want := "1.0000 2.0000 3.0000 4.0000 5.0000 6.0000\n0.0394\n"
+	if outW.String() != want {
+		t.Errorf("Evaluate() outW: got %q want %q", outW.String(), want)
+	}
+
+	err = eng.Evaluate(strings.NewReader("G21\n#5161=7\n#5183=8\n"))
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	}
+	if pos := eng.HomePosition(); pos != (gcode.Position{X: 7.0, Y: 2.0, Z: 3.0}) {
+		t.Errorf("HomePosition(): got %s want {7, 2, 3}", pos)
+	}
+	if pos := eng.SecondPosition(); pos != (gcode.Position{X: 4.0, Y: 5.0, Z: 8.0}) {
+		t.Errorf("SecondPosition(): got %s want {4, 5, 8}", pos)
+	}
+}
+
+func TestDeferredCurrentCoordSysParam(t *testing.T) {
+	var outW bytes.Buffer
+	m := machine{
+		actions: []action{
+			{cmd: rapidTo, x: 3.0},
+		},
+	}
+	eng := gcode.NewEngine(&m, gcode.LinuxCNC, &outW, &outW)
+	err := eng.Evaluate(strings.NewReader(`
+G21
+G10 L2 P3 X-3
+#5220=3 (debug,#5220)
+(debug,#5220)
+G0 X0
+`))
+	if err != nil {
+		t.Fatalf("Evaluate(#5220=3) failed: %s", err)
+	}
+	if outW.String() != "1.0000\n3.0000\n" {
+		t.Errorf("Evaluate(#5220=3) outW: got %q want 1, 3", outW.String())
+	}
+	if st := eng.State(); st.CoordinateSystem != 3 {
+		t.Errorf("State().CoordinateSystem: got %d want 3", st.CoordinateSystem)
+	} else if m.adx != len(m.actions) {
+		t.Errorf("Evaluate(#5220=3): got %d actions want %d", m.adx, len(m.actions))
+	}
+
+	err = eng.Evaluate(strings.NewReader("#5220=3.5\n"))
+	if err == nil {
+		t.Errorf("Evaluate(#5220=3.5) did not fail")
+	} else if !strings.Contains(err.Error(), "#5220") {
+		t.Errorf("Evaluate(#5220=3.5): got %s want parameter", err)
+	}
+	if st := eng.State(); st.CoordinateSystem != 3 {
+		t.Errorf("State().CoordinateSystem: got %d want 3", st.CoordinateSystem)
+	}
+}
+
+type toolChangeMachine struct {
+	machine
+}
+
+func (m *toolChangeMachine) ChangeTool(tool uint) error {
+	return m.checkAction(action{cmd: changeTool, tool: tool})
+}
+
+func TestChangeTool(t *testing.T) {
+	m := toolChangeMachine{
+		machine: machine{
+			actions: []action{
+				{cmd: selectTool, tool: 2},
+				{cmd: changeTool, tool: 2},
+				{cmd: selectTool, tool: 3},
+				{cmd: rapidTo, x: 1.0},
+				{cmd: changeTool, tool: 3},
+				{cmd: changeTool, tool: 3},
+			},
+		},
+	}
+	eng := gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+	err := eng.Evaluate(strings.NewReader(`
+T2 M6
+T3
+G0 X1
+M6
+M6
+`))
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	} else if m.adx != len(m.actions) {
+		t.Errorf("Evaluate(): got %d actions want %d", m.adx, len(m.actions))
+	}
+	if tool := eng.LoadedTool(); tool != 3 {
+		t.Errorf("LoadedTool(): got %d want 3", tool)
+	}
+
+	eng = gcode.NewEngine(&toolChangeMachine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+	err = eng.Evaluate(strings.NewReader("M6\n"))
+	if err == nil {
+		t.Errorf("Evaluate(M6) did not fail")
+	}
+
+	m = toolChangeMachine{machine: machine{actions: []action{{cmd: changeTool, tool: 4}}}}
+	eng = gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+	eng.InitialTool = 4
+	err = eng.Evaluate(strings.NewReader("M6\n"))
+	if err != nil {
+		t.Errorf("Evaluate(M6) failed: %s", err)
+	} else if m.adx != len(m.actions) {
+		t.Errorf("Evaluate(M6): got %d actions want %d", m.adx, len(m.actions))
+	}
+
+	err = gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr).Evaluate(
+		strings.NewReader("T1 M6\n"))
+	if err == nil {
+		t.Errorf("Evaluate(M6) did not fail without a ToolChanger")
+	}
+}
+
+type coolant struct {
+	mist, flood bool
+}
+
+type coolantMachine struct {
+	machine
+	coolant []coolant
+}
+
+func (m *coolantMachine) SetCoolant(mist, flood bool) error {
+	m.coolant = append(m.coolant, coolant{mist, flood})
+	return nil
+}
+
+func TestCoolant(t *testing.T) {
+	cases := []struct {
+		s       string
+		coolant []coolant
+		x       float64
+	}{
+		{s: "M8\nG0 X1\nM9\nG0 X2\nM2\n", coolant: []coolant{{false, true}, {false, false}},
+			x: 2.0},
+		{s: "M7 M8 G0 X1\nM2\n", coolant: []coolant{{true, false}, {true, true}, {false, false}},
+			x: 1.0},
+		{s: "M7\nM9 G0 X1\n", coolant: []coolant{{true, false}, {false, false}}, x: 1.0},
+		{s: "M8\nM30\n", coolant: []coolant{{false, true}, {false, false}}},
+	}
+
+	for _, c := range cases {
+		m := coolantMachine{}
+		eng := gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+		err := eng.Evaluate(strings.NewReader(c.s))
+		if err != nil {
+			t.Errorf("Evaluate(%s) failed: %s", c.s, err)
+		} else if !reflect.DeepEqual(m.coolant, c.coolant) {
+			t.Errorf("Evaluate(%s): got %v want %v", c.s, m.coolant, c.coolant)
+		} else if st := eng.State(); st.Position.X != c.x {
+			t.Errorf("Evaluate(%s): got position %s want X%s", c.s, st.Position, gcode.Number(c.x))
+		}
+	}
+
+	m := coolantMachine{}
+	eng := gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+	err := eng.Evaluate(strings.NewReader("M7 M8\n"))
+	if err != nil {
+		t.Fatalf("Evaluate(M7 M8) failed: %s", err)
+	}
+	if st := eng.State(); !st.Mist || !st.Flood {
+		t.Errorf("State(): got mist %v flood %v want true, true", st.Mist, st.Flood)
+	}
+}
+
+func TestDefaultsComment(t *testing.T) {
+	m := machine{
+		actions: []action{
+			{cmd: setFeed, f: 1000.0},
+			{cmd: linearTo, x: 10.0},
+			{cmd: setSpindle, speed: 8000.0, clockwise: true},
+			{cmd: setFeed, f: 500.0},
+			{cmd: linearTo, x: 20.0},
+		},
+	}
+	eng := gcode.NewEngine(&m, 0, os.Stdout, os.Stderr)
+	eng.DefaultsComment = true
+	err := eng.Evaluate(strings.NewReader(`
+(DEFAULTS, F1000 S8000)
+G21
+G1 X10
+M3
+G1 X20 F500
+`))
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	} else if m.adx != len(m.actions) {
+		t.Errorf("Evaluate(): got %d actions want %d", m.adx, len(m.actions))
+	}
+
+	for _, s := range []string{"(defaults,X1)\n", "(defaults,F0)\n", "(defaults,S-1)\n"} {
+		eng := gcode.NewEngine(&machine{}, 0, os.Stdout, os.Stderr)
+		eng.DefaultsComment = true
+		err := eng.Evaluate(strings.NewReader(s))
+		if err == nil {
+			t.Errorf("Evaluate(%s) did not fail", s)
+		}
+	}
+
+	eng = gcode.NewEngine(&machine{actions: []action{}}, 0, os.Stdout, os.Stderr)
+	err = eng.Evaluate(strings.NewReader("(defaults,F1000)\n"))
+	if err != nil {
+		t.Errorf("Evaluate(defaults) failed: %s", err)
+	}
+}
+
+type pause struct {
+	optional bool
+	message  string
+}
+
+type pauseMachine struct {
+	machine
+	pauses []pause
+}
+
+func (m *pauseMachine) Pause(optional bool, message string) error {
+	m.pauses = append(m.pauses, pause{optional, message})
+	return nil
+}
+
+func TestPause(t *testing.T) {
+	var outW bytes.Buffer
+	m := pauseMachine{
+		machine: machine{
+			actions: []action{
+				{cmd: rapidTo, x: 1.0},
+				{cmd: rapidTo, x: 2.0},
+				{cmd: rapidTo, x: 3.0},
+			},
+		},
+	}
+	eng := gcode.NewEngine(&m, gcode.AllFeatures, &outW, &outW)
+	err := eng.Evaluate(strings.NewReader(`
+G21
+G0 X1
+(msg,change to the 1/8 endmill) M0
+G0 X2
+M1
+G0 X3
+`))
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	} else if m.adx != len(m.actions) {
+		t.Errorf("Evaluate(): got %d actions want %d", m.adx, len(m.actions))
+	}
+	want := []pause{{false, "change to the 1/8 endmill"}, {true, ""}}
+	if !reflect.DeepEqual(m.pauses, want) {
+		t.Errorf("Evaluate(): got %v want %v", m.pauses, want)
+	}
+	if outW.String() != "change to the 1/8 endmill\n" {
+		t.Errorf("Evaluate() outW: got %q", outW.String())
+	}
+
+	err = gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr).Evaluate(
+		strings.NewReader("M0\n"))
+	if err == nil {
+		t.Errorf("Evaluate(M0) did not fail without a Pauser")
+	}
+}
+
+func TestWarnRedundantModes(t *testing.T) {
+	cases := []struct {
+		s        string
+		warnings []string
+	}{
+		{s: "G21 G90 G17\nG1 X1 F10\nG1 X2\nX3\n", warnings: []string{"3: redundant modal code: G1"}},
+		{s: "G90 G90\nG0 X1\nG1 X2\nG0 X3\n", warnings: []string{"1: redundant modal code: G90"}},
+		{s: "G91\nG90\nG90 G20\nG21 G17 G18\n", warnings: []string{"3: redundant modal code: G90"}},
+		{s: "G90.1\nG91.1\nG91.1\nG91\n", warnings: []string{"3: redundant modal code: G91.1"}},
+		{s: "G20\nM2\nG21\nG21\n", warnings: nil},
+	}
+
+	for _, c := range cases {
+		var warnings []string
+		eng := gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+		eng.WarnRedundantModes = true
+		eng.Warn = func(line int, msg string) {
+			warnings = append(warnings, fmt.Sprintf("%d: %s", line, msg))
+		}
+		err := eng.Evaluate(strings.NewReader(c.s))
+		if err != nil {
+			t.Errorf("Evaluate(%s) failed: %s", c.s, err)
+		} else if !reflect.DeepEqual(warnings, c.warnings) {
+			t.Errorf("Evaluate(%s): got %v want %v", c.s, warnings, c.warnings)
+		}
+	}
+
+	var warnings []string
+	eng := gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+	eng.Warn = func(line int, msg string) {
+		warnings = append(warnings, msg)
+	}
+	err := eng.Evaluate(strings.NewReader("G90 G90\nG1 X1 F10\nG1 X2\n"))
+	if err != nil {
+		t.Errorf("Evaluate() failed: %s", err)
+	} else if warnings != nil {
+		t.Errorf("Evaluate(): got %v want no warnings", warnings)
+	}
+}
+
+func TestLatheDiameterMode(t *testing.T) {
+	m := machine{
+		actions: []action{
+			{cmd: setFeed, f: 100.0},
+			{cmd: linearTo, x: 5.0},
+			{cmd: linearTo, x: 5.0, z: -1.0},
+			{cmd: linearTo, x: 6.0, z: -1.0},
+			{cmd: linearTo, x: 10.0, z: -1.0},
+			{cmd: rapidTo, x: 20.0, z: -1.0},
+			{cmd: linearTo, x: 25.4, z: -1.0},
+		},
+	}
+	eng := gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+	eng.Lathe = true
+	err := eng.Evaluate(strings.NewReader(`
+G21
+G7
+G1 X10 F100
+Z-1
+G91 X2
+G90
+G8
+G1 X10
+G53 G0 X20
+G7 G20
+G1 X2
+`))
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	} else if m.adx != len(m.actions) {
+		t.Errorf("Evaluate(): got %d actions want %d", m.adx, len(m.actions))
+	}
+
+	eng = gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+	err = eng.Evaluate(strings.NewReader("G7\n"))
+	if err == nil {
+		t.Errorf("Evaluate(G7) did not fail without Lathe")
+	}
+}
+
+func TestFeedOverride(t *testing.T) {
+	var outW bytes.Buffer
+	m := machine{
+		actions: []action{
+			{cmd: setFeed, f: 100.0},
+			{cmd: linearTo, x: 1.0},
+			{cmd: setFeed, f: 50.0},
+			{cmd: linearTo, x: 2.0},
+			{cmd: linearTo, x: 3.0},
+			{cmd: setFeed, f: 254.0},
+			{cmd: linearTo, x: 25.4},
+		},
+	}
+	eng := gcode.NewEngine(&m, gcode.AllFeatures, &outW, &outW)
+	err := eng.Evaluate(strings.NewReader(`
+G21
+(debug,#<_feed_override>)
+G1 X1 F100
+#<_feed_override>=0.5
+(debug,#<_FEED_OVERRIDE>)
+G1 X2 F100
+X3
+#<_feed_override>=[#<_feed_override> * 4]
+G20
+G1 X1 F5
+`))
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	} else if m.adx != len(m.actions) {
+		t.Errorf("Evaluate(): got %d actions want %d", m.adx, len(m.actions))
+	}
+	if outW.String() != "1.0000\n0.5000\n" {
+		t.Errorf("Evaluate() outW: got %q want 1, 0.5", outW.String())
+	}
+	if st := eng.State(); st.Feed != 5.0*25.4 {
+		t.Errorf("State().Feed: got %f want %f", st.Feed, 5.0*25.4)
+	}
+
+	for _, s := range []string{"#<_feed_override>=0\n", "#<_feed_override>=-1\n",
+		"#<_feed_override>=<abc>\n"} {
+
+		eng := gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+		err := eng.Evaluate(strings.NewReader(s))
+		if err == nil {
+			t.Errorf("Evaluate(%s) did not fail", s)
+		}
+	}
+}
+
+func TestMachinePositionParams(t *testing.T) {
+	var outW bytes.Buffer
+	m := machine{
+		actions: []action{
+			{cmd: rapidTo, x: -9.0, y: -18.0, z: 3.0},
+			{cmd: rapidTo, x: 5.0, y: 6.0, z: 7.0},
+			{cmd: rapidTo, x: 15.0, y: 26.0, z: 7.0},
+		},
+	}
+	eng := gcode.NewEngine(&m, gcode.AllFeatures, &outW, &outW)
+	err := eng.Evaluate(strings.NewReader(`
+G21
+G10 L2 P2 X10 Y20
+G55
+G0 X1 Y2 Z3
+(debug,#5021 #5022 #5023 #5041 #5042 #5043)
+G53 G0 X5 Y6 Z7
+(debug,#5021 #5022 #5023 #5041 #5042 #5043)
+(debug,#5420 #5421 #5422)
+G92 X0 Y0
+G0 X10 Y20
+(debug,#5021 #5022 #5041 #5042)
+G20
+(debug,#5021 #5041)
+`))
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	} else if m.adx != len(m.actions) {
+		t.Errorf("Evaluate(): got %d actions want %d", m.adx, len(m.actions))
+	}
+	want := `-9.0000 -18.0000 3.0000 1.0000 2.0000 3.0000
+5.0000 6.0000 7.0000 15.0000 26.0000 7.0000
+15.0000 26.0000 7.0000
+15.0000 26.0000 10.0000 20.0000
+0.5906 0.3937
+`
+	if outW.String() != want {
+		t.Errorf("Evaluate() outW: got %q want %q", outW.String(), want)
+	}
+
+	for _, s := range []string{"#5021=1\n", "#5022=1\n", "#5023=1\n", "#5041=1\n",
+		"#5042=1\n", "#5043=1\n"} {
+
+		eng := gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+		err := eng.Evaluate(strings.NewReader(s))
+		if err == nil {
+			t.Errorf("Evaluate(%s) did not fail", s)
+		}
+	}
+}
+
+func TestSubroutines(t *testing.T) {
+	m := machine{
+		actions: []action{
+			{cmd: setFeed, f: 100.0},
+			{cmd: linearTo, x: 1.0},
+			{cmd: linearTo, x: 1.0, y: 10.0},
+			{cmd: linearTo, x: 2.0, y: 10.0},
+			{cmd: linearTo, x: 2.0, y: 20.0},
+			{cmd: linearTo, x: 5.0, y: 20.0},
+		},
+	}
+	var outW strings.Builder
+	eng := gcode.NewEngine(&m, gcode.AllFeatures, &outW, os.Stderr)
+	err := eng.Evaluate(strings.NewReader(`
+G21 F100
+#1=5
+#31=0
+O100 sub
+    G1 X#1
+    #31=[#31+10]
+    #1=99
+    G1 Y#31
+O100 endsub
+O100 call [1]
+O100 call [2]
+G1 X#1
+(debug,#1 #31)
+`))
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	} else if m.adx != len(m.actions) {
+		t.Errorf("Evaluate(): got %d actions want %d", m.adx, len(m.actions))
+	}
+	want := "5.0000 20.0000\n"
+	if outW.String() != want {
+		t.Errorf("Evaluate() outW: got %q want %q", outW.String(), want)
+	}
+}
+
+func TestEvaluateString(t *testing.T) {
+	m := machine{
+		actions: []action{
+			{cmd: setFeed, f: 100.0},
+			{cmd: linearTo, x: 10.0},
+			{cmd: linearTo, x: 10.0, y: 10.0},
+			{cmd: linearTo, y: 10.0},
+			{cmd: linearTo},
+		},
+	}
+	err := gcode.EvaluateString(`
+(msg,square)
+G21 F100
+G1 X10
+G1 Y10
+G1 X0
+G1 Y0
+M2
+`, &m, gcode.AllFeatures)
+	if err != nil {
+		t.Fatalf("EvaluateString() failed: %s", err)
+	} else if m.adx != len(m.actions) {
+		t.Errorf("EvaluateString(): got %d actions want %d", m.adx, len(m.actions))
+	}
+
+	err = gcode.EvaluateString("G1 X[1\n", &machine{}, gcode.AllFeatures)
+	if err == nil {
+		t.Errorf("EvaluateString(G1 X[1) did not fail")
+	}
+}
+
+func TestOverridesEnabled(t *testing.T) {
+	m := machine{
+		actions: []action{
+			{cmd: setFeed, f: 100.0},
+			{cmd: linearTo, x: 1.0},
+			{cmd: setFeed, f: 200.0},
+			{cmd: linearTo, x: 2.0},
+			{cmd: setFeed, f: 100.0},
+			{cmd: linearTo, x: 3.0},
+		},
+	}
+	eng := gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+	if !eng.OverridesEnabled() {
+		t.Errorf("OverridesEnabled(): got false want true")
+	}
+	err := eng.Evaluate(strings.NewReader(`
+G21
+#<_feed_override>=2
+M49
+G1 X1 F100
+`))
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	} else if eng.OverridesEnabled() {
+		t.Errorf("OverridesEnabled(): got true want false")
+	}
+
+	err = eng.Evaluate(strings.NewReader(`
+M48
+G1 X2 F100
+M49
+G1 X3 F100
+M30
+`))
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	} else if m.adx != len(m.actions) {
+		t.Errorf("Evaluate(): got %d actions want %d", m.adx, len(m.actions))
+	} else if !eng.OverridesEnabled() {
+		t.Errorf("OverridesEnabled(): got false want true after M30")
+	}
+}
+
+func TestSubroutineScope(t *testing.T) {
+	var outW strings.Builder
+	eng := gcode.NewEngine(&machine{}, gcode.AllFeatures, &outW, os.Stderr)
+	err := eng.Evaluate(strings.NewReader(`
+#5=1
+#35=1
+#<abc>=1
+#<_abc>=1
+O100 sub
+    #5=2
+    #35=2
+    #<abc>=2
+    #<_abc>=2
+    (debug,#5 #35 #<abc> #<_abc>)
+O100 endsub
+O100 call
+(debug,#5 #35 #<abc> #<_abc>)
+`))
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	}
+	want := "2.0000 2.0000 2.0000 2.0000\n1.0000 2.0000 1.0000 2.0000\n"
+	if outW.String() != want {
+		t.Errorf("Evaluate() outW: got %q want %q", outW.String(), want)
+	}
+
+	for _, s := range []string{
+		"#<abc>=1\nO100 sub\n#1=#<abc>\nO100 endsub\nO100 call\n",
+		"O100 sub\n#<abc>=1\nO100 endsub\nO100 call\n#1=#<abc>\n",
+	} {
+		eng := gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+		err := eng.Evaluate(strings.NewReader(s))
+		if err == nil {
+			t.Errorf("Evaluate(%s) did not fail", s)
+		}
+	}
+}
+
+func TestLastProgrammedFeed(t *testing.T) {
+	m := machine{
+		actions: []action{
+			{cmd: setFeed, f: 2540.0},
+			{cmd: linearTo, x: 25.4},
+			{cmd: setFeed, f: 50.0},
+			{cmd: linearTo, x: 10.0},
+		},
+	}
+	eng := gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+	if eng.LastProgrammedFeed() != 0.0 {
+		t.Errorf("LastProgrammedFeed(): got %v want 0", eng.LastProgrammedFeed())
+	}
+	err := eng.Evaluate(strings.NewReader("G20 F100\nG1 X1\n"))
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	} else if eng.LastProgrammedFeed() != 100.0 {
+		t.Errorf("LastProgrammedFeed(): got %v want 100", eng.LastProgrammedFeed())
+	} else if st := eng.State(); st.Feed != 2540.0 {
+		t.Errorf("State().Feed: got %v want 2540", st.Feed)
+	}
+
+	err = eng.Evaluate(strings.NewReader("G21 G1 X10 F50\n"))
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	} else if m.adx != len(m.actions) {
+		t.Errorf("Evaluate(): got %d actions want %d", m.adx, len(m.actions))
+	} else if eng.LastProgrammedFeed() != 50.0 {
+		t.Errorf("LastProgrammedFeed(): got %v want 50", eng.LastProgrammedFeed())
+	}
+}
+
+func TestIgnoreUnknownMCodes(t *testing.T) {
+	var unknown [][]gcode.Code
+	m := machine{
+		actions: []action{
+			{cmd: rapidTo, x: 1.0},
+			{cmd: rapidTo, x: 2.0},
+		},
+	}
+	eng := gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+	eng.IgnoreUnknownMCodes = true
+	eng.UnknownCodes = func(codes []gcode.Code) {
+		unknown = append(unknown, codes)
+	}
+	err := eng.Evaluate(strings.NewReader(`
+G21
+M100
+G0 X1
+M101 P1 Q2 G0 X2
+`))
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	} else if m.adx != len(m.actions) {
+		t.Errorf("Evaluate(): got %d actions want %d", m.adx, len(m.actions))
+	}
+	want := [][]gcode.Code{
+		{{'M', gcode.Number(100)}},
+		{{'M', gcode.Number(101)}, {'P', gcode.Number(1)}, {'Q', gcode.Number(2)}},
+	}
+	if !reflect.DeepEqual(unknown, want) {
+		t.Errorf("UnknownCodes() got %v want %v", unknown, want)
+	}
+
+	for _, s := range []string{"M100\n", "G140\n"} {
+		eng := gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+		eng.IgnoreUnknownMCodes = s == "G140\n"
+		err := eng.Evaluate(strings.NewReader(s))
+		if err == nil {
+			t.Errorf("Evaluate(%s) did not fail", s)
+		}
+	}
+}
+
+func TestPArg(t *testing.T) {
+	m := dwellMachine{
+		machine: machine{
+			actions: []action{
+				{cmd: rapidTo, x: -9.0, y: 2.0},
+			},
+		},
+	}
+	eng := gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+	err := eng.Evaluate(strings.NewReader(`
+G21
+G4 P1
+G10 L2 P1 X10
+G0 X1 Y2
+`))
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	} else if m.adx != len(m.actions) {
+		t.Errorf("Evaluate(): got %d actions want %d", m.adx, len(m.actions))
+	} else if !reflect.DeepEqual(m.dwells, []float64{1.0}) {
+		t.Errorf("Evaluate(): got dwells %v want [1]", m.dwells)
+	}
+
+	for _, s := range []string{"G1 X1 P1\n", "G21\nP1\n", "G20 P1\n"} {
+		eng := gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+		err := eng.Evaluate(strings.NewReader(s))
+		if err == nil {
+			t.Errorf("Evaluate(%s) did not fail", s)
+		} else if !strings.Contains(err.Error(), "; P is the dwell for G4") {
+			t.Errorf("Evaluate(%s) failed with %s", s, err)
+		}
+	}
+}
+
+func TestWarn(t *testing.T) {
+	cases := []struct {
+		s        string
+		warnings []string
+	}{
+		{s: "G21\nG0 X1 Y2\nG0 X1\nG1 X1 Y2 F10\nG1 X2\n",
+			warnings: []string{
+				"3: redundant move to the current position: {x: 1.0000, y: 2.0000, z: 0.0000}",
+				"4: redundant move to the current position: {x: 1.0000, y: 2.0000, z: 0.0000}",
+			}},
+		{s: "G21 G17\nG0 X1 Y0\nG2 X11 Y0 I5 J0 F10\nG2 X0.999 Y0 I-5 J0\n",
+			warnings: []string{
+				"4: arc endpoint off circle (start radius 5.0000, end radius 5.0010)",
+			}},
+		{s: "G21 G17\nG0 X1 Y0\nG2 X11 Y0 I5 J0.00001 F10\n", warnings: nil},
+		{s: "o100 sub\no100 endsub\no100 sub\nG0 X1\no100 endsub\no100 call\n",
+			warnings: []string{"4: subroutine O100 redefined"}},
+	}
+
+	for _, c := range cases {
+		var warnings []string
+		eng := gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+		eng.WarnRedundantMoves = true
+		eng.Warn = func(line int, msg string) {
+			warnings = append(warnings, fmt.Sprintf("%d: %s", line, msg))
+		}
+		err := eng.Evaluate(strings.NewReader(c.s))
+		if err != nil {
+			t.Errorf("Evaluate(%s) failed: %s", c.s, err)
+		} else if !reflect.DeepEqual(warnings, c.warnings) {
+			t.Errorf("Evaluate(%s): got %v want %v", c.s, warnings, c.warnings)
+		}
+	}
+}
+
+func TestDefaultFeed(t *testing.T) {
+	m := machine{
+		actions: []action{
+			{cmd: rapidTo, x: 25.4},
+			{cmd: setFeed, f: 500.0},
+			{cmd: linearTo, x: 50.8},
+			{cmd: linearTo, x: 76.2},
+			{cmd: setFeed, f: 254.0},
+			{cmd: linearTo, x: 101.6},
+		},
+	}
+	eng := gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+	eng.DefaultFeed = 500.0
+	eng.RequireFeed = true
+	err := eng.Evaluate(strings.NewReader("G20\nG0 X1\nG1 X2\nX3\nX4 F10\n"))
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	} else if m.adx != len(m.actions) {
+		t.Errorf("Evaluate(): got %d actions want %d", m.adx, len(m.actions))
+	}
+
+	for _, s := range []string{"G1 X1\n", "G0 X1\nG2 X3 I1\n", "G0 Z1\nG81 X1 Z-1 R0.5\n"} {
+		eng := gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+		eng.RequireFeed = true
+		err := eng.Evaluate(strings.NewReader(s))
+		if err == nil {
+			t.Errorf("Evaluate(%s) did not fail", s)
+		}
+	}
+
+	eng = gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+	eng.RequireFeed = true
+	err = eng.Evaluate(strings.NewReader("G0 X1\nG1 X2 F100\nG2 X4 I1\n"))
+	if err != nil {
+		t.Errorf("Evaluate() failed: %s", err)
+	}
+}
+
+type unknownAtMachine struct {
+	machine
+	positions []gcode.Position
+}
+
+func (m *unknownAtMachine) HandleUnknownAt(code gcode.Code, codes []gcode.Code,
+	curPos gcode.CurrentPosition) ([]gcode.Code, error) {
+
+	if num, ok := code.Value.AsNumber(); code.Letter != 'G' || !ok || !num.Equal(140) {
+		return nil, fmt.Errorf("unexpected code: %s", code)
+	}
+
+	// G140: move X by 5 mm.
+	pos := curPos.Get()
+	m.positions = append(m.positions, pos)
+	pos.X += 5.0
+	return codes, curPos.Set(pos)
+}
+
+func TestHandleUnknownAt(t *testing.T) {
+	m := unknownAtMachine{
+		machine: machine{
+			actions: []action{
+				{cmd: rapidTo, x: 1.0, y: 2.0},
+				{cmd: rapidTo, x: 6.0, y: 3.0},
+			},
+		},
+	}
+	eng := gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+	err := eng.Evaluate(strings.NewReader("G21\nG0 X1 Y2\nG140\nG0 Y3\nG140\n"))
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	} else if m.adx != len(m.actions) {
+		t.Errorf("Evaluate(): got %d actions want %d", m.adx, len(m.actions))
+	}
+	want := []gcode.Position{{X: 1.0, Y: 2.0}, {X: 6.0, Y: 3.0}}
+	if !reflect.DeepEqual(m.positions, want) {
+		t.Errorf("HandleUnknownAt: got %v want %v", m.positions, want)
+	}
+	if pos := eng.State().Position; pos != (gcode.Position{X: 11.0, Y: 3.0}) {
+		t.Errorf("State().Position: got %v want {11, 3, 0}", pos)
+	}
+}
+
+type feedMachine struct {
+	machine
+	feeds []float64
+}
+
+func (m *feedMachine) SetFeed(feed float64) error {
+	m.feeds = append(m.feeds, feed)
+	return nil
+}
+
+func TestFeedModes(t *testing.T) {
+	m := machine{
+		actions: []action{
+			{cmd: setSpindle, speed: 1000.0, clockwise: true},
+			{cmd: setFeed, f: 100.0},
+			{cmd: linearTo, x: 1.0},
+			{cmd: setSpindle, speed: 2000.0, clockwise: true},
+			{cmd: setFeed, f: 200.0},
+			{cmd: linearTo, x: 2.0},
+			{cmd: setFeed, f: 20.0},
+			{cmd: linearTo, x: 12.0},
+			{cmd: setFeed, f: 30.0},
+			{cmd: linearTo, x: 17.0},
+			{cmd: rapidTo, x: 20.0},
+			{cmd: setFeed, f: 50.0},
+			{cmd: linearTo, x: 21.0},
+		},
+	}
+	eng := gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+	err := eng.Evaluate(strings.NewReader(`
+G21 G95
+S1000 M3
+G1 X1 F0.1
+S2000
+G1 X2
+G93
+G1 X12 F2
+X17 F6
+G0 X20 F1
+G94 G1 X21 F50
+`))
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	} else if m.adx != len(m.actions) {
+		t.Errorf("Evaluate(): got %d actions want %d", m.adx, len(m.actions))
+	} else if st := eng.State(); st.FeedMode != gcode.UnitsPerMinuteFeed || st.Feed != 50.0 {
+		t.Errorf("State(): got feed %v mode %d want 50 mode G94", st.Feed, st.FeedMode)
+	}
+
+	fm := feedMachine{}
+	eng = gcode.NewEngine(&fm, gcode.AllFeatures, os.Stdout, os.Stderr)
+	err = eng.Evaluate(strings.NewReader("G21 G17 G93\nG0 X10\nG3 X-10 I-10 F2\nG3 X10 I10 F4\n"))
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	} else if len(fm.feeds) != 2 || math.Abs(fm.feeds[0]-20.0*math.Pi) > 0.0001 ||
+		math.Abs(fm.feeds[1]-40.0*math.Pi) > 0.0001 {
+
+		t.Errorf("Evaluate(): got feeds %v want [%v %v]", fm.feeds, 20.0*math.Pi, 40.0*math.Pi)
+	} else if st := eng.State(); st.FeedMode != gcode.InverseTimeFeed {
+		t.Errorf("State().FeedMode: got %d want G93", st.FeedMode)
+	}
+
+	err = eng.Evaluate(strings.NewReader("M2\n"))
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	} else if st := eng.State(); st.FeedMode != gcode.UnitsPerMinuteFeed || st.Feed != 0.0 {
+		t.Errorf("State(): got feed %v mode %d want 0 mode G94", st.Feed, st.FeedMode)
+	}
+
+	for _, s := range []string{
+		"G93 G1 X1\n",
+		"G93\nG1 X1 F1\nX2\n",
+		"G93\nG2 X1 Y1 I1\n",
+		"G93 G81 X1 Z-1 R1 F1\n",
+		"G95 G1 X1 F1\n",
+	} {
+		eng := gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+		err := eng.Evaluate(strings.NewReader(s))
+		if err == nil {
+			t.Errorf("Evaluate(%s) did not fail", s)
+		}
+	}
+}
+
+func TestComputedCodes(t *testing.T) {
+	m := machine{
+		actions: []action{
+			{cmd: setFeed, f: 10.0},
+			{cmd: linearTo, x: 1.0},
+			{cmd: rapidTo, x: 3.0, y: 1.0},
+			{cmd: rapidTo, x: 3.0, y: 1.0, z: 1.0},
+			{cmd: rapidTo, x: 4.0, y: 1.0, z: 1.0},
+			{cmd: linearTo, x: 4.0, y: 1.0, z: -1.0},
+			{cmd: rapidTo, x: 4.0, y: 1.0, z: 1.0},
+			{cmd: setSpindle, speed: 0.0, clockwise: false},
+			{cmd: setSpindle, speed: 100.0, clockwise: false},
+		},
+	}
+	var arcs []gcode.Arc
+	eng := gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+	eng.ArcHandler = func(arc gcode.Arc) (bool, error) {
+		arcs = append(arcs, arc)
+		return true, nil
+	}
+	err := eng.Evaluate(strings.NewReader(`
+G21
+#1=0
+G[[#1 > 0] + 1] X1 F10
+#1=1
+G[[#1 > 0] + 1] X2 Y1 R1
+G[1 == 0] X3
+G[80 + 1] X4 Z-1 R1
+G[80 + [#1 < 0]] M[[#1 == 1] + 3] S100
+`))
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	} else if m.adx != len(m.actions) {
+		t.Errorf("Evaluate(): got %d actions want %d", m.adx, len(m.actions))
+	} else if len(arcs) != 1 || !arcs[0].Clockwise {
+		t.Errorf("Evaluate(): got arcs %v want one clockwise arc", arcs)
+	}
+}
+
+func TestConstantSurfaceSpeed(t *testing.T) {
+	rpm := func(x float64) float64 {
+		return 100000.0 / (2.0 * math.Pi * x)
+	}
+	m := machine{
+		actions: []action{
+			{cmd: rapidTo, x: 50.0},
+			{cmd: setSpindle, speed: rpm(50.0), clockwise: true},
+			{cmd: setFeed, f: 100.0},
+			{cmd: linearTo, x: 25.0},
+			{cmd: setSpindle, speed: rpm(25.0), clockwise: true},
+			{cmd: linearTo, x: 25.0, z: -10.0},
+			{cmd: rapidTo, x: 5.0, z: -10.0},
+			{cmd: setSpindle, speed: 2000.0, clockwise: true},
+			{cmd: rapidTo, x: 4.0, z: -10.0},
+			{cmd: setSpindle, speed: 500.0, clockwise: true},
+			{cmd: rapidTo, x: 10.0, z: -10.0},
+		},
+	}
+	eng := gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+	eng.Lathe = true
+	err := eng.Evaluate(strings.NewReader(`
+G21 G18
+G0 X50
+G96 D2000 S100 M3
+G1 X25 F100
+Z-10
+G0 X5
+X4
+G97 S500
+X10
+`))
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	} else if m.adx != len(m.actions) {
+		t.Errorf("Evaluate(): got %d actions want %d", m.adx, len(m.actions))
+	} else if st := eng.State(); st.ConstantSurface || st.SpindleSpeed != 500.0 {
+		t.Errorf("State(): got G96 %v speed %v want G97 speed 500", st.ConstantSurface,
+			st.SpindleSpeed)
+	}
+
+	for _, s := range []string{"G96 S100\n", "G96 D0 S100\n", "G0 X1\nG96 S100\nG0 X0\n"} {
+		eng := gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+		eng.Lathe = true
+		err := eng.Evaluate(strings.NewReader(s))
+		if err == nil {
+			t.Errorf("Evaluate(%s) did not fail", s)
+		}
+	}
+}
+
+func TestBreakBeforeMCodes(t *testing.T) {
+	s := "G21\nT2\nG0 X1\nM6\nG0 X2\nT3 M6\nG0 X3\n"
+	m := toolChangeMachine{
+		machine: machine{
+			actions: []action{
+				{cmd: selectTool, tool: 2},
+				{cmd: rapidTo, x: 1.0},
+				{cmd: changeTool, tool: 2},
+				{cmd: rapidTo, x: 2.0},
+				{cmd: selectTool, tool: 3},
+				{cmd: changeTool, tool: 3},
+				{cmd: rapidTo, x: 3.0},
+			},
+		},
+	}
+	eng := gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+	eng.BreakBeforeMCodes = []float64{6}
+	err := eng.Evaluate(strings.NewReader(s))
+	be, ok := err.(gcode.BreakError)
+	if !ok {
+		t.Fatalf("Evaluate() got %v want a BreakError", err)
+	} else if be.Line != 4 || be.Code.Letter != 'M' || m.adx != 2 {
+		t.Errorf("Evaluate() got %s after %d actions want 4: break before M6 after 2", be, m.adx)
+	}
+	state := be.State
+
+	err = eng.Continue()
+	if be, ok := err.(gcode.BreakError); !ok {
+		t.Fatalf("Continue() got %v want a BreakError", err)
+	} else if be.Line != 6 || m.adx != 4 {
+		t.Errorf("Continue() got %s after %d actions want 6: break before M6 after 4", be, m.adx)
+	}
+	err = eng.Continue()
+	if err != nil {
+		t.Fatalf("Continue() failed: %s", err)
+	} else if m.adx != len(m.actions) {
+		t.Errorf("Continue(): got %d actions want %d", m.adx, len(m.actions))
+	}
+	err = eng.Continue()
+	if err == nil {
+		t.Errorf("Continue() did not fail")
+	}
+
+	// Restart at the line of the first break using the state.
+	m.adx = 2
+	eng = gcode.NewEngine(&m, gcode.AllFeatures, os.Stdout, os.Stderr)
+	err = eng.UnmarshalState(state)
+	if err != nil {
+		t.Fatalf("UnmarshalState() failed: %s", err)
+	}
+	lines := strings.SplitAfter(s, "\n")
+	err = eng.Evaluate(strings.NewReader(strings.Join(lines[be.Line-1:], "")))
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	} else if m.adx != len(m.actions) {
+		t.Errorf("Evaluate(): got %d actions want %d", m.adx, len(m.actions))
+	}
+}
+
+type overrideMachine struct {
+	machine
+	enables []string
+}
+
+func (m *overrideMachine) FeedOverrideEnable(enable bool) error {
+	m.enables = append(m.enables, fmt.Sprintf("feed %v", enable))
+	return nil
+}
+
+func (m *overrideMachine) SpeedOverrideEnable(enable bool) error {
+	m.enables = append(m.enables, fmt.Sprintf("speed %v", enable))
+	return nil
+}
+
+func TestOverrideEnabler(t *testing.T) {
+	m := overrideMachine{
+		machine: machine{
+			actions: []action{
+				{cmd: rapidTo, x: 1.0},
+				{cmd: rapidTo, x: 2.0},
+				{cmd: setFeed, f: 10.0},
+				{cmd: linearTo, x: 3.0},
+			},
+		},
+	}
+	var outW strings.Builder
+	eng := gcode.NewEngine(&m, gcode.AllFeatures, &outW, os.Stderr)
+	err := eng.Evaluate(strings.NewReader(`
+G21
+(debug,#<_overrides_enabled>)
+M49 G0 X1
+(debug,#<_overrides_enabled>)
+M48 X2
+(debug,#<_overrides_enabled>)
+M49 G1 X3 F10
+M2
+`))
+	want := []string{"feed false", "speed false", "feed true", "speed true", "feed false",
+		"speed false", "feed true", "speed true"}
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	} else if m.adx != len(m.actions) {
+		t.Errorf("Evaluate(): got %d actions want %d", m.adx, len(m.actions))
+	} else if !reflect.DeepEqual(m.enables, want) {
+		t.Errorf("Evaluate(): got %v want %v", m.enables, want)
+	} else if out := outW.String(); out != "1.0000\n0.0000\n1.0000\n" {
+		t.Errorf("Evaluate(): got output %q", out)
+	}
+
+	err = eng.Evaluate(strings.NewReader("#<_overrides_enabled>=0\n"))
+	if err == nil {
+		t.Errorf("Evaluate(#<_overrides_enabled>=0) did not fail")
+	}
+}
+
+func TestParamProviders(t *testing.T) {
+	first := map[int]gcode.Number{1: 10}
+	second := map[int]gcode.Number{1: 99, 2: 20}
+	mapProvider := func(nums map[int]gcode.Number, names map[gcode.Name]gcode.Value,
+		settable bool) gcode.ParamProvider {
+
+		return gcode.ParamProvider{
+			GetNumParam: func(num int) (gcode.Number, bool) {
+				val, ok := nums[num]
+				return val, ok
+			},
+			SetNumParam: func(num int, val gcode.Number) (bool, error) {
+				if !settable || num >= 10 {
+					return false, nil
+				}
+				nums[num] = val
+				return true, nil
+			},
+			GetNameParam: func(name gcode.Name) (gcode.Value, bool) {
+				val, ok := names[name]
+				return val, ok
+			},
+		}
+	}
+
+	var outW strings.Builder
+	eng := gcode.NewEngine(&machine{}, gcode.AllFeatures, &outW, os.Stderr)
+	eng.ParamProviders = []gcode.ParamProvider{
+		mapProvider(first, map[gcode.Name]gcode.Value{"a": gcode.Number(1)}, true),
+		mapProvider(second, map[gcode.Name]gcode.Value{"a": gcode.Number(2), "b": gcode.Number(3)},
+			false),
+	}
+	err := eng.Evaluate(strings.NewReader(`
+(debug,#1)
+(debug,#2)
+(debug,#<a>)
+(debug,#<b>)
+#10=[EXISTS[#3] + EXISTS[#<b>] * 10]
+(debug,#10)
+#2=5
+#50=7
+#<b>=4
+(debug,#2)
+(debug,#50)
+(debug,#<b>)
+`))
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	}
+	want := "10.0000\n20.0000\n1.0000\n3.0000\n10.0000\n5.0000\n7.0000\n4.0000\n"
+	if out := outW.String(); out != want {
+		t.Errorf("Evaluate(): got %q want %q", out, want)
+	}
+	if first[2] != 5 || second[2] != 20 {
+		t.Errorf("SetNumParam(2): got %v and %v want 5 and 20", first[2], second[2])
+	}
+	if _, ok := first[50]; ok {
+		t.Errorf("SetNumParam(50): got %v want not set", first[50])
+	}
+}
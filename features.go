@@ -0,0 +1,204 @@
+package gcode
+
+import (
+	"io"
+	"strings"
+)
+
+// RequiredFeatures scans a program and returns the minimal set of features needed to parse and
+// evaluate it: BeagleG for WHILE, IF, and unbracketed parameter names; LinuxCNC for O-words, $
+// spindle selection, and MSG, DEBUG, and PRINT comments; RepRap for {} expressions and *nnn
+// checksums; and Polar for @ and ^ words. The program is not evaluated, so errors are only
+// returned when reading from r fails.
+func RequiredFeatures(r io.ByteScanner) (Features, error) {
+	var f Features
+	var depth int
+	atStart := true
+	var assign bool // An = outside of brackets, as in BeagleG's #1 = 2 * 3.
+
+	for {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			return f, nil
+		} else if err != nil {
+			return 0, err
+		}
+
+		switch b {
+		case '\n', '\r':
+			depth = 0
+			atStart = true
+			assign = false
+		case ' ', '\t':
+		case '(', ';', '%':
+			inline := b == '('
+			var comment []byte
+			for {
+				b, err = r.ReadByte()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					return 0, err
+				}
+				if (inline && b == ')') || b == '\n' || b == '\r' {
+					break
+				}
+				comment = append(comment, b)
+			}
+			if b == '\n' || b == '\r' {
+				depth = 0
+				atStart = true
+				assign = false
+			}
+
+			cmd := strings.ToLower(strings.SplitN(string(comment), ",", 2)[0])
+			if cmd == "msg" || cmd == "debug" || cmd == "print" {
+				f |= LinuxCNC
+			}
+		case '"':
+			for {
+				b, err = r.ReadByte()
+				if err == io.EOF {
+					return f, nil
+				} else if err != nil {
+					return 0, err
+				}
+				if b == '"' || b == '\n' || b == '\r' {
+					break
+				} else if b == '\\' {
+					r.ReadByte()
+				}
+			}
+		case '[':
+			depth += 1
+		case ']':
+			depth -= 1
+		case '{', '}':
+			f |= RepRap
+		case '@', '^':
+			if depth == 0 {
+				f |= Polar
+			}
+			atStart = false
+		case '$':
+			if depth == 0 {
+				f |= LinuxCNC
+			}
+			atStart = false
+		case '=':
+			if depth == 0 {
+				assign = true
+			}
+			atStart = false
+		case '*':
+			if depth == 0 && !atStart && !assign {
+				checksum, err := readChecksum(r)
+				if err != nil {
+					return 0, err
+				} else if checksum {
+					f |= RepRap
+				}
+			}
+			atStart = false
+		case '#':
+			b, err = r.ReadByte()
+			if err == io.EOF {
+				return f, nil
+			} else if err != nil {
+				return 0, err
+			}
+			if upcaseByte(b) >= 'A' && upcaseByte(b) <= 'Z' || b == '_' {
+				f |= BeagleG
+			}
+			r.UnreadByte()
+			atStart = false
+		default:
+			b = upcaseByte(b)
+			if b < 'A' || b > 'Z' {
+				atStart = false
+				break
+			}
+
+			sym := []byte{b}
+			for {
+				b, err = r.ReadByte()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					return 0, err
+				}
+				if !symbolByte(upcaseByte(b)) {
+					r.UnreadByte()
+					break
+				}
+				sym = append(sym, upcaseByte(b))
+			}
+
+			if depth == 0 {
+				switch string(sym) {
+				case "WHILE", "IF":
+					if atStart {
+						f |= BeagleG
+					}
+				case "O":
+					if atStart {
+						f |= LinuxCNC
+					}
+				case "N":
+					if atStart {
+						// Skip the line number so that a keyword may follow it.
+						for {
+							b, err = r.ReadByte()
+							if err == io.EOF {
+								return f, nil
+							} else if err != nil {
+								return 0, err
+							}
+							if b < '0' || b > '9' {
+								r.UnreadByte()
+								break
+							}
+						}
+						continue
+					}
+				}
+			}
+			atStart = false
+		}
+	}
+}
+
+// readChecksum reads the digits following a *, and returns true if they are followed by the end
+// of the line, so that the * starts a checksum rather than being a multiplication.
+func readChecksum(r io.ByteScanner) (bool, error) {
+	var digits int
+	for {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			return digits > 0, nil
+		} else if err != nil {
+			return false, err
+		}
+		if b < '0' || b > '9' {
+			r.UnreadByte()
+			break
+		}
+		digits += 1
+	}
+	if digits == 0 {
+		return false, nil
+	}
+
+	for {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			return true, nil
+		} else if err != nil {
+			return false, err
+		}
+		if b != ' ' && b != '\t' {
+			r.UnreadByte()
+			return b == '\n' || b == '\r' || b == ';', nil
+		}
+	}
+}
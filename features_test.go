@@ -0,0 +1,55 @@
+package gcode_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/leftmike/gcode"
+)
+
+func TestRequiredFeatures(t *testing.T) {
+	cases := []struct {
+		s string
+		f gcode.Features
+	}{
+		{s: "G0 X1 Y2\nG1 F10 Z-1 ; comment\n"},
+		{s: "#1=[2 * 3]\nG0 X#1 (comment)\n"},
+		{s: "#<abc>=2\nG0 X#<abc>\n"},
+		{s: "G0 X\"(msg,not a comment)\"\n"},
+
+		{s: "#abc=2\nG0 X#abc\n", f: gcode.BeagleG},
+		{s: "WHILE [#1 < 10] DO\n#1=[#1 + 1]\nEND\n", f: gcode.BeagleG},
+		{s: "N10 while [#1 < 10] do\n#1++\nEND\n", f: gcode.BeagleG},
+		{s: "IF [#1 == 1] THEN #2=3 ELSE #2=4\n", f: gcode.BeagleG},
+
+		{s: "(msg,hello world)\n", f: gcode.LinuxCNC},
+		{s: "G0 X1 (DEBUG,#1)\n", f: gcode.LinuxCNC},
+		{s: "G0 X1 ;print,#1\n", f: gcode.LinuxCNC},
+		{s: "O100 sub\nG0 X#1\nO100 endsub\n", f: gcode.LinuxCNC},
+		{s: "o<abc> call [1]\n", f: gcode.LinuxCNC},
+		{s: "M3 $1 S100\n", f: gcode.LinuxCNC},
+
+		{s: "N10 G0 X1 *91\n", f: gcode.RepRap},
+		{s: "G0 X{1 + 2}\n", f: gcode.RepRap},
+		{s: "G0 X[1 * 2]\n"},
+		{s: "G0 X1*91\n", f: gcode.RepRap},
+		{s: "#abc = 2 * 3\nG0 X#abc\n", f: gcode.BeagleG},
+		{s: "#abc = 2*3\n#1 = #abc * 2\n", f: gcode.BeagleG},
+		{s: "IF [#1 == 1] THEN #2=3 * 4\n", f: gcode.BeagleG},
+
+		{s: "G1 @10 ^45 F100\n", f: gcode.Polar},
+		{s: "G0 X\"@1\"\n"},
+
+		{s: "(msg,start)\n#abc=2\nG0 X{#abc + 1} *12\n",
+			f: gcode.BeagleG | gcode.LinuxCNC | gcode.RepRap},
+	}
+
+	for _, c := range cases {
+		f, err := gcode.RequiredFeatures(strings.NewReader(c.s))
+		if err != nil {
+			t.Errorf("RequiredFeatures(%s) failed with %s", c.s, err)
+		} else if f != c.f {
+			t.Errorf("RequiredFeatures(%s) got %d want %d", c.s, f, c.f)
+		}
+	}
+}
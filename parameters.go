@@ -2,9 +2,17 @@ package gcode
 
 import (
 	"fmt"
+	"io"
+	"sort"
 )
 
 const (
+	machinePosXParam  = 5021
+	machinePosYParam  = 5022
+	machinePosZParam  = 5023
+	workCoordXParam   = 5041 // #5041 to #5043 are the same as #5420 to #5422.
+	workCoordYParam   = 5042
+	workCoordZParam   = 5043
 	homePosXParam     = 5161
 	homePosYParam     = 5162
 	homePosZParam     = 5163
@@ -18,11 +26,38 @@ const (
 	curCoordSysParam  = 5220
 	coordSysParam     = 5221 // Nine sets of coordinate system parameters starting here.
 	coordSysParamStep = 20   // Gap between each coordinate system's parameters.
+	curToolParam      = 5400
+	toolOffsetXParam  = 5401
+	toolOffsetYParam  = 5402
+	toolOffsetZParam  = 5403
 	curPosXParam      = 5420
 	curPosYParam      = 5421
 	curPosZParam      = 5422
+
+	feedOverrideParam     Name = "_feed_override"
+	overridesEnabledParam Name = "_overrides_enabled"
 )
 
+// ParamProvider is a source of global parameters which the program has not set, such as a tool
+// table read from a file or offsets saved by the machine; see ParamProviders. Any of the
+// functions may be nil.
+type ParamProvider struct {
+	// GetNumParam returns the value of a number parameter, or false if the provider does not
+	// have it.
+	GetNumParam func(num int) (Number, bool)
+
+	// SetNumParam is called when the program sets a number parameter; if it returns true, the
+	// provider has stored the value, and later providers and the engine do not.
+	SetNumParam func(num int, val Number) (bool, error)
+
+	// GetNameParam returns the value of a name parameter, or false if the provider does not
+	// have it.
+	GetNameParam func(name Name) (Value, bool)
+
+	// SetNameParam is called when the program sets a name parameter, like SetNumParam.
+	SetNameParam func(name Name, val Value) (bool, error)
+}
+
 func (eng *engine) getCoordSysParam(num int) (Number, bool) {
 	num -= coordSysParam
 	coordSys := num / coordSysParamStep
@@ -80,35 +115,68 @@ func (eng *engine) getNumParam(num int) (Number, bool) {
 		return Number(eng.workPos.Z / eng.units), true
 	case curCoordSysParam:
 		return Number(eng.curCoordSys + 1), true
-	case curPosXParam:
+	case curToolParam:
+		return Number(eng.CurrentTool()), true
+	case probePosXParam:
+		return Number(eng.probePos.X / eng.units), true
+	case probePosYParam:
+		return Number(eng.probePos.Y / eng.units), true
+	case probePosZParam:
+		return Number(eng.probePos.Z / eng.units), true
+	case probeResultParam:
+		if eng.probeContact {
+			return 1, true
+		}
+		return 0, true
+	case toolOffsetXParam, toolOffsetYParam:
+		return 0, true
+	case toolOffsetZParam:
+		return Number(eng.toolLengthOffset / eng.units), true
+	case machinePosXParam:
+		return Number(eng.curPos.X / eng.units), true
+	case machinePosYParam:
+		return Number(eng.curPos.Y / eng.units), true
+	case machinePosZParam:
+		return Number(eng.curPos.Z / eng.units), true
+	case curPosXParam, workCoordXParam:
 		if eng.useWorkPos {
-			return Number((eng.curPos.X + eng.coordSysPos[eng.curCoordSys].X + eng.workPos.X) /
-				eng.units), true
+			return Number((eng.curPos.X + eng.coordSysPos[eng.curCoordSys].X + eng.localPos.X +
+				eng.workPos.X) / eng.units), true
 		}
-		return Number((eng.curPos.X + eng.coordSysPos[eng.curCoordSys].X) / eng.units), true
-	case curPosYParam:
+		return Number((eng.curPos.X + eng.coordSysPos[eng.curCoordSys].X + eng.localPos.X) /
+			eng.units), true
+	case curPosYParam, workCoordYParam:
 		if eng.useWorkPos {
-			return Number((eng.curPos.Y + eng.coordSysPos[eng.curCoordSys].Y + eng.workPos.Y) /
-				eng.units), true
+			return Number((eng.curPos.Y + eng.coordSysPos[eng.curCoordSys].Y + eng.localPos.Y +
+				eng.workPos.Y) / eng.units), true
 		}
-		return Number((eng.curPos.Y + eng.coordSysPos[eng.curCoordSys].Y) / eng.units), true
-	case curPosZParam:
+		return Number((eng.curPos.Y + eng.coordSysPos[eng.curCoordSys].Y + eng.localPos.Y) /
+			eng.units), true
+	case curPosZParam, workCoordZParam:
 		if eng.useWorkPos {
-			return Number((eng.curPos.Z + eng.coordSysPos[eng.curCoordSys].Z + eng.workPos.Z) /
-				eng.units), true
+			return Number((eng.curPos.Z + eng.coordSysPos[eng.curCoordSys].Z + eng.localPos.Z +
+				eng.workPos.Z + eng.toolLengthOffset) / eng.units), true
 		}
-		return Number((eng.curPos.Z + eng.coordSysPos[eng.curCoordSys].Z) / eng.units), true
+		return Number((eng.curPos.Z + eng.coordSysPos[eng.curCoordSys].Z + eng.localPos.Z +
+			eng.toolLengthOffset) / eng.units), true
 	}
 
-	if num >= coordSysParam && num < coordSysParam*coordSysParamStep*9 {
+	if num >= coordSysParam && num < coordSysParam+coordSysParamStep*9 {
 		return eng.getCoordSysParam(num)
 	}
 
 	val, ok := eng.numParams[num]
-	if !ok {
-		return 0, false
+	if ok {
+		return val, true
 	}
-	return val, true
+	for _, pp := range eng.ParamProviders {
+		if pp.GetNumParam != nil {
+			if val, ok := pp.GetNumParam(num); ok {
+				return val, true
+			}
+		}
+	}
+	return 0, false
 }
 
 func readOnlyNumParam(num int) error {
@@ -164,25 +232,147 @@ func (eng *engine) setNumParam(num int, val Number) error {
 		return readOnlyNumParam(curPosYParam)
 	case curPosZParam:
 		return readOnlyNumParam(curPosZParam)
+	case machinePosXParam, machinePosYParam, machinePosZParam, workCoordXParam, workCoordYParam,
+		workCoordZParam:
+
+		return readOnlyNumParam(num)
+	case curToolParam, toolOffsetXParam, toolOffsetYParam, toolOffsetZParam, probePosXParam,
+		probePosYParam, probePosZParam, probeResultParam:
+
+		return readOnlyNumParam(num)
 	}
 
-	if num >= coordSysParam && num < coordSysParam*coordSysParamStep*9 {
+	if num >= coordSysParam && num < coordSysParam+coordSysParamStep*9 {
 		return eng.setCoordSysParam(num, val)
 	}
 
+	for _, pp := range eng.ParamProviders {
+		if pp.SetNumParam != nil {
+			if ok, err := pp.SetNumParam(num, val); err != nil || ok {
+				return err
+			}
+		}
+	}
 	eng.numParams[num] = val
 	return nil
 }
 
 func (eng *engine) getNameParam(name Name) (Value, bool) {
+	if name == feedOverrideParam {
+		return Number(eng.feedOverride), true
+	} else if name == overridesEnabledParam {
+		if eng.noOverrides {
+			return Number(0), true
+		}
+		return Number(1), true
+	}
+
 	val, ok := eng.nameParams[name]
-	if !ok {
-		return nil, false
+	if ok {
+		return val, true
 	}
-	return val, true
+	for _, pp := range eng.ParamProviders {
+		if pp.GetNameParam != nil {
+			if val, ok := pp.GetNameParam(name); ok {
+				return val, true
+			}
+		}
+	}
+	return nil, false
 }
 
 func (eng *engine) setNameParam(name Name, val Value) error {
+	if name == feedOverrideParam {
+		num, ok := val.AsNumber()
+		if !ok || num <= 0.0 {
+			return fmt.Errorf("#<%s>: expected a positive number: %s", name, val)
+		}
+		eng.feedOverride = float64(num)
+		return nil
+	} else if name == overridesEnabledParam {
+		return fmt.Errorf("global name parameter #<%s> is read-only", name)
+	}
+
+	for _, pp := range eng.ParamProviders {
+		if pp.SetNameParam != nil {
+			if ok, err := pp.SetNameParam(name, val); err != nil || ok {
+				return err
+			}
+		}
+	}
 	eng.nameParams[name] = val
 	return nil
 }
+
+// RangeNumberParams calls fn for each global number parameter which has been set, in order by
+// number, until fn returns false. The predefined parameters, such as the coordinate system
+// offsets, are not included.
+func (eng *engine) RangeNumberParams(fn func(num int, val Number) bool) {
+	nums := make([]int, 0, len(eng.numParams))
+	for num := range eng.numParams {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+
+	for _, num := range nums {
+		if !fn(num, eng.numParams[num]) {
+			return
+		}
+	}
+}
+
+// RangeNameParams calls fn for each global name parameter which has been set, in order by name,
+// until fn returns false.
+func (eng *engine) RangeNameParams(fn func(name Name, val Value) bool) {
+	names := make([]Name, 0, len(eng.nameParams))
+	for name := range eng.nameParams {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return names[i] < names[j]
+	})
+
+	for _, name := range names {
+		if !fn(name, eng.nameParams[name]) {
+			return
+		}
+	}
+}
+
+// EvalProgram parses a program, evaluating only the assignments and expressions, and returns
+// the resulting global number and name parameters. The codes, including any motion, are
+// ignored, as are MSG, DEBUG, and PRINT comments.
+func EvalProgram(r io.ByteScanner, f Features) (map[int]Number, map[Name]Value, error) {
+	numParams := map[int]Number{}
+	nameParams := map[Name]Value{}
+
+	p := Parser{
+		Scanner:  r,
+		Features: f,
+		GetNumParam: func(num int) (Number, bool) {
+			val, ok := numParams[num]
+			return val, ok
+		},
+		SetNumParam: func(num int, val Number) error {
+			numParams[num] = val
+			return nil
+		},
+		GetNameParam: func(name Name) (Value, bool) {
+			val, ok := nameParams[name]
+			return val, ok
+		},
+		SetNameParam: func(name Name, val Value) error {
+			nameParams[name] = val
+			return nil
+		},
+	}
+
+	for {
+		_, err := p.Parse()
+		if err == io.EOF {
+			return numParams, nameParams, nil
+		} else if err != nil {
+			return nil, nil, err
+		}
+	}
+}
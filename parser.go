@@ -9,6 +9,12 @@ package gcode
       <body>
     | 'IF' <expr> 'THEN' <assignment> ('ELSEIF' <expr> 'THEN' <assignment>)* ['ELSE' <assignment>]
     | 'WHILE' <expr> 'DO' <suffix> <line>* <suffix> 'END'
+<linuxcnc-body> =
+      <body>
+    | 'O' <o-label> 'SUB' <suffix> <line>* 'O' <o-label> 'ENDSUB'
+    | 'O' <o-label> 'RETURN'
+    | 'O' <o-label> 'CALL' <expr>*
+<o-label> = <integer> | <name>
 <command> = <code> <expr>
 <assignment> =
       <parameter> <whitespace>* <assign-op> <whitespace>* <expr>
@@ -21,6 +27,7 @@ package gcode
 <expr> =
       <reference>
     | '[' <sub-expr> ']'
+    | '{' <sub-expr> '}' ;; RepRap
     | <number>
     | <name>
     | <string>
@@ -28,19 +35,26 @@ package gcode
       <number>
     | '-' <sub-expr>
     | '!' <sub-expr>
+    | '~' <sub-expr> ;; BitwiseOperators
     | '[' <sub-expr> ']'
+    | '{' <sub-expr> '}' ;; RepRap
     | <sub-expr> <op> <sub-expr>
     | <reference>
     | <name>
     | <string>
     | <func> '[' [<sub-expr> [',' ...]] ']'
+    | 'ATAN' '[' <sub-expr> ']' '/' '[' <sub-expr> ']'
+    | 'EXISTS' '[' <reference> ']'
+    | <func> '{' [<sub-expr> [',' ...]] '}' ;; RepRap
 <op> = '+' '-' '*' '/'
     | '==' '!=' '<' '<=' '>' '>='
-    | '&&' '||'
+    | '&&' '||' 'XOR'
+    | '&' '|' ;; BitwiseOperators
 <reference> = '#'* <parameter>
 <trailing-comment> = (';' | '%') <any-char>*
 <inline-comment> = '(' <any-char>* ')'
-<code> = 'A' ... 'Z' | 'a' ... 'z'
+<code> = 'A' ... 'Z' | 'a' ... 'z' | '$' ;; LinuxCNC
+    | '@' | '^' ;; Polar
 <name> = '<' <name-char>+ '>'
 <initial-name-char> = 'A' ... 'Z' | 'a' ... 'z' | '_'
 <name-char> = <initial-name-char> | '0' ... '9'
@@ -55,6 +69,7 @@ import (
 	"io"
 	"math"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -82,6 +97,10 @@ const (
 	LinuxCNC
 	RepRap
 
+	// Polar enables @ (radius) and ^ (angle in degrees) for moves in polar coordinates. It is
+	// not a dialect, so it is not included in AllFeatures.
+	Polar
+
 	AllFeatures Features = BeagleG | LinuxCNC | RepRap
 )
 
@@ -97,6 +116,10 @@ func (f Features) HasRepRap() bool {
 	return f&RepRap != 0
 }
 
+func (f Features) HasPolar() bool {
+	return f&Polar != 0
+}
+
 type Parser struct {
 	Scanner  io.ByteScanner
 	Features Features
@@ -115,22 +138,86 @@ type Parser struct {
 	// SetNameParam sets the value of a global name parameter.
 	SetNameParam func(name Name, val Value) error
 
+	// LineNumberExpr allows the line number following N to be an expression, such as a
+	// parameter, which must evaluate to an integer. By default, only digits are allowed. The
+	// expression is evaluated once, when the line is parsed, so in a loop or a subroutine, the
+	// line number does not change when the line is repeated.
+	LineNumberExpr bool
+
+	// MaxReferences limits the number of leading # in a parameter reference, such as ###1; if
+	// zero, defaultMaxReferences is used. Each # beyond the first uses the value of the
+	// parameter as the number of another parameter.
+	MaxReferences int
+
+	// BeagleGComments evaluates MSG, DEBUG, and PRINT comments when the BeagleG feature is
+	// enabled; otherwise, they are only evaluated when the LinuxCNC feature is enabled.
+	BeagleGComments bool
+
+	// PrefixedIntegers allows hexadecimal integers prefixed with 0x and binary integers
+	// prefixed with 0b in expressions, such as [0x10 + 0b101].
+	PrefixedIntegers bool
+
+	// BitwiseOperators allows the integer operators & (and), | (or), and ~ (not) in
+	// expressions, in addition to the logical operators &&, ||, and !.
+	BitwiseOperators bool
+
+	// LineTerminator ends each line written for MSG, DEBUG, and PRINT comments; if empty, "\n"
+	// is used.
+	LineTerminator string
+
+	// RequireChecksum causes a line without a checksum (*nnn) at the end to be rejected when the
+	// RepRap feature is enabled; lines which are empty or only a comment are allowed.
+	RequireChecksum bool
+
+	// CommentHandlers are called with the body of comments, such as (name,body), whose name
+	// matches, ignoring case, a key of the map; keys must be lower case. Unlike MSG, DEBUG, and
+	// PRINT comments, the handlers are called regardless of the features enabled.
+	CommentHandlers map[string]func(body string) error
+
+	// Warn, if set, is called with the line number and the message of non-fatal diagnostics,
+	// such as when a subroutine is redefined; otherwise, warnings are written to ErrW. The line
+	// number is counted like ParseError.Line.
+	Warn func(line int, msg string)
+
 	lineState     lineState
 	physicalLine  int // Count of lines
 	virtualLine   int // Lines as tracked by Nnnn
+	column        int // Column of the last byte read; see ParseError.
+	prevColumn    int
+	endOfLine     bool // The last byte read ended a line.
+	prevEndOfLine bool
 	stack         *stackFrame
+	calls         *callFrame
+	subs          map[string][]action // Subroutines by label, such as 100 or <name>.
+	sub           string              // The label of the subroutine being parsed, if any.
 	noDebugOutput bool
+	message       string // The body of the last MSG comment on the line.
 }
 
 const (
-	minimumDelta = 0.0001
+	minimumDelta         = 0.0001
+	defaultMaxReferences = 16
+	maxSubParams         = 30
 )
 
 type stackFrame struct {
 	actions []action
+	call    bool // The actions are the body of a called subroutine.
 	next    *stackFrame
 }
 
+// callFrame holds the parameters, #1 to #30 and names which do not start with _, which are
+// local to a called subroutine.
+type callFrame struct {
+	params [maxSubParams]Number
+	names  map[Name]Value
+	next   *callFrame
+}
+
+func isGlobalName(name Name) bool {
+	return strings.HasPrefix(string(name), "_")
+}
+
 type lineState byte
 
 const (
@@ -165,33 +252,44 @@ const (
 var (
 	opPrecedence = [...]int{
 		orOp:           1,
-		andOp:          2,
-		notOp:          3,
-		equalOp:        4,
-		notEqualOp:     4,
-		greaterThanOp:  5,
-		greaterEqualOp: 5,
-		lessThanOp:     5,
-		lessEqualOp:    5,
-		subtractOp:     7,
-		addOp:          7,
-		divideOp:       8,
-		multiplyOp:     8,
-		negateOp:       9,
-		noOp:           11,
+		xorOp:          2,
+		andOp:          3,
+		notOp:          4,
+		equalOp:        5,
+		notEqualOp:     5,
+		greaterThanOp:  6,
+		greaterEqualOp: 6,
+		lessThanOp:     6,
+		lessEqualOp:    6,
+		bitOrOp:        7,
+		bitAndOp:       8,
+		subtractOp:     9,
+		addOp:          9,
+		divideOp:       10,
+		multiplyOp:     10,
+		negateOp:       11,
+		bitNotOp:       11,
+		noOp:           12,
 	}
 
 	calls = map[string]struct {
 		fn      callFunc
 		numArgs int
+		maxArgs int // If non-zero, up to maxArgs arguments are allowed.
 	}{
 		"ABS":   {fn: abs, numArgs: 1},
 		"ACOS":  {fn: acos, numArgs: 1},
 		"ASIN":  {fn: asin, numArgs: 1},
-		"ATAN":  {fn: atan, numArgs: 1},
+		"ATAN":  {fn: atan, numArgs: 1, maxArgs: 2},
 		"CEIL":  {fn: ceil, numArgs: 1},
 		"COS":   {fn: cos, numArgs: 1},
+		"EXP":   {fn: exp, numArgs: 1},
+		"FIX":   {fn: floor, numArgs: 1},
 		"FLOOR": {fn: floor, numArgs: 1},
+		"FUP":   {fn: ceil, numArgs: 1},
+		"LN":    {fn: ln, numArgs: 1},
+		"MOD":   {fn: mod, numArgs: 2},
+		"POW":   {fn: pow, numArgs: 2},
 		"ROUND": {fn: round, numArgs: 1},
 		"SIN":   {fn: sin, numArgs: 1},
 		"SQRT":  {fn: sqrt, numArgs: 1},
@@ -212,6 +310,7 @@ const (
 	noOp
 	andOp
 	orOp
+	xorOp
 	equalOp
 	notEqualOp
 	greaterThanOp
@@ -222,6 +321,9 @@ const (
 	addOp
 	divideOp
 	multiplyOp
+	bitAndOp
+	bitOrOp
+	bitNotOp
 )
 
 type unary struct {
@@ -253,8 +355,12 @@ func (n Number) String() string {
 func (n Number) Equal(n2 Number) bool {
 	// Numbers are equal if their absolute difference is less that 0.0001
 
-	delta := math.Abs(float64(n)) - math.Abs(float64(n2))
-	return math.Abs(delta) < minimumDelta
+	return math.Abs(float64(n)-float64(n2)) < minimumDelta
+}
+
+// isTrue returns whether n is true in a test: non-zero numbers are true.
+func isTrue(n Number) bool {
+	return math.Abs(float64(n)) >= minimumDelta
 }
 
 func (_ Number) AsName() (Name, bool) {
@@ -269,6 +375,14 @@ func (n Number) AsInteger() (int, bool) {
 	return int(n), n.Equal(Number(math.Trunc(float64(n))))
 }
 
+// RoundToInteger returns the number rounded to the nearest integer. Unlike AsInteger, it always
+// succeeds, so callers should check that the number is close enough to the result. AsInteger
+// allows the tolerance of Equal, so it succeeds for 2.0000001, but it truncates rather than
+// rounds, so it fails for 1.9999999.
+func (n Number) RoundToInteger() int {
+	return int(math.Round(float64(n)))
+}
+
 func (_ Number) AsString() (String, bool) {
 	return "", false
 }
@@ -341,6 +455,29 @@ func (prm param) evaluate(p *Parser) Value {
 	return v
 }
 
+// exists evaluates to 1 if the parameter referenced by prm has been set and 0 otherwise; only
+// the last parameter in a chain of references, such as ##1, need not exist.
+type exists struct {
+	prm param
+}
+
+func (e exists) evaluate(p *Parser) Value {
+	v := param{refs: e.prm.refs - 1, expr: e.prm.expr}.evaluate(p)
+	if num, ok := v.AsNumber(); ok {
+		n, ok := num.AsInteger()
+		if !ok || n < 1 {
+			p.error(fmt.Sprintf("number parameter must be a positive integer: %s", num))
+		}
+		return logicBool(p.hasNumParam(n))
+	}
+
+	n, ok := v.AsName()
+	if !ok {
+		p.error("expected a name parameter")
+	}
+	return logicBool(p.hasNameParam(n))
+}
+
 func (u *unary) evaluate(p *Parser) Value {
 	switch u.op {
 	case negateOp:
@@ -354,11 +491,22 @@ func (u *unary) evaluate(p *Parser) Value {
 		}
 	case noOp:
 		return u.expr.evaluate(p)
+	case bitNotOp:
+		return Number(^p.wantBits(u.expr.evaluate(p)))
 	default:
 		panic(fmt.Sprintf("unexpected unary op: %d", u.op))
 	}
 }
 
+// wantBits returns the value as an integer for a bitwise operator.
+func (p *Parser) wantBits(v Value) int64 {
+	n := p.wantNumber(v)
+	if _, ok := n.AsInteger(); !ok {
+		p.error(fmt.Sprintf("expected an integer for a bitwise operator: %s", n))
+	}
+	return int64(math.Round(float64(n)))
+}
+
 func (op op) precedence() int {
 	return opPrecedence[op]
 }
@@ -393,6 +541,9 @@ func (b *binary) evaluate(p *Parser) Value {
 			return Number(1)
 		}
 		return logicNumber(p.wantNumber(b.right.evaluate(p)))
+	case xorOp:
+		return logicBool((p.wantNumber(b.left.evaluate(p)) != 0) !=
+			(p.wantNumber(b.right.evaluate(p)) != 0))
 	case equalOp:
 		return logicBool(p.wantNumber(b.left.evaluate(p)) == p.wantNumber(b.right.evaluate(p)))
 	case notEqualOp:
@@ -413,6 +564,10 @@ func (b *binary) evaluate(p *Parser) Value {
 		return p.wantNumber(b.left.evaluate(p)) / p.wantNumber(b.right.evaluate(p))
 	case multiplyOp:
 		return p.wantNumber(b.left.evaluate(p)) * p.wantNumber(b.right.evaluate(p))
+	case bitAndOp:
+		return Number(p.wantBits(b.left.evaluate(p)) & p.wantBits(b.right.evaluate(p)))
+	case bitOrOp:
+		return Number(p.wantBits(b.left.evaluate(p)) | p.wantBits(b.right.evaluate(p)))
 	default:
 		panic(fmt.Sprintf("unexpected binary op: %d", b.op))
 	}
@@ -439,6 +594,7 @@ func (p *Parser) Parse() (codes []Code, err error) {
 
 	var endFuncs []endFunc
 	codes = nil
+	p.message = ""
 
 	for {
 		var act action
@@ -473,17 +629,31 @@ func (p *Parser) getNumParam(num int) Number {
 		return 1
 	}
 
+	if num >= 1 && num <= maxSubParams && p.calls != nil {
+		return p.calls.params[num-1]
+	}
+
 	if p.GetNumParam == nil {
 		p.error("getting global number parameters not supported")
 	}
 
 	val, ok := p.GetNumParam(int(num))
 	if !ok {
-		p.error(fmt.Sprintf("global number parameter %s not found", val))
+		p.error(fmt.Sprintf("global number parameter #%d not found", num))
 	}
 	return val
 }
 
+func (p *Parser) hasNumParam(num int) bool {
+	if num == debugOutputParam || (num >= 1 && num <= maxSubParams && p.calls != nil) {
+		return true
+	} else if p.GetNumParam == nil {
+		return false
+	}
+	_, ok := p.GetNumParam(num)
+	return ok
+}
+
 func (p *Parser) setNumParam(num int, val Number) {
 	if num == debugOutputParam {
 		if val.Equal(0.0) {
@@ -494,6 +664,11 @@ func (p *Parser) setNumParam(num int, val Number) {
 		return
 	}
 
+	if num >= 1 && num <= maxSubParams && p.calls != nil {
+		p.calls.params[num-1] = val
+		return
+	}
+
 	if p.GetNumParam == nil || p.SetNumParam == nil {
 		p.error("setting global number parameters not supported")
 	}
@@ -505,6 +680,14 @@ func (p *Parser) setNumParam(num int, val Number) {
 }
 
 func (p *Parser) getNameParam(name Name) Value {
+	if p.calls != nil && !isGlobalName(name) {
+		val, ok := p.calls.names[name]
+		if !ok {
+			p.error(fmt.Sprintf("local name parameter %s not found", name))
+		}
+		return val
+	}
+
 	if p.GetNameParam == nil {
 		p.error("getting global name parameters not supported")
 	}
@@ -515,7 +698,23 @@ func (p *Parser) getNameParam(name Name) Value {
 	return val
 }
 
+func (p *Parser) hasNameParam(name Name) bool {
+	if p.calls != nil && !isGlobalName(name) {
+		_, ok := p.calls.names[name]
+		return ok
+	} else if p.GetNameParam == nil {
+		return false
+	}
+	_, ok := p.GetNameParam(name)
+	return ok
+}
+
 func (p *Parser) setNameParam(name Name, val Value) {
+	if p.calls != nil && !isGlobalName(name) {
+		p.calls.names[name] = val
+		return
+	}
+
 	if p.GetNameParam == nil || p.SetNameParam == nil {
 		p.error("setting globel name parameters not supported")
 	}
@@ -547,6 +746,11 @@ func asin(p *Parser, args []Value) Value {
 }
 
 func atan(p *Parser, args []Value) Value {
+	if len(args) == 2 {
+		// ATAN[y,x]
+		return toDegrees(math.Atan2(float64(p.wantNumber(args[0])),
+			float64(p.wantNumber(args[1]))))
+	}
 	return toDegrees(math.Atan(float64(p.wantNumber(args[0]))))
 }
 
@@ -558,10 +762,32 @@ func cos(p *Parser, args []Value) Value {
 	return Number(math.Cos(toRadians(p.wantNumber(args[0]))))
 }
 
+func exp(p *Parser, args []Value) Value {
+	return Number(math.Exp(float64(p.wantNumber(args[0]))))
+}
+
 func floor(p *Parser, args []Value) Value {
 	return Number(math.Floor(float64(p.wantNumber(args[0]))))
 }
 
+func ln(p *Parser, args []Value) Value {
+	return Number(math.Log(float64(p.wantNumber(args[0]))))
+}
+
+// mod returns the remainder of the first argument divided by the second; like LinuxCNC, the
+// result is never negative: MOD[-7,3] is 2.
+func mod(p *Parser, args []Value) Value {
+	n := math.Mod(float64(p.wantNumber(args[0])), float64(p.wantNumber(args[1])))
+	if n < 0 {
+		n += math.Abs(float64(p.wantNumber(args[1])))
+	}
+	return Number(n)
+}
+
+func pow(p *Parser, args []Value) Value {
+	return Number(math.Pow(float64(p.wantNumber(args[0])), float64(p.wantNumber(args[1]))))
+}
+
 func round(p *Parser, args []Value) Value {
 	return Number(math.Round(float64(p.wantNumber(args[0]))))
 }
@@ -586,8 +812,31 @@ func (p *Parser) wantNumber(v Value) Number {
 	return n
 }
 
+// ParseError is returned by Parse for errors in parsing or evaluating a line. Line and
+// VirtualLine are the number of lines, counted physically and as tracked by Nnnn, which had been
+// read when the error occurred. Column is the column, starting at 1, of the last byte read; when
+// the error is found at the end of a line, it is the column of the end of the line.
+type ParseError struct {
+	Line        int
+	VirtualLine int
+	Column      int
+	Msg         string
+}
+
+func (pe ParseError) Error() string {
+	if pe.Line == pe.VirtualLine {
+		return fmt.Sprintf("%d: %s", pe.Line, pe.Msg)
+	}
+	return fmt.Sprintf("%d(%d): %s", pe.Line, pe.VirtualLine, pe.Msg)
+}
+
 func (p *Parser) error(msg string) {
-	panic(fmt.Errorf("%s: %s", p.where(), msg))
+	panic(ParseError{
+		Line:        p.physicalLine,
+		VirtualLine: p.virtualLine,
+		Column:      p.column,
+		Msg:         msg,
+	})
 }
 
 func (p *Parser) readByte() byte {
@@ -598,6 +847,14 @@ func (p *Parser) readByte() byte {
 		}
 		p.error(err.Error())
 	}
+
+	p.prevColumn = p.column
+	p.prevEndOfLine = p.endOfLine
+	if p.endOfLine {
+		p.column = 0
+	}
+	p.column += 1
+	p.endOfLine = b == '\n' || b == '\r'
 	return b
 }
 
@@ -606,6 +863,16 @@ func (p *Parser) unreadByte() {
 	if err != nil {
 		p.error(err.Error())
 	}
+	p.column = p.prevColumn
+	p.endOfLine = p.prevEndOfLine
+}
+
+func (p *Parser) warn(msg string) {
+	if p.Warn != nil {
+		p.Warn(p.physicalLine, msg)
+	} else if p.ErrW != nil {
+		fmt.Fprintf(p.ErrW, "warning: %s: %s\n", p.where(), msg)
+	}
 }
 
 func (p *Parser) where() string {
@@ -635,6 +902,10 @@ func (p *Parser) parseNumber() expression {
 		bytes = append(bytes, b)
 	}
 
+	return p.parseDecimal(bytes, neg)
+}
+
+func (p *Parser) parseDecimal(bytes []byte, neg bool) expression {
 	for {
 		b := p.readByte()
 		if b >= '0' && b <= '9' {
@@ -667,6 +938,38 @@ func (p *Parser) parseNumber() expression {
 	return Number(n)
 }
 
+// parsePrefixedInteger parses a number following a leading 0, which might be 0x for hexadecimal
+// or 0b for binary.
+func (p *Parser) parsePrefixedInteger() expression {
+	var base int
+	switch b := p.readByte(); b {
+	case 'x', 'X':
+		base = 16
+	case 'b', 'B':
+		base = 2
+	default:
+		p.unreadByte()
+		return p.parseDecimal([]byte{'0'}, false)
+	}
+
+	var bytes []byte
+	for {
+		b := p.readByte()
+		if (b >= '0' && b <= '9') || (b >= 'a' && b <= 'f') || (b >= 'A' && b <= 'F') {
+			bytes = append(bytes, b)
+		} else {
+			break
+		}
+	}
+	p.unreadByte()
+
+	n, err := strconv.ParseUint(string(bytes), base, 53)
+	if err != nil {
+		p.error(fmt.Sprintf("not a base %d integer: %s", base, string(bytes)))
+	}
+	return Number(n)
+}
+
 func (p *Parser) parseSubExpr() expression {
 	p.skipWhitespace()
 	b := p.readByte()
@@ -679,14 +982,12 @@ func (p *Parser) parseSubExpr() expression {
 	case '!':
 		// ! <expr>
 		e = &unary{op: notOp, expr: p.parseSubExpr()}
-	case '[':
-		// [ <expr> ]
-		e = &unary{op: noOp, expr: p.parseSubExpr()}
-		p.skipWhitespace()
-		b = p.readByte()
-		if b != ']' {
-			p.error(fmt.Sprintf("expected closing brace, got %c", b))
+	case '~':
+		// ~ <expr>
+		if !p.BitwiseOperators {
+			p.error("unexpected ~")
 		}
+		e = &unary{op: bitNotOp, expr: p.parseSubExpr()}
 	case '#':
 		e = p.parseReference()
 	case '<':
@@ -694,6 +995,13 @@ func (p *Parser) parseSubExpr() expression {
 	case '"':
 		e = p.parseString()
 	default:
+		if cb := p.closingBracket(b); cb != 0 {
+			// [ <expr> ]
+			e = &unary{op: noOp, expr: p.parseSubExpr()}
+			p.wantClosingBracket(cb)
+			break
+		}
+
 		b = upcaseByte(b)
 		if b >= 'A' && b <= 'Z' {
 			sym := p.parseSymbol(b)
@@ -701,38 +1009,13 @@ func (p *Parser) parseSubExpr() expression {
 				p.error("expected a function name")
 			}
 
-			fi, ok := calls[sym]
-			if !ok {
-				p.error(fmt.Sprintf("function not found: %s", sym))
-			}
-			p.skipWhitespace()
-			b = p.readByte()
-			if b != '[' {
-				p.error(fmt.Sprintf("expected [ following function name; got %c", b))
-			}
-			c := call{fn: fi.fn}
-
-			p.skipWhitespace()
-			b = p.readByte()
-			if b != ']' {
-				p.unreadByte()
-				for {
-					c.args = append(c.args, p.parseSubExpr())
-					p.skipWhitespace()
-					b = p.readByte()
-					if b == ']' {
-						break
-					} else if b != ',' {
-						p.error("expected a comma (,) between arguments")
-					}
-				}
-			}
-			if len(c.args) != fi.numArgs {
-				p.error(
-					fmt.Sprintf("wrong number of arguments to function %s: got %d, want %d",
-						sym, len(c.args), fi.numArgs))
+			if sym == "EXISTS" {
+				e = p.parseExists()
+			} else {
+				e = p.parseCall(sym)
 			}
-			e = &c
+		} else if b == '0' && p.PrefixedIntegers {
+			e = p.parsePrefixedInteger()
 		} else {
 			p.unreadByte()
 			e = p.parseNumber()
@@ -781,16 +1064,29 @@ func (p *Parser) parseSubExpr() expression {
 		}
 	case '&':
 		b = p.readByte()
-		if b != '&' {
+		if b == '&' {
+			op = andOp
+		} else if p.BitwiseOperators {
+			p.unreadByte()
+			op = bitAndOp
+		} else {
 			p.error(fmt.Sprintf("expected &&, got &%c", b))
 		}
-		op = andOp
 	case '|':
 		b = p.readByte()
-		if b != '|' {
+		if b == '|' {
+			op = orOp
+		} else if p.BitwiseOperators {
+			p.unreadByte()
+			op = bitOrOp
+		} else {
 			p.error(fmt.Sprintf("expected ||, got |%c", b))
 		}
-		op = orOp
+	case 'X', 'x':
+		if p.parseSymbol('X') != "XOR" {
+			p.error("expected XOR")
+		}
+		op = xorOp
 	default:
 		p.unreadByte()
 		return e
@@ -799,6 +1095,83 @@ func (p *Parser) parseSubExpr() expression {
 	return &binary{op: op, left: e, right: p.parseSubExpr()}
 }
 
+func (p *Parser) parseCall(sym string) expression {
+	fi, ok := calls[sym]
+	if !ok {
+		p.error(fmt.Sprintf("function not found: %s", sym))
+	}
+	p.skipWhitespace()
+	b := p.readByte()
+	cb := p.closingBracket(b)
+	if cb == 0 {
+		p.error(fmt.Sprintf("expected [ following function name; got %c", b))
+	}
+	c := call{fn: fi.fn}
+
+	p.skipWhitespace()
+	b = p.readByte()
+	if b != cb {
+		p.unreadByte()
+		for {
+			c.args = append(c.args, p.parseSubExpr())
+			p.skipWhitespace()
+			b = p.readByte()
+			if b == cb {
+				break
+			} else if b != ',' {
+				p.error("expected a comma (,) between arguments")
+			}
+		}
+	}
+	if sym == "ATAN" && len(c.args) == 1 && p.Features.HasLinuxCNC() {
+		// LinuxCNC: ATAN '[' <sub-expr> ']' '/' '[' <sub-expr> ']'; for other dialects,
+		// ATAN[y]/[x] remains a division.
+		p.skipWhitespace()
+		if p.readByte() == '/' {
+			p.skipWhitespace()
+			b = p.readByte()
+			cb = p.closingBracket(b)
+			if cb == 0 {
+				// ATAN[y] / <sub-expr> is a division.
+				p.unreadByte()
+				return &binary{op: divideOp, left: &c, right: p.parseSubExpr()}
+			}
+			c.args = append(c.args, p.parseSubExpr())
+			p.wantClosingBracket(cb)
+		} else {
+			p.unreadByte()
+		}
+	}
+	if fi.maxArgs > 0 && (len(c.args) < fi.numArgs || len(c.args) > fi.maxArgs) {
+		p.error(
+			fmt.Sprintf("wrong number of arguments to function %s: got %d, want %d to %d",
+				sym, len(c.args), fi.numArgs, fi.maxArgs))
+	} else if fi.maxArgs == 0 && len(c.args) != fi.numArgs {
+		p.error(
+			fmt.Sprintf("wrong number of arguments to function %s: got %d, want %d",
+				sym, len(c.args), fi.numArgs))
+	}
+	return &c
+}
+
+func (p *Parser) parseExists() expression {
+	// EXISTS '[' <reference> ']'
+
+	p.skipWhitespace()
+	b := p.readByte()
+	cb := p.closingBracket(b)
+	if cb == 0 {
+		p.error(fmt.Sprintf("expected [ following function name; got %c", b))
+	}
+	p.skipWhitespace()
+	if p.readByte() != '#' {
+		p.error("expected a parameter reference following EXISTS")
+	}
+	prm := p.parseReference().(param)
+	p.wantClosingBracket(cb)
+	return exists{prm: prm}
+}
+
 func adjustPrecedence(e expression) expression {
 	switch e := e.(type) {
 	case *unary:
@@ -849,31 +1222,75 @@ func (p *Parser) parseReference() expression {
 	}
 	p.unreadByte()
 
-	if b == '[' {
+	maxRefs := p.MaxReferences
+	if maxRefs <= 0 {
+		maxRefs = defaultMaxReferences
+	}
+	if refs > maxRefs {
+		p.error(fmt.Sprintf("too many parameter references: %d > %d", refs, maxRefs))
+	}
+
+	if p.closingBracket(b) != 0 {
 		return param{refs: refs, expr: p.parseExpr()}
 	}
 
 	return param{refs: refs, expr: p.parseParameter(p.Scanner).(expression)}
 }
 
+// parseCodeExpr parses the expression following the letter of a code.
+func (p *Parser) parseCodeExpr(letter Letter) expression {
+	p.skipWhitespace()
+	if p.readByte() == '=' {
+		p.error(fmt.Sprintf("assignment operator not valid after a code word: %c=", letter))
+	}
+	p.unreadByte()
+
+	return p.parseExpr()
+}
+
+// closingBracket returns the byte which closes an expression opened by b, or 0 if b does not
+// open an expression. RepRap uses {} as well as [] for expressions.
+func (p *Parser) closingBracket(b byte) byte {
+	if b == '[' {
+		return ']'
+	} else if b == '{' && p.Features.HasRepRap() {
+		return '}'
+	}
+	return 0
+}
+
+func (p *Parser) wantClosingBracket(cb byte) {
+	p.skipWhitespace()
+	b := p.readByte()
+	if b != cb {
+		p.error(fmt.Sprintf("expected closing brace %c, got %c", cb, b))
+	}
+}
+
 func (p *Parser) parseExpr() expression {
 	p.skipWhitespace()
 	b := p.readByte()
+	if cb := p.closingBracket(b); cb != 0 {
+		e := adjustPrecedence(p.parseSubExpr())
+		p.wantClosingBracket(cb)
+		return e
+	}
+
 	switch b {
 	case '#':
 		return p.parseReference()
-	case '[':
-		e := adjustPrecedence(p.parseSubExpr())
-		p.skipWhitespace()
-		b = p.readByte()
-		if b != ']' {
-			p.error(fmt.Sprintf("expected closing brace, got %c", b))
-		}
-		return e
 	case '<':
 		return p.parseName()
 	case '"':
 		return p.parseString()
+	case '-':
+		// - #nnn and - [ <expr> ]
+		b = p.readByte()
+		p.unreadByte()
+		if b == '#' || p.closingBracket(b) != 0 {
+			return &unary{op: negateOp, expr: p.parseExpr()}
+		}
+		return p.parseDecimal(nil, true)
 	default:
 		p.unreadByte()
 		return p.parseNumber()
@@ -1220,6 +1637,116 @@ func (p *Parser) parseIfBeagleG() action {
 	}
 }
 
+func (p *Parser) parseOCodeLinuxCNC() action {
+	// 'O' <o-label> ('SUB' | 'ENDSUB' | 'RETURN' | 'CALL' <expr>*)
+
+	if p.lineState != beforeLineNum && p.lineState != afterLineNum {
+		p.error("O must be first on line")
+	}
+	p.lineState = inBody
+
+	var label string
+	if p.readByte() == '<' {
+		label = fmt.Sprintf("<%s>", p.parseName())
+	} else {
+		p.unreadByte()
+		label = fmt.Sprintf("%d", p.wantInteger())
+	}
+
+	p.skipWhitespace()
+	switch p.parseSymbol(upcaseByte(p.readByte())) {
+	case "SUB":
+		return p.parseSubLinuxCNC(label)
+	case "ENDSUB":
+		if p.sub == "" {
+			p.error(fmt.Sprintf("unexpected O%s endsub, no matching sub", label))
+		} else if p.sub != label {
+			p.error(fmt.Sprintf("expected O%s endsub, got O%s endsub", p.sub, label))
+		}
+		return endSubActionLinuxCNC{}
+	case "RETURN":
+		if p.sub == "" {
+			p.error(fmt.Sprintf("unexpected O%s return, not in a subroutine", label))
+		} else if p.sub != label {
+			p.error(fmt.Sprintf("expected O%s return, got O%s return", p.sub, label))
+		}
+		return returnActionLinuxCNC{}
+	case "CALL":
+		var args []expression
+		for {
+			p.skipWhitespace()
+			b := p.readByte()
+			p.unreadByte()
+			if b == '\n' || b == '\r' || b == ';' || b == '(' || b == '*' {
+				break
+			}
+			if len(args) == maxSubParams {
+				p.error(fmt.Sprintf("too many arguments to O%s: more than %d", label,
+					maxSubParams))
+			}
+			args = append(args, p.parseExpr())
+		}
+		return callActionLinuxCNC{label: label, args: args}
+	}
+
+	p.error(fmt.Sprintf("expected keyword SUB, ENDSUB, RETURN, or CALL following O%s", label))
+	return nil
+}
+
+func (p *Parser) parseSubLinuxCNC(label string) action {
+	// 'SUB' <suffix> <line>* 'O' <o-label> 'ENDSUB'
+
+	if p.sub != "" {
+		p.error(fmt.Sprintf("O%s sub not allowed within O%s sub", label, p.sub))
+	}
+	p.sub = label
+
+	defer func() {
+		if r := recover(); r != nil {
+			if r == io.EOF {
+				p.error(fmt.Sprintf("missing O%s endsub", label))
+			}
+			panic(r)
+		}
+	}()
+
+	var actions []action
+	for {
+		act := p.parse()
+		actions = append(actions, act)
+		if _, ok := act.(endSubActionLinuxCNC); ok {
+			break
+		}
+	}
+
+	p.sub = ""
+	return subActionLinuxCNC{label: label, actions: actions}
+}
+
+var (
+	keywordsBeagleG  = []string{"DO", "ELSE", "ELSEIF", "END", "IF", "THEN", "WHILE"}
+	keywordsLinuxCNC = []string{"CALL", "ENDSUB", "RETURN", "SUB"}
+)
+
+// Keywords returns the keywords, in sorted order, which are recognized for the features of the
+// parser: WHILE, IF, and the keywords which go with them for BeagleG, and the keywords which
+// follow O-words, such as SUB and CALL, for LinuxCNC.
+func (p *Parser) Keywords() []string {
+	var keywords []string
+	if p.Features.HasBeagleG() {
+		keywords = append(keywords, keywordsBeagleG...)
+	}
+	if p.Features.HasLinuxCNC() {
+		keywords = append(keywords, keywordsLinuxCNC...)
+	}
+	sort.Strings(keywords)
+	return keywords
+}
+
+func (p *Parser) hasComments() bool {
+	return p.Features.HasLinuxCNC() || (p.BeagleGComments && p.Features.HasBeagleG())
+}
+
 func (p *Parser) parseComment(comment string, inline bool) action {
 	subs := strings.SplitN(comment, ",", 2)
 	if len(subs) != 2 {
@@ -1229,11 +1756,17 @@ func (p *Parser) parseComment(comment string, inline bool) action {
 	var hasParams bool
 	cmd := strings.ToLower(subs[0])
 	body := subs[1]
+	if fn, ok := p.CommentHandlers[cmd]; ok {
+		return commentHandlerAction{
+			fn:   fn,
+			body: body,
+		}
+	} else if !p.hasComments() {
+		return nil
+	}
+
 	switch cmd {
 	case "msg":
-		if p.OutW == nil {
-			return nil
-		}
 	case "debug":
 		if p.OutW == nil || p.noDebugOutput {
 			return nil
@@ -1376,7 +1909,14 @@ func (p *Parser) evaluateComment(w io.Writer, body string) {
 		}
 	}
 
-	fmt.Fprintln(w)
+	io.WriteString(w, p.lineTerminator())
+}
+
+func (p *Parser) lineTerminator() string {
+	if p.LineTerminator == "" {
+		return "\n"
+	}
+	return p.LineTerminator
 }
 
 func (ca commentAction) evaluate(p *Parser, codes []Code, endFuncs []endFunc) ([]Code, []endFunc,
@@ -1384,18 +1924,21 @@ func (ca commentAction) evaluate(p *Parser, codes []Code, endFuncs []endFunc) ([
 
 	switch ca.cmd {
 	case "msg":
-		fmt.Fprintln(p.OutW, ca.body)
+		p.message = ca.body
+		if p.OutW != nil {
+			io.WriteString(p.OutW, ca.body+p.lineTerminator())
+		}
 	case "debug":
 		if ca.hasParams {
 			p.evaluateComment(p.OutW, ca.body)
 		} else {
-			fmt.Fprintln(p.OutW, ca.body)
+			io.WriteString(p.OutW, ca.body+p.lineTerminator())
 		}
 	case "print":
 		if ca.hasParams {
 			p.evaluateComment(p.ErrW, ca.body)
 		} else {
-			fmt.Fprintln(p.ErrW, ca.body)
+			io.WriteString(p.ErrW, ca.body+p.lineTerminator())
 		}
 	default:
 		panic(fmt.Sprintf("unexpected comment cmd: %s", ca.cmd))
@@ -1404,6 +1947,21 @@ func (ca commentAction) evaluate(p *Parser, codes []Code, endFuncs []endFunc) ([
 	return codes, endFuncs, false
 }
 
+type commentHandlerAction struct {
+	fn   func(body string) error
+	body string
+}
+
+func (cha commentHandlerAction) evaluate(p *Parser, codes []Code, endFuncs []endFunc) ([]Code,
+	[]endFunc, bool) {
+
+	err := cha.fn(cha.body)
+	if err != nil {
+		p.error(err.Error())
+	}
+	return codes, endFuncs, false
+}
+
 type whileActionBeagleG struct {
 	whileTest expression
 	actions   []action
@@ -1412,7 +1970,7 @@ type whileActionBeagleG struct {
 func (wa *whileActionBeagleG) evaluate(p *Parser, codes []Code, endFuncs []endFunc) ([]Code,
 	[]endFunc, bool) {
 
-	if !Number(0).Equal(p.wantNumber(wa.whileTest.evaluate(p))) {
+	if isTrue(p.wantNumber(wa.whileTest.evaluate(p))) {
 		p.stack = &stackFrame{
 			actions: wa.actions,
 			next:    p.stack,
@@ -1443,12 +2001,12 @@ type ifActionBeagleG struct {
 func (ia ifActionBeagleG) evaluate(p *Parser, codes []Code, endFuncs []endFunc) ([]Code,
 	[]endFunc, bool) {
 
-	if !Number(0).Equal(p.wantNumber(ia.ifTest.evaluate(p))) {
+	if isTrue(p.wantNumber(ia.ifTest.evaluate(p))) {
 		return ia.thenAssign.evaluate(p, codes, endFuncs)
 	}
 
 	for edx := range ia.elseifTests {
-		if math.Abs(float64(p.wantNumber(ia.elseifTests[edx].evaluate(p)))) >= minimumDelta {
+		if isTrue(p.wantNumber(ia.elseifTests[edx].evaluate(p))) {
 			return ia.elseifAssigns[edx].evaluate(p, codes, endFuncs)
 		}
 	}
@@ -1459,6 +2017,82 @@ func (ia ifActionBeagleG) evaluate(p *Parser, codes []Code, endFuncs []endFunc)
 	return codes, endFuncs, false
 }
 
+type subActionLinuxCNC struct {
+	label   string
+	actions []action
+}
+
+func (sa subActionLinuxCNC) evaluate(p *Parser, codes []Code, endFuncs []endFunc) ([]Code,
+	[]endFunc, bool) {
+
+	if p.subs == nil {
+		p.subs = map[string][]action{}
+	} else if _, ok := p.subs[sa.label]; ok {
+		p.warn(fmt.Sprintf("subroutine O%s redefined", sa.label))
+	}
+	p.subs[sa.label] = sa.actions
+	return codes, endFuncs, false
+}
+
+type callActionLinuxCNC struct {
+	label string
+	args  []expression
+}
+
+func (ca callActionLinuxCNC) evaluate(p *Parser, codes []Code, endFuncs []endFunc) ([]Code,
+	[]endFunc, bool) {
+
+	actions, ok := p.subs[ca.label]
+	if !ok {
+		p.error(fmt.Sprintf("subroutine O%s not defined", ca.label))
+	}
+
+	// Evaluate the arguments before the call so that they may refer to the caller's parameters.
+	cf := &callFrame{names: map[Name]Value{}, next: p.calls}
+	for adx, arg := range ca.args {
+		cf.params[adx] = p.wantNumber(arg.evaluate(p))
+	}
+	p.calls = cf
+	p.stack = &stackFrame{
+		actions: actions,
+		call:    true,
+		next:    p.stack,
+	}
+
+	return codes, endFuncs, false
+}
+
+type returnActionLinuxCNC struct{}
+
+func (ra returnActionLinuxCNC) evaluate(p *Parser, codes []Code, endFuncs []endFunc) ([]Code,
+	[]endFunc, bool) {
+
+	// Discard the rest of the subroutine, including any loops within it.
+	for {
+		sf := p.stack
+		p.stack = sf.next
+		if sf.call {
+			break
+		}
+	}
+	p.calls = p.calls.next
+
+	return codes, endFuncs, false
+}
+
+type endSubActionLinuxCNC struct{}
+
+func (ea endSubActionLinuxCNC) evaluate(p *Parser, codes []Code, endFuncs []endFunc) ([]Code,
+	[]endFunc, bool) {
+
+	if p.calls == nil {
+		p.error("unexpected endsub, not in a subroutine")
+	}
+	p.calls = p.calls.next
+
+	return codes, endFuncs, false
+}
+
 type eolAction struct{}
 
 func (ea eolAction) evaluate(p *Parser, codes []Code, endFuncs []endFunc) ([]Code, []endFunc,
@@ -1470,12 +2104,21 @@ func (ea eolAction) evaluate(p *Parser, codes []Code, endFuncs []endFunc) ([]Cod
 	return codes, nil, true
 }
 
+func (p *Parser) checkChecksum() {
+	if p.RequireChecksum && p.Features.HasRepRap() &&
+		(p.lineState == afterLineNum || p.lineState == inBody) {
+
+		p.error("expected a checksum (*nnn) at end of line")
+	}
+}
+
 func (p *Parser) parse() action {
 	for {
 		p.skipWhitespace()
 		b := upcaseByte(p.readByte())
 
 		if b == '\n' || b == '\r' {
+			p.checkChecksum()
 			p.lineState = beforeLineNum
 			p.physicalLine += 1
 			p.virtualLine += 1
@@ -1486,6 +2129,7 @@ func (p *Parser) parse() action {
 			for {
 				b := p.readByte()
 				if b == '\n' || b == '\r' {
+					p.checkChecksum()
 					p.lineState = beforeLineNum
 					p.physicalLine += 1
 					p.virtualLine += 1
@@ -1494,7 +2138,7 @@ func (p *Parser) parse() action {
 				bytes = append(bytes, b)
 			}
 
-			if p.Features.HasLinuxCNC() {
+			if p.hasComments() || len(p.CommentHandlers) > 0 {
 				act := p.parseComment(string(bytes), false)
 				if act != nil {
 					p.unreadByte()
@@ -1515,7 +2159,7 @@ func (p *Parser) parse() action {
 				bytes = append(bytes, b)
 			}
 
-			if p.Features.HasLinuxCNC() {
+			if p.hasComments() || len(p.CommentHandlers) > 0 {
 				act := p.parseComment(string(bytes), true)
 				if act != nil {
 					return act
@@ -1533,6 +2177,22 @@ func (p *Parser) parse() action {
 			p.lineState = inBody
 
 			return p.parseAssignment()
+		} else if b == '$' && p.Features.HasLinuxCNC() {
+			if p.lineState == afterChecksum {
+				p.error("checksum (*nnn) must be at end of line")
+			}
+			p.lineState = inBody
+
+			// Parse $n to select a spindle.
+			return codeAction{letter: Letter(b), expr: p.parseCodeExpr(Letter(b))}
+		} else if (b == '@' || b == '^') && p.Features.HasPolar() {
+			if p.lineState == afterChecksum {
+				p.error("checksum (*nnn) must be at end of line")
+			}
+			p.lineState = inBody
+
+			// Parse @nnn (radius) and ^nnn (angle).
+			return codeAction{letter: Letter(b), expr: p.parseCodeExpr(Letter(b))}
 		} else if b < 'A' || b > 'Z' {
 			p.error(fmt.Sprintf("unexpected command: %d", b))
 		} else if kw := p.parseSymbol(b); kw != "" {
@@ -1556,6 +2216,8 @@ func (p *Parser) parse() action {
 			}
 
 			p.error("unexpected keyword")
+		} else if b == 'O' && p.Features.HasLinuxCNC() {
+			return p.parseOCodeLinuxCNC()
 		} else if b == 'N' {
 			// Parse Nnnn.
 
@@ -1563,7 +2225,19 @@ func (p *Parser) parse() action {
 				p.error("N must be first on line")
 			}
 
-			num := p.wantInteger()
+			var num int
+			if p.LineNumberExpr {
+				n := p.wantNumber(p.parseExpr().evaluate(p))
+				var ok bool
+				num, ok = n.AsInteger()
+				if !ok {
+					p.error(fmt.Sprintf("expected an integer line number: N%s", n))
+				} else if num > math.MaxInt32 {
+					p.error("number too big")
+				}
+			} else {
+				num = p.wantInteger()
+			}
 			if num <= p.virtualLine {
 				p.error(fmt.Sprintf("N%d invalid", num))
 			}
@@ -1577,7 +2251,7 @@ func (p *Parser) parse() action {
 			p.lineState = inBody
 
 			// Parse all the other letters (A to Z except N).
-			return codeAction{letter: Letter(b), expr: p.parseExpr()}
+			return codeAction{letter: Letter(b), expr: p.parseCodeExpr(Letter(b))}
 		}
 	}
 }
@@ -100,6 +100,34 @@ func TestParser(t *testing.T) {
 	}
 }
 
+func TestCodeAssignment(t *testing.T) {
+	cases := []string{
+		"G=\n",
+		"X=5\n",
+		"G0 X =5\n",
+		"G1\nY=[1+2]\n",
+	}
+
+	for _, c := range cases {
+		p := Parser{
+			Scanner:  strings.NewReader(c),
+			Features: AllFeatures,
+		}
+
+		var err error
+		for err == nil {
+			_, err = p.Parse()
+		}
+		if err == io.EOF {
+			t.Errorf("Parse(%s) did not fail", c)
+		} else if !strings.Contains(err.Error(),
+			"assignment operator not valid after a code word") {
+
+			t.Errorf("Parse(%s) failed with %s", c, err)
+		}
+	}
+}
+
 func TestParserLines(t *testing.T) {
 	cases := []struct {
 		s     string
@@ -145,6 +173,313 @@ G14 X1 Y2 ; comment
 	}
 }
 
+func TestLineNumberExpr(t *testing.T) {
+	cases := []struct {
+		s     string
+		expr  bool
+		fail  bool
+		codes []Code
+	}{
+		{s: "#1=10\nN#1 G0 X1\n", expr: true, codes: []Code{{'G', Number(0)}, {'X', Number(1)}}},
+		{s: "#1=10\nN[#1 + 1] G0 X1\n", expr: true,
+			codes: []Code{{'G', Number(0)}, {'X', Number(1)}}},
+		{s: "N10 G0 X1\n", codes: []Code{{'G', Number(0)}, {'X', Number(1)}}},
+		{s: "#1=10.5\nN#1 G0 X1\n", fail: true},
+		{s: "#1=0\nN#1 G0 X1\n", fail: true},
+		{s: "N#2 G0 X1\n", fail: true},
+		{s: "N<abc> G0 X1\n", fail: true},
+	}
+
+	for _, lineNumberExpr := range []bool{true, false} {
+		for _, c := range cases {
+			numParams := map[int]Number{}
+			p := Parser{
+				Scanner:  strings.NewReader(c.s),
+				Features: AllFeatures,
+				GetNumParam: func(num int) (Number, bool) {
+					n, ok := numParams[num]
+					return n, ok
+				},
+				SetNumParam: func(num int, val Number) error {
+					numParams[num] = val
+					return nil
+				},
+				LineNumberExpr: lineNumberExpr,
+			}
+
+			codes, err := p.Parse()
+			if c.fail || (c.expr && !lineNumberExpr) {
+				if err == nil {
+					t.Errorf("Parse(%s, %v) did not fail", c.s, lineNumberExpr)
+				}
+			} else if err != nil {
+				t.Errorf("Parse(%s, %v) failed with %s", c.s, lineNumberExpr, err)
+			} else if !codesEqual(codes, c.codes) {
+				t.Errorf("Parse(%s, %v): got %v want %v", c.s, lineNumberExpr, codes, c.codes)
+			}
+		}
+	}
+}
+
+func TestLineNumberExprLoop(t *testing.T) {
+	numParams := map[int]Number{101: 1, 102: 2}
+	p := Parser{
+		Scanner: strings.NewReader(
+			"#1=10\nWHILE [#1 < 13] DO\n#1=[#1 + 1]\nN[#1 * 10] G0 X#[#1 + 90]\nEND\n"),
+		Features: BeagleG,
+		GetNumParam: func(num int) (Number, bool) {
+			n, ok := numParams[num]
+			return n, ok
+		},
+		SetNumParam: func(num int, val Number) error {
+			numParams[num] = val
+			return nil
+		},
+		LineNumberExpr: true,
+	}
+
+	for _, want := range [][]Code{
+		{{'G', Number(0)}, {'X', Number(1)}},
+		{{'G', Number(0)}, {'X', Number(2)}},
+	} {
+		codes, err := p.Parse()
+		if err != nil {
+			t.Fatalf("Parse() failed with %s", err)
+		} else if !codesEqual(codes, want) {
+			t.Errorf("Parse(): got %v want %v", codes, want)
+		}
+	}
+
+	// The line number was evaluated when the loop was parsed, when #1 was 10, so it is N100
+	// rather than N130 for the third time through the loop.
+	_, err := p.Parse()
+	if err == nil {
+		t.Errorf("Parse() did not fail")
+	} else if !strings.Contains(err.Error(), "(100): ") {
+		t.Errorf("Parse(): got %s want line N100", err)
+	}
+}
+
+func TestPrefixedIntegers(t *testing.T) {
+	cases := []struct {
+		s    string
+		fail bool
+		val  Number
+	}{
+		{s: "#1=[0x10]\n", val: 16},
+		{s: "#1=[0x10==16]\n", val: 1},
+		{s: "#1=[0b101]\n", val: 5},
+		{s: "#1=[0b101==5]\n", val: 1},
+		{s: "#1=[0XfF + 0B11]\n", val: 258},
+		{s: "#1=[-0x10]\n", val: -16},
+		{s: "#1=[0.5 + 0]\n", val: 0.5},
+		{s: "#1=[0x]\n", fail: true},
+		{s: "#1=[0b102]\n", fail: true},
+		{s: "#1=[0xG]\n", fail: true},
+	}
+
+	for _, prefixed := range []bool{true, false} {
+		for _, c := range cases {
+			numParams := map[int]Number{}
+			p := Parser{
+				Scanner:  strings.NewReader(c.s),
+				Features: AllFeatures,
+				GetNumParam: func(num int) (Number, bool) {
+					n, ok := numParams[num]
+					return n, ok
+				},
+				SetNumParam: func(num int, val Number) error {
+					numParams[num] = val
+					return nil
+				},
+				PrefixedIntegers: prefixed,
+			}
+
+			_, err := p.Parse()
+			if c.fail || (!prefixed && strings.ContainsAny(c.s, "xXbB")) {
+				if err == nil || err == io.EOF {
+					t.Errorf("Parse(%s, %v) did not fail", c.s, prefixed)
+				}
+			} else if err != nil && err != io.EOF {
+				t.Errorf("Parse(%s, %v) failed with %s", c.s, prefixed, err)
+			} else if numParams[1] != c.val {
+				t.Errorf("Parse(%s, %v): got %s want %s", c.s, prefixed, numParams[1], c.val)
+			}
+		}
+	}
+}
+
+func TestBitwiseOperators(t *testing.T) {
+	cases := []struct {
+		s       string
+		bitwise bool
+		fail    bool
+		val     Number
+	}{
+		{s: "#1=[[6 & 3]==2]\n", bitwise: true, val: 1},
+		{s: "#1=[[5 | 2]==7]\n", bitwise: true, val: 1},
+		{s: "#1=[6 & 3]\n", bitwise: true, val: 2},
+		{s: "#1=[5 | 2]\n", bitwise: true, val: 7},
+		{s: "#1=[~5]\n", bitwise: true, val: -6},
+		{s: "#1=[~5 & 7]\n", bitwise: true, val: 2},
+		{s: "#1=[1 | 6 & 3]\n", bitwise: true, val: 3},
+		{s: "#1=[4 | 1 + 2]\n", bitwise: true, val: 7},
+		{s: "#1=[6 & 3 == 2]\n", bitwise: true, val: 1},
+		{s: "#1=[1 && 2]\n", bitwise: true, val: 1},
+		{s: "#1=[0 || 2]\n", bitwise: true, val: 1},
+		{s: "#1=[1 && 2]\n", val: 1},
+		{s: "#1=[0 || 0]\n", val: 0},
+		{s: "#1=[1.5 & 1]\n", bitwise: true, fail: true},
+		{s: "#1=[6 & 3]\n", fail: true},
+		{s: "#1=[5 | 2]\n", fail: true},
+		{s: "#1=[~5]\n", fail: true},
+	}
+
+	for _, c := range cases {
+		numParams := map[int]Number{}
+		p := Parser{
+			Scanner:  strings.NewReader(c.s),
+			Features: AllFeatures,
+			GetNumParam: func(num int) (Number, bool) {
+				n, ok := numParams[num]
+				return n, ok
+			},
+			SetNumParam: func(num int, val Number) error {
+				numParams[num] = val
+				return nil
+			},
+			BitwiseOperators: c.bitwise,
+		}
+
+		_, err := p.Parse()
+		if c.fail {
+			if err == nil || err == io.EOF {
+				t.Errorf("Parse(%s, %v) did not fail", c.s, c.bitwise)
+			}
+		} else if err != nil && err != io.EOF {
+			t.Errorf("Parse(%s, %v) failed with %s", c.s, c.bitwise, err)
+		} else if numParams[1] != c.val {
+			t.Errorf("Parse(%s, %v): got %s want %s", c.s, c.bitwise, numParams[1], c.val)
+		}
+	}
+}
+
+func TestRepRapBraces(t *testing.T) {
+	cases := []struct {
+		s      string
+		reprap bool
+		fail   bool
+		code   Code
+		val    Number
+	}{
+		{s: "G{1+2}\n", reprap: true, code: Code{'G', Number(3)}},
+		{s: "G{1+2}\n", fail: true},
+		{s: "G[1+2]\n", reprap: true, code: Code{'G', Number(3)}},
+		{s: "G[1+2]\n", code: Code{'G', Number(3)}},
+		{s: "G-{1+2}\n", reprap: true, code: Code{'G', Number(-3)}},
+		{s: "G{{1+2}*[3+4]}\n", reprap: true, code: Code{'G', Number(21)}},
+		{s: "G{ABS{-2}}\n", reprap: true, code: Code{'G', Number(2)}},
+		{s: "G{#1}\n", reprap: true, code: Code{'G', Number(5)}},
+		{s: "G#{1}\n", reprap: true, code: Code{'G', Number(5)}},
+		{s: "#1={2*3}\n", reprap: true, val: 6},
+		{s: "#1={2*3}\n", fail: true},
+		{s: "G{1+2]\n", reprap: true, fail: true},
+		{s: "G[1+2}\n", reprap: true, fail: true},
+		{s: "G{[1+2}]\n", reprap: true, fail: true},
+		{s: "G{ABS[-2}}\n", reprap: true, fail: true},
+	}
+
+	for _, c := range cases {
+		numParams := map[int]Number{1: 5}
+		f := BeagleG | LinuxCNC
+		if c.reprap {
+			f = RepRap
+		}
+		p := Parser{
+			Scanner:  strings.NewReader(c.s),
+			Features: f,
+			GetNumParam: func(num int) (Number, bool) {
+				n, ok := numParams[num]
+				return n, ok
+			},
+			SetNumParam: func(num int, val Number) error {
+				numParams[num] = val
+				return nil
+			},
+		}
+
+		codes, err := p.Parse()
+		if c.fail {
+			if err == nil || err == io.EOF {
+				t.Errorf("Parse(%s, %v) did not fail", c.s, c.reprap)
+			}
+		} else if err != nil && err != io.EOF {
+			t.Errorf("Parse(%s, %v) failed with %s", c.s, c.reprap, err)
+		} else if c.code.Letter != 0 {
+			if len(codes) != 1 || codes[0] != c.code {
+				t.Errorf("Parse(%s, %v): got %v want %v", c.s, c.reprap, codes, c.code)
+			}
+		} else if numParams[1] != c.val {
+			t.Errorf("Parse(%s, %v): got %s want %s", c.s, c.reprap, numParams[1], c.val)
+		}
+	}
+}
+
+func TestMaxReferences(t *testing.T) {
+	cases := []struct {
+		s       string
+		maxRefs int
+		fail    bool
+		codes   []Code
+	}{
+		{s: "#1=2\n#2=3\n#3=4\nG0 X###1\n", codes: []Code{{'G', Number(0)}, {'X', Number(4)}}},
+		{s: "#1=2\n#2=3\n#3=4\nG0 X###1\n", maxRefs: 3,
+			codes: []Code{{'G', Number(0)}, {'X', Number(4)}}},
+		{s: "#1=2\n#2=3\n#3=4\nG0 X###1\n", maxRefs: 2, fail: true},
+		{s: "#1=1\nG0 X" + strings.Repeat("#", defaultMaxReferences) + "1\n",
+			codes: []Code{{'G', Number(0)}, {'X', Number(1)}}},
+		{s: "#1=1\nG0 X" + strings.Repeat("#", defaultMaxReferences+1) + "1\n", fail: true},
+		{s: "#1=1\nG0 X" + strings.Repeat("#", 1000) + "1\n", fail: true},
+	}
+
+	for _, c := range cases {
+		numParams := map[int]Number{}
+		p := Parser{
+			Scanner:  strings.NewReader(c.s),
+			Features: AllFeatures,
+			GetNumParam: func(num int) (Number, bool) {
+				n, ok := numParams[num]
+				return n, ok
+			},
+			SetNumParam: func(num int, val Number) error {
+				numParams[num] = val
+				return nil
+			},
+			MaxReferences: c.maxRefs,
+		}
+
+		var codes []Code
+		var err error
+		for {
+			codes, err = p.Parse()
+			if err != nil || len(codes) > 0 {
+				break
+			}
+		}
+		if c.fail {
+			if err == nil {
+				t.Errorf("Parse(%s, %d) did not fail", c.s, c.maxRefs)
+			} else if !strings.Contains(err.Error(), "too many parameter references") {
+				t.Errorf("Parse(%s, %d) failed with %s", c.s, c.maxRefs, err)
+			}
+		} else if err != nil {
+			t.Errorf("Parse(%s, %d) failed with %s", c.s, c.maxRefs, err)
+		} else if !codesEqual(codes, c.codes) {
+			t.Errorf("Parse(%s, %d): got %v want %v", c.s, c.maxRefs, codes, c.codes)
+		}
+	}
+}
+
 func parseParameter(p *Parser) (num int, nam string, err error) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -458,6 +793,13 @@ func TestParseIfBeagleG(t *testing.T) {
 			num: 100, val: 3},
 		{s: "#100=0\nIF 0 THEN #100=1 ELSEIF 0 THEN #100=2 ELSEIF 0 THEN #100=3 ELSE #100=4\nG1\n",
 			num: 100, val: 4},
+
+		{s: "#100=0\nIF 0.00001 THEN #100=1 ELSEIF 0.00001 THEN #100=2 ELSE #100=3\nG1\n",
+			num: 100, val: 3},
+		{s: "#100=0\nIF -0.00001 THEN #100=1 ELSEIF 0.001 THEN #100=2 ELSE #100=3\nG1\n",
+			num: 100, val: 2},
+		{s: "#100=0\nIF 0.001 THEN #100=1 ELSEIF 1 THEN #100=2 ELSE #100=3\nG1\n",
+			num: 100, val: 1},
 	}
 
 	for _, c := range cases {
@@ -505,6 +847,8 @@ func TestParseWhileBeagleG(t *testing.T) {
 		{s: "WHILE 0 DO\n#100=1\n", fail: true},
 		{s: "WHILE DO\n", fail: true},
 		{s: "WHILE 0 DO\n#100=1\nEND G1\n", fail: true},
+		{s: "#100=0\nWHILE 0.00001 DO\n#100=1\nEND\nG1\n", num: 100, val: 0},
+		{s: "#100=0\n#200=0.001\nWHILE #200 DO\n#100=1\n#200=0\nEND\nG1\n", num: 100, val: 1},
 		{s: `
 #100=0
 WHILE [#100 < 10] DO
@@ -568,6 +912,183 @@ G1
 	}
 }
 
+func TestParseSubLinuxCNC(t *testing.T) {
+	cases := []struct {
+		s     string
+		codes []Code
+		vals  map[int]Number
+		fail  bool
+	}{
+		{s: "O100 endsub\n", fail: true},
+		{s: "O100 return\n", fail: true},
+		{s: "O100 call\n", fail: true},
+		{s: "O100 sub\nG1\n", fail: true},
+		{s: "O100 sub\nO200 sub\nO200 endsub\nO100 endsub\n", fail: true},
+		{s: "O100 sub\nO200 endsub\n", fail: true},
+		{s: "O100 sub\nO200 return\nO100 endsub\n", fail: true},
+		{s: "O100 foo\n", fail: true},
+		{s: "G1 O100 call\n", fail: true},
+		{s: "O100 sub\nO100 endsub\nO100 call" + strings.Repeat(" [1]", 31) + "\n",
+			fail: true},
+		{s: `
+#31=1
+O100 sub
+    #31=2
+O100 endsub
+`, vals: map[int]Number{31: 1}},
+		{s: `
+#1=5
+#31=0
+O100 sub
+    #1=[#1*2]
+    #31=#1
+O100 endsub
+O100 call [7]
+`, vals: map[int]Number{1: 5, 31: 14}},
+		{s: `
+#1=3
+O100 sub
+    #31=[#1+#2]
+    #32=#3
+O100 endsub
+O100 call [#1*2] [4]
+`, vals: map[int]Number{1: 3, 31: 10, 32: 0}},
+		{s: `
+o<foo> sub
+    #31=1
+    o<foo> return
+    #31=2
+o<foo> endsub
+O<FOO> call
+`, vals: map[int]Number{31: 1}},
+		{s: `
+O200 sub
+    #31=#1
+O200 endsub
+O100 sub
+    O200 call [#1+1]
+    #32=#1
+O100 endsub
+N10 O100 call [1]
+`, vals: map[int]Number{31: 2, 32: 1}},
+		{s: `
+O100 sub
+    G1 X#1
+O100 endsub
+O100 call [1]
+O100 call [2]
+G0 X3
+`, codes: []Code{{'G', Number(1)}, {'X', Number(1)}, {'G', Number(1)}, {'X', Number(2)},
+			{'G', Number(0)}, {'X', Number(3)}}},
+	}
+
+	for _, c := range cases {
+		numParams := map[int]Number{}
+		p := Parser{
+			Scanner:  strings.NewReader(c.s),
+			Features: LinuxCNC,
+			GetNumParam: func(num int) (Number, bool) {
+				n, ok := numParams[num]
+				return n, ok
+			},
+			SetNumParam: func(num int, val Number) error {
+				numParams[num] = val
+				return nil
+			},
+		}
+
+		var codes []Code
+		var err error
+		for {
+			var cs []Code
+			cs, err = p.Parse()
+			if err != nil {
+				break
+			}
+			codes = append(codes, cs...)
+		}
+		if c.fail {
+			if err == io.EOF {
+				t.Errorf("Parse(%s) did not fail", c.s)
+			}
+		} else if err != io.EOF {
+			t.Errorf("Parse(%s) failed with %s", c.s, err)
+		} else if !reflect.DeepEqual(codes, c.codes) {
+			t.Errorf("Parse(%s): got %v want %v", c.s, codes, c.codes)
+		} else {
+			for num, val := range c.vals {
+				if numParams[num] != val {
+					t.Errorf("Parse(%s): #%d: got %s want %s", c.s, num, numParams[num], val)
+				}
+			}
+		}
+	}
+}
+
+func TestKeywords(t *testing.T) {
+	cases := []struct {
+		f        Features
+		keywords []string
+	}{
+		{f: 0},
+		{f: RepRap},
+		{f: BeagleG, keywords: []string{"DO", "ELSE", "ELSEIF", "END", "IF", "THEN", "WHILE"}},
+		{f: LinuxCNC, keywords: []string{"CALL", "ENDSUB", "RETURN", "SUB"}},
+		{f: AllFeatures, keywords: []string{"CALL", "DO", "ELSE", "ELSEIF", "END", "ENDSUB", "IF",
+			"RETURN", "SUB", "THEN", "WHILE"}},
+	}
+
+	for _, c := range cases {
+		p := Parser{Features: c.f}
+		keywords := p.Keywords()
+		if !reflect.DeepEqual(keywords, c.keywords) {
+			t.Errorf("Keywords(%d): got %v want %v", c.f, keywords, c.keywords)
+		}
+	}
+}
+
+func TestParseError(t *testing.T) {
+	cases := []struct {
+		s  string
+		pe ParseError
+	}{
+		{s: "G1 X[1+]\n", pe: ParseError{Line: 0, VirtualLine: 0, Column: 8, Msg: "not a number"}},
+		{s: "G0\nG1 X[1+]\n",
+			pe: ParseError{Line: 1, VirtualLine: 1, Column: 8, Msg: "not a number"}},
+		{s: "G0\nN10 G1\nG1 X[1\n", pe: ParseError{Line: 2, VirtualLine: 10, Column: 7,
+			Msg: "expected closing brace ], got \n"}},
+		{s: "G0\n   G1 Q\"abc\n", pe: ParseError{Line: 1, VirtualLine: 1, Column: 12,
+			Msg: "strings may not contain newlines"}},
+	}
+
+	for _, c := range cases {
+		p := Parser{
+			Scanner:  strings.NewReader(c.s),
+			Features: AllFeatures,
+		}
+
+		var err error
+		for err == nil {
+			_, err = p.Parse()
+		}
+		pe, ok := err.(ParseError)
+		if !ok {
+			t.Errorf("Parse(%q) failed with %v; want a ParseError", c.s, err)
+		} else if pe != c.pe {
+			t.Errorf("Parse(%q) got %#v want %#v", c.s, pe, c.pe)
+		}
+	}
+
+	pe := ParseError{Line: 3, VirtualLine: 3, Column: 2, Msg: "message"}
+	if pe.Error() != "3: message" {
+		t.Errorf("Error() got %q want \"3: message\"", pe.Error())
+	}
+	pe = ParseError{Line: 3, VirtualLine: 20, Column: 2, Msg: "message"}
+	if pe.Error() != "3(20): message" {
+		t.Errorf("Error() got %q want \"3(20): message\"", pe.Error())
+	}
+}
+
 type executor struct {
 	fail     bool
 	executed *bool
@@ -679,6 +1200,208 @@ a string <name> 321.0000
 	}
 }
 
+func TestBeagleGComments(t *testing.T) {
+	cases := []struct {
+		s        string
+		f        Features
+		comments bool
+		outW     string
+		errW     string
+	}{
+		{s: "(msg,hi) G10\n", f: BeagleG},
+		{s: "(msg,hi) G10\n", f: BeagleG, comments: true, outW: "hi\n"},
+		{s: "G10 ;msg,hi\n", f: BeagleG, comments: true, outW: "hi\n"},
+		{s: "#1=2\n(debug,#1)\nG10\n", f: BeagleG, comments: true, outW: "2.0000\n"},
+		{s: "(print,hi) G10\n", f: BeagleG, comments: true, errW: "hi\n"},
+		{s: "(msg,hi) G10\n", f: RepRap, comments: true},
+		{s: "(msg,hi) G10\n", f: LinuxCNC, outW: "hi\n"},
+	}
+
+	for _, c := range cases {
+		var outW bytes.Buffer
+		var errW bytes.Buffer
+		numParams := map[int]Number{}
+
+		p := Parser{
+			Scanner:  strings.NewReader(c.s),
+			Features: c.f,
+			OutW:     &outW,
+			ErrW:     &errW,
+			GetNumParam: func(num int) (Number, bool) {
+				n, ok := numParams[num]
+				return n, ok
+			},
+			SetNumParam: func(num int, val Number) error {
+				numParams[num] = val
+				return nil
+			},
+			BeagleGComments: c.comments,
+		}
+
+		for {
+			codes, err := p.Parse()
+			if err != nil {
+				t.Errorf("Parse(%s) failed with %s", c.s, err)
+				break
+			}
+			if len(codes) > 0 {
+				break
+			}
+		}
+
+		o := outW.String()
+		if o != c.outW {
+			t.Errorf("Parse(%s) outW: got %s want %s", c.s, o, c.outW)
+		}
+		e := errW.String()
+		if e != c.errW {
+			t.Errorf("Parse(%s) errW: got %s want %s", c.s, e, c.errW)
+		}
+	}
+}
+
+func TestLineTerminator(t *testing.T) {
+	cases := []struct {
+		s    string
+		term string
+		outW string
+		errW string
+	}{
+		{s: "(msg,hi) G10\n", outW: "hi\n"},
+		{s: "(msg,hi) G10\n", term: "\n", outW: "hi\n"},
+		{s: "(msg,hi) G10\n", term: "\r\n", outW: "hi\r\n"},
+		{s: "#1=2\n(debug,#1)\nG10\n", term: "\r\n", outW: "2.0000\r\n"},
+		{s: "(debug,hi) G10\n", term: "\r\n", outW: "hi\r\n"},
+		{s: "(print,hi) G10\n", term: "\r\n", errW: "hi\r\n"},
+	}
+
+	for _, c := range cases {
+		var outW bytes.Buffer
+		var errW bytes.Buffer
+		numParams := map[int]Number{}
+
+		p := Parser{
+			Scanner:  strings.NewReader(c.s),
+			Features: LinuxCNC,
+			OutW:     &outW,
+			ErrW:     &errW,
+			GetNumParam: func(num int) (Number, bool) {
+				n, ok := numParams[num]
+				return n, ok
+			},
+			SetNumParam: func(num int, val Number) error {
+				numParams[num] = val
+				return nil
+			},
+			LineTerminator: c.term,
+		}
+
+		for {
+			codes, err := p.Parse()
+			if err != nil {
+				t.Errorf("Parse(%s) failed with %s", c.s, err)
+				break
+			}
+			if len(codes) > 0 {
+				break
+			}
+		}
+
+		o := outW.String()
+		if o != c.outW {
+			t.Errorf("Parse(%s) outW: got %q want %q", c.s, o, c.outW)
+		}
+		e := errW.String()
+		if e != c.errW {
+			t.Errorf("Parse(%s) errW: got %q want %q", c.s, e, c.errW)
+		}
+	}
+}
+
+func TestRequireChecksum(t *testing.T) {
+	cases := []struct {
+		s       string
+		f       Features
+		require bool
+		fail    bool
+	}{
+		{s: "N1 G10 *20\n", f: RepRap, require: true},
+		{s: "N1 G10 *20 ;comment\n", f: RepRap, require: true},
+		{s: "; comment\n\nN3 G10 *20\n", f: RepRap, require: true},
+		{s: "N1 G10\n", f: RepRap, require: true, fail: true},
+		{s: "G10\n", f: RepRap, require: true, fail: true},
+		{s: "G10 ;comment\n", f: RepRap, require: true, fail: true},
+		{s: "N1 G10\n", f: RepRap},
+		{s: "G10\n", f: RepRap},
+		{s: "G10\n", f: LinuxCNC, require: true},
+	}
+
+	for _, c := range cases {
+		p := Parser{
+			Scanner:         strings.NewReader(c.s),
+			Features:        c.f,
+			RequireChecksum: c.require,
+		}
+
+		var err error
+		for err == nil {
+			_, err = p.Parse()
+		}
+		if c.fail {
+			if err == io.EOF {
+				t.Errorf("Parse(%s) did not fail", c.s)
+			}
+		} else if err != io.EOF {
+			t.Errorf("Parse(%s) failed with %s", c.s, err)
+		}
+	}
+}
+
+func TestCommentHandlers(t *testing.T) {
+	cases := []struct {
+		s      string
+		f      Features
+		bodies []string
+		fail   bool
+	}{
+		{s: "(tool, 1/4 endmill) G10\n", bodies: []string{" 1/4 endmill"}},
+		{s: "(TOOL,a)\n;Tool,b\nG10\n", f: LinuxCNC, bodies: []string{"a", "b"}},
+		{s: "(msg,hi) (other,x) (tool) G10\n"},
+		{s: "(tool,fail) G10\n", fail: true},
+	}
+
+	for _, c := range cases {
+		var bodies []string
+		p := Parser{
+			Scanner:  strings.NewReader(c.s),
+			Features: c.f,
+			CommentHandlers: map[string]func(body string) error{
+				"tool": func(body string) error {
+					if body == "fail" {
+						return errors.New("failed")
+					}
+					bodies = append(bodies, body)
+					return nil
+				},
+			},
+		}
+
+		var err error
+		for err == nil {
+			_, err = p.Parse()
+		}
+		if c.fail {
+			if err == io.EOF {
+				t.Errorf("Parse(%s) did not fail", c.s)
+			}
+		} else if err != io.EOF {
+			t.Errorf("Parse(%s) failed with %s", c.s, err)
+		} else if !reflect.DeepEqual(bodies, c.bodies) {
+			t.Errorf("Parse(%s): got %v want %v", c.s, bodies, c.bodies)
+		}
+	}
+}
+
 func TestParameters(t *testing.T) {
 	cases := []struct {
 		s     string
@@ -710,6 +1433,15 @@ func TestParameters(t *testing.T) {
 		{s: "#123456789=0\n", fail: true},
 		{s: "#1=-1 \nG##1\n", fail: true},
 		{s: "#1=2.1 #2=0\nG##1\n", fail: true},
+
+		{s: "#2=3\n#1=-#2\nG#1\n", codes: []Code{{'G', Number(-3)}}},
+		{s: "#2=3\n#1 = -#2\nG#1\n", codes: []Code{{'G', Number(-3)}}},
+		{s: "#2=3\n#1=-[#2 + 1]\nG#1\n", codes: []Code{{'G', Number(-4)}}},
+		{s: "#2=3\n#1=--#2\n", fail: true},
+		{s: "#2=3\n#1=-#<abc>\n", fail: true},
+		{s: "#<abc>=\"x\"\n#1=-#<abc>\n", fail: true},
+		{s: "#1=-2.5\nG#1\n", codes: []Code{{'G', Number(-2.5)}}},
+		{s: "#2=3\nG-#2\n", codes: []Code{{'G', Number(-3)}}},
 	}
 
 	for _, c := range cases {
@@ -830,6 +1562,20 @@ func TestExpressions(t *testing.T) {
 		{s: "[1 && #111]] ", efail: true},
 		{s: "[1 && 2] ", num: 1},
 		{s: "[1 && 0] ", num: 0},
+		{s: "[0 XOR 0] ", num: 0},
+		{s: "[0 XOR 2] ", num: 1},
+		{s: "[2 xor 0] ", num: 1},
+		{s: "[1 Xor 1] ", num: 0},
+		{s: "[0.00001 XOR 0] ", num: 1},
+		{s: "[0.00001 XOR 1] ", num: 0},
+		{s: "[1 XOR 1 || 1] ", num: 1},
+		{s: "[1 || 1 XOR 1] ", num: 1},
+		{s: "[1 XOR 1 && 0] ", num: 1},
+		{s: "[0 && 1 XOR 1] ", num: 1},
+		{s: "[1 XOR 0 == 1] ", num: 1},
+		{s: "[1 XO 1] ", pfail: true},
+		{s: "[1 X 1] ", pfail: true},
+		{s: "[1 XORX 1] ", pfail: true},
 		{s: "[101 == #1] ", num: 1},
 		{s: "[100 == #1] ", num: 0},
 		{s: "[101 < #1] ", num: 0},
@@ -838,6 +1584,10 @@ func TestExpressions(t *testing.T) {
 		{s: "[101 <= #1] ", num: 1},
 		{s: "[100 != #1] ", num: 1},
 		{s: "[101 != #1] ", num: 0},
+		{s: "[[#1 > 100] + 1] ", num: 2},
+		{s: "[[#1 > 101] + 1] ", num: 1},
+		{s: "[[1 < 2] * 80 + [2 < 1] * 10 + 1] ", num: 81},
+		{s: "[[1 == 1] && 2 + 1] ", num: 1},
 		{s: "[101 > #1] ", num: 0},
 		{s: "[102 > #1] ", num: 1},
 		{s: "[100 >= #1] ", num: 0},
@@ -909,11 +1659,61 @@ func TestExpressions(t *testing.T) {
 		{s: "[ceil[-12.34]] ", num: -12},
 		{s: "[floor[12.34]] ", num: 12},
 		{s: "[floor[-12.34]] ", num: -13},
+		{s: "[fix[2.5]] ", num: 2},
+		{s: "[fix[-2.5]] ", num: -3},
+		{s: "[fup[2.5]] ", num: 3},
+		{s: "[fup[-2.5]] ", num: -2},
 		{s: "[round[12.34]] ", num: 12},
 		{s: "[round[-12.34]] ", num: -12},
 		{s: "[round[34.56]] ", num: 35},
 		{s: "[round[-34.56]] ", num: -35},
 
+		{s: "[atan[1, 1]] ", num: 45},
+		{s: "[atan[1, -1]] ", num: 135},
+		{s: "[atan[-1, 0]] ", num: -90},
+		{s: "[atan[1]/[1]] ", num: 45},
+		{s: "[ATAN[1] / [-1]] ", num: 135},
+		{s: "[atan[-1]/[-1]] ", num: -135},
+		{s: "[atan[-1]/[1]] ", num: -45},
+		{s: "[atan[0]/[-1]] ", num: 180},
+		{s: "[atan[1]/[1] * 2] ", num: 90},
+		{s: "[atan[1]/[1]/[3]] ", num: 15},
+		{s: "[atan[1]/[0.5 + 0.5] + 1] ", num: 46},
+		{s: "[atan[1]/2] ", num: 22.5},
+		{s: "[atan[1]/2 + 1] ", num: 23.5},
+		{s: "[atan[1, 1]/[3]] ", num: 15},
+		{s: "[atan[1]/[1] ", pfail: true},
+		{s: "[atan[]] ", pfail: true},
+		{s: "[atan[1, 2, 3]] ", pfail: true},
+
+		{s: "[exp[0]] ", num: 1},
+		{s: "[exp[1]] ", num: Number(math.E)},
+		{s: "[ln[1]] ", num: 0},
+		{s: "[ln[exp[2]]] ", num: 2},
+		{s: "[pow[2, 10]] ", num: 1024},
+		{s: "[pow[4, 0.5]] ", num: 2},
+		{s: "[pow[2]] ", pfail: true},
+		{s: "[mod[7, 3]] ", num: 1},
+		{s: "[mod[-7, 3]] ", num: 2},
+		{s: "[mod[7.5, 2]] ", num: 1.5},
+		{s: "[mod[7]] ", pfail: true},
+		{s: "[mod[7, 3, 1]] ", pfail: true},
+
+		{s: "[exists[#1]] ", num: 1},
+		{s: "[exists[#101]] ", num: 0},
+		{s: "[exists[#[40+50]]] ", num: 1},
+		{s: "[exists[##1]] ", num: 0},
+		{s: "[exists[##101]] ", efail: true},
+		{s: "[exists[#<test>]] ", num: 1},
+		{s: "[exists[#<TEST>]] ", num: 1},
+		{s: "[exists[#test]] ", num: 1},
+		{s: "[exists[#<abc>]] ", num: 0},
+		{s: "[!exists[#<abc>] && exists[#2]] ", num: 1},
+		{s: "[exists[1]] ", pfail: true},
+		{s: "[exists[#1] ", pfail: true},
+		{s: "[exists[#1, #2]] ", pfail: true},
+		{s: "[exists #1] ", pfail: true},
+
 		{s: `[123+"abc"] `, efail: true},
 		{s: `[<abc>+123] `, efail: true},
 	}
@@ -967,6 +1767,36 @@ func TestExpressions(t *testing.T) {
 	}
 }
 
+func TestAtanDivision(t *testing.T) {
+	cases := []struct {
+		s   string
+		f   Features
+		num Number
+	}{
+		{s: "[atan[1]/[2]] ", f: LinuxCNC, num: Number(math.Atan2(1, 2) * 180 / math.Pi)},
+		{s: "[atan[1]/[2]] ", f: BeagleG, num: 22.5},
+		{s: "[atan[1]/[1]/[3]] ", f: BeagleG, num: 15},
+	}
+
+	for _, c := range cases {
+		p := Parser{
+			Scanner:  strings.NewReader(c.s),
+			Features: c.f,
+		}
+		e, err := parseExpr(&p)
+		if err != nil {
+			t.Errorf("parseExpr(%s) failed with %s", c.s, err)
+			continue
+		}
+		n, err := evaluateExpr(&p, e)
+		if err != nil {
+			t.Errorf("evaluateExpr(%s) failed with %s", c.s, err)
+		} else if notEq(n, c.num) {
+			t.Errorf("evaluateExpr(%s) got %s, want %s", c.s, n, c.num)
+		}
+	}
+}
+
 func valuesEqual(v1, v2 Value) bool {
 	if n1, ok := v1.AsNumber(); ok {
 		n2, ok := v2.AsNumber()
@@ -981,6 +1811,33 @@ func valuesEqual(v1, v2 Value) bool {
 	return false
 }
 
+func TestNumberEqual(t *testing.T) {
+	cases := []struct {
+		n1, n2 Number
+		equal  bool
+	}{
+		{1.0, 1.0, true},
+		{1.0, 1.00001, true},
+		{-2.5, -2.50009, true},
+		{0.0, -0.00001, true},
+		{1.0, -1.0, false},
+		{3.0, -3.0, false},
+		{-90.1, 90.1, false},
+		{90.1, 91.1, false},
+		{1.0, 1.0002, false},
+		{0.0, 0.0001, false},
+	}
+
+	for _, c := range cases {
+		if eq := c.n1.Equal(c.n2); eq != c.equal {
+			t.Errorf("Number(%s).Equal(%s): got %v want %v", c.n1, c.n2, eq, c.equal)
+		}
+		if eq := c.n2.Equal(c.n1); eq != c.equal {
+			t.Errorf("Number(%s).Equal(%s): got %v want %v", c.n2, c.n1, eq, c.equal)
+		}
+	}
+}
+
 func TestValues(t *testing.T) {
 	cases := []struct {
 		s     string
@@ -1040,6 +1897,32 @@ func TestValues(t *testing.T) {
 		t.Errorf("%#v.AsInteger() failed: %d", num, n)
 	}
 
+	for _, c := range []struct {
+		num Number
+		n   int
+	}{
+		{Number(2.0), 2},
+		{Number(2.0000001), 2},
+		{Number(1.9999999), 2},
+		{Number(2.4), 2},
+		{Number(2.6), 3},
+		{Number(-1.9999999), -2},
+	} {
+		if n := c.num.RoundToInteger(); n != c.n {
+			t.Errorf("%#v.RoundToInteger() got %d want %d", c.num, n, c.n)
+		}
+	}
+
+	// AsInteger allows the tolerance of Equal, but truncates.
+	num = Number(2.0000001)
+	if n, ok := num.AsInteger(); !ok || n != 2 {
+		t.Errorf("%#v.AsInteger() got %d, %v want 2, true", num, n, ok)
+	}
+	num = Number(1.9999999)
+	if n, ok := num.AsInteger(); ok {
+		t.Errorf("%#v.AsInteger() did not fail: %d", num, n)
+	}
+
 	nam := Name("abc")
 	if _, ok := nam.AsString(); ok {
 		t.Errorf("%#v.AsString() did not fail", nam)
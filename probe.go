@@ -0,0 +1,88 @@
+package gcode
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Prober is optionally implemented by machines which can probe. G38.2 and G38.3 probe towards
+// the workpiece and G38.4 and G38.5 probe away from it; G38.2 and G38.4 require contact.
+// Probe moves towards pos, in machine coordinates, until the probe contacts (towards) or loses
+// contact with (away) the workpiece, and returns the position where it stopped and whether
+// contact changed. For machines which don't implement Prober, G38.x is passed to HandleUnknown.
+type Prober interface {
+	Probe(pos Position, towards bool, requireContact bool) (Position, bool, error)
+}
+
+const (
+	probePosXParam   = 5061
+	probePosYParam   = 5062
+	probePosZParam   = 5063
+	probeResultParam = 5070
+)
+
+// toWork converts a position from machine coordinates to the active coordinate system; it is
+// the inverse of toMachineX, toMachineY, and toMachineZ.
+func (eng *engine) toWork(pos Position) Position {
+	cs := eng.coordSysPos[eng.curCoordSys]
+	wp := eng.workOffset()
+	return Position{
+		X: pos.X + cs.X + eng.localPos.X + wp.X,
+		Y: pos.Y + cs.Y + eng.localPos.Y + wp.Y,
+		Z: pos.Z + cs.Z + eng.localPos.Z + wp.Z + eng.toolLengthOffset,
+	}
+}
+
+func (eng *engine) probe(pr Prober, codes []Code, useMachine, towards,
+	requireContact bool) ([]Code, error) {
+
+	if useMachine {
+		return nil, errors.New("G53 not allowed with probing")
+	}
+	if eng.feedMode == InverseTimeFeed {
+		return nil, errors.New("probing not allowed in inverse time feed mode (G93)")
+	}
+
+	var err error
+	var args []arg
+	args, codes, err = eng.parseArgs(codes, fArg|xArg|yArg|zArg)
+	if err != nil {
+		return nil, err
+	}
+
+	pos := eng.curPos
+	for _, arg := range args {
+		switch arg.letter {
+		case 'F':
+			err = eng.setFeed(float64(arg.num))
+			if err != nil {
+				return nil, err
+			}
+		case 'X':
+			pos.X = eng.toMachineX(float64(arg.num)*eng.units, eng.absoluteMode)
+		case 'Y':
+			pos.Y = eng.toMachineY(float64(arg.num)*eng.units, eng.absoluteMode)
+		case 'Z':
+			pos.Z = eng.toMachineZ(float64(arg.num)*eng.units, eng.absoluteMode)
+		}
+	}
+	if !hasArg(args, 'X') && !hasArg(args, 'Y') && !hasArg(args, 'Z') {
+		return nil, errors.New("expected at least one X, Y, or Z arg for probing")
+	}
+	if !pos.finite() {
+		return nil, fmt.Errorf("expected a finite position: %s", pos)
+	}
+
+	eng.trace("probe %s %v %v", pos, towards, requireContact)
+	contactPos, contact, err := pr.Probe(pos, towards, requireContact)
+	if err != nil {
+		return nil, err
+	}
+	eng.curPos = contactPos
+	eng.probePos = eng.toWork(contactPos)
+	eng.probeContact = contact
+	if requireContact && !contact {
+		return nil, fmt.Errorf("probe did not make contact: %s", contactPos)
+	}
+	return codes, nil
+}
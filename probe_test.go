@@ -0,0 +1,94 @@
+package gcode_test
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/leftmike/gcode"
+)
+
+type probeMachine struct {
+	machine
+	surfaceZ float64 // Probing towards stops here, if reached.
+	probes   []gcode.Position
+}
+
+func (m *probeMachine) Probe(pos gcode.Position, towards bool,
+	requireContact bool) (gcode.Position, bool, error) {
+
+	m.probes = append(m.probes, pos)
+	if towards && pos.Z < m.surfaceZ {
+		pos.Z = m.surfaceZ
+		return pos, true, nil
+	}
+	return pos, false, nil
+}
+
+func TestProbe(t *testing.T) {
+	var outW bytes.Buffer
+	m := probeMachine{
+		machine: machine{
+			actions: []action{
+				{cmd: rapidTo, x: 1.0, y: 1.0, z: 7.0},
+				{cmd: setFeed, f: 50.0},
+				{cmd: rapidTo, x: 1.0, y: 1.0, z: 6.0},
+			},
+		},
+		surfaceZ: -2.0,
+	}
+	eng := gcode.NewEngine(&m, gcode.AllFeatures, &outW, &outW)
+	err := eng.Evaluate(strings.NewReader(`
+G21
+G10 L2 P1 Z-1
+G0 X1 Y1 Z6
+G38.2 Z-10 F50
+(debug,#5061 #5062 #5063 #5070)
+G0 Z5
+G38.3 Z2
+(debug,#5063 #5070)
+`))
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	}
+	want := "1.0000 1.0000 -3.0000 1.0000\n2.0000 0.0000\n"
+	if outW.String() != want {
+		t.Errorf("Evaluate() outW: got %q want %q", outW.String(), want)
+	}
+	if len(m.probes) != 2 || m.probes[0] != (gcode.Position{X: 1.0, Y: 1.0, Z: -9.0}) {
+		t.Errorf("Evaluate(): got probes %v", m.probes)
+	}
+	if st := eng.State(); st.Position != (gcode.Position{X: 1.0, Y: 1.0, Z: 3.0}) {
+		t.Errorf("Evaluate(): got position %s want {1, 1, 3}", st.Position)
+	}
+
+	cases := []string{
+		"G38.2 Z1\n",
+		"G38.4 Z-5\n",
+		"G38.2\n",
+		"G38.2 Z-5 I1\n",
+		"G53 G38.2 Z-5\n",
+		"G38.2 Z-5\n#5061=1\n",
+	}
+	for _, c := range cases {
+		eng := gcode.NewEngine(&probeMachine{surfaceZ: -2.0}, gcode.AllFeatures, os.Stdout,
+			os.Stderr)
+		err := eng.Evaluate(strings.NewReader(c))
+		if err == nil {
+			t.Errorf("Evaluate(%s) did not fail", c)
+		}
+	}
+
+	var unknown []gcode.Code
+	eng = gcode.NewEngine(&dropMachine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+	eng.UnknownCodes = func(codes []gcode.Code) {
+		unknown = append(unknown, codes...)
+	}
+	err = eng.Evaluate(strings.NewReader("G38.2 Z-1\n"))
+	if err != nil {
+		t.Errorf("Evaluate(G38.2) failed: %s", err)
+	} else if len(unknown) != 2 {
+		t.Errorf("Evaluate(G38.2): got %v want [G38.2 Z-1]", unknown)
+	}
+}
@@ -0,0 +1,308 @@
+package gcode
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// savedNumber is saved as a JSON number if it is finite; otherwise, since JSON does not allow
+// them, it is saved as one of the strings "NaN", "+Inf", or "-Inf". Expressions such as
+// [LN[0]] can set parameters, offsets, and feeds to numbers which are not finite.
+type savedNumber float64
+
+func (sn savedNumber) MarshalJSON() ([]byte, error) {
+	f := float64(sn)
+	if math.IsNaN(f) {
+		return []byte(`"NaN"`), nil
+	} else if math.IsInf(f, 1) {
+		return []byte(`"+Inf"`), nil
+	} else if math.IsInf(f, -1) {
+		return []byte(`"-Inf"`), nil
+	}
+	return json.Marshal(f)
+}
+
+func (sn *savedNumber) UnmarshalJSON(data []byte) error {
+	var s string
+	if json.Unmarshal(data, &s) != nil {
+		var f float64
+		err := json.Unmarshal(data, &f)
+		if err != nil {
+			return err
+		}
+		*sn = savedNumber(f)
+		return nil
+	}
+
+	switch s {
+	case "NaN":
+		*sn = savedNumber(math.NaN())
+	case "+Inf":
+		*sn = savedNumber(math.Inf(1))
+	case "-Inf":
+		*sn = savedNumber(math.Inf(-1))
+	default:
+		return fmt.Errorf("expected a number, NaN, +Inf, or -Inf: %q", s)
+	}
+	return nil
+}
+
+type savedPosition struct {
+	X, Y, Z savedNumber
+}
+
+func toSavedPosition(pos Position) savedPosition {
+	return savedPosition{X: savedNumber(pos.X), Y: savedNumber(pos.Y), Z: savedNumber(pos.Z)}
+}
+
+func (sp savedPosition) position() Position {
+	return Position{X: float64(sp.X), Y: float64(sp.Y), Z: float64(sp.Z)}
+}
+
+// savedValue is a name parameter value; exactly one of the fields is set.
+type savedValue struct {
+	Number *savedNumber `json:",omitempty"`
+	Name   *Name        `json:",omitempty"`
+	String *String      `json:",omitempty"`
+}
+
+type savedSpindle struct {
+	On        bool
+	Speed     savedNumber
+	Clockwise bool
+}
+
+// savedState is the state of the engine saved by MarshalState. Positions and offsets are in mm.
+type savedState struct {
+	NumParams        map[int]savedNumber
+	NameParams       map[Name]savedValue
+	Inches           bool
+	HomePosition     savedPosition
+	SecondPosition   savedPosition
+	Position         savedPosition
+	CoordinateSystem int // 1 is G54 and 9 is G59.3.
+	CoordSysOffsets  [9]savedPosition
+	LocalOffset      savedPosition
+	WorkOffset       savedPosition
+	UseWorkOffset    bool
+	ToolLengthOffset savedNumber
+	ToolOffsets      map[uint]savedNumber
+	MoveMode         moveMode
+	RetractR         bool
+	Absolute         bool
+	AbsoluteArc      bool
+	Diameter         bool
+	Plane            Plane
+	Spindles         []savedSpindle
+	ConstantSurface  bool
+	SurfaceSpeed     savedNumber
+	MaxSpindleSpeed  savedNumber
+	Mist             bool
+	Flood            bool
+	Tool             uint
+	ToolSelected     bool
+	LoadedTool       uint
+	ToolChanged      bool
+	PathMode         PathMode
+	PathTolerance    savedNumber
+	NaiveCAMTol      savedNumber
+	Feed             savedNumber
+	FeedMode         FeedMode
+	ProgrammedFeed   savedNumber
+	FeedOverride     savedNumber
+	NoOverrides      bool
+}
+
+// MarshalState returns the parameters and the modal state of the engine, including the
+// offsets, units, plane, position, spindles, and tool, so that a program may be paused and later
+// resumed, possibly by a different engine, using UnmarshalState. The values of Z, R, P, and Q
+// remembered by canned cycles are not included.
+func (eng *engine) MarshalState() ([]byte, error) {
+	ss := savedState{
+		NumParams:        map[int]savedNumber{},
+		NameParams:       map[Name]savedValue{},
+		Inches:           eng.units != 1.0,
+		HomePosition:     toSavedPosition(eng.homePos),
+		SecondPosition:   toSavedPosition(eng.secondPos),
+		Position:         toSavedPosition(eng.curPos),
+		CoordinateSystem: eng.curCoordSys + 1,
+		LocalOffset:      toSavedPosition(eng.localPos),
+		WorkOffset:       toSavedPosition(eng.workPos),
+		UseWorkOffset:    eng.useWorkPos,
+		ToolLengthOffset: savedNumber(eng.toolLengthOffset),
+		MoveMode:         eng.moveMode,
+		RetractR:         eng.cycle.retractR,
+		Absolute:         eng.absoluteMode,
+		AbsoluteArc:      eng.absoluteArcMode,
+		Diameter:         eng.diameterMode,
+		Plane:            eng.arcPlane,
+		ConstantSurface:  eng.constantSurface,
+		SurfaceSpeed:     savedNumber(eng.surfaceSpeed),
+		MaxSpindleSpeed:  savedNumber(eng.maxSpindleSpeed),
+		Mist:             eng.mist,
+		Flood:            eng.flood,
+		Tool:             eng.curTool,
+		ToolSelected:     eng.toolSelected,
+		LoadedTool:       eng.loadedTool,
+		ToolChanged:      eng.toolChanged,
+		PathMode:         eng.pathMode,
+		PathTolerance:    savedNumber(eng.pathTolerance),
+		NaiveCAMTol:      savedNumber(eng.naiveCAMTol),
+		Feed:             savedNumber(eng.feed),
+		FeedMode:         eng.feedMode,
+		ProgrammedFeed:   savedNumber(eng.programmedFeed),
+		FeedOverride:     savedNumber(eng.feedOverride),
+		NoOverrides:      eng.noOverrides,
+	}
+
+	for num, val := range eng.numParams {
+		ss.NumParams[num] = savedNumber(val)
+	}
+	for cdx, pos := range eng.coordSysPos {
+		ss.CoordSysOffsets[cdx] = toSavedPosition(pos)
+	}
+	if eng.toolOffsets != nil {
+		ss.ToolOffsets = map[uint]savedNumber{}
+		for tool, offset := range eng.toolOffsets {
+			ss.ToolOffsets[tool] = savedNumber(offset)
+		}
+	}
+
+	for name, val := range eng.nameParams {
+		var sv savedValue
+		if num, ok := val.AsNumber(); ok {
+			sn := savedNumber(num)
+			sv.Number = &sn
+		} else if nam, ok := val.AsName(); ok {
+			sv.Name = &nam
+		} else if str, ok := val.AsString(); ok {
+			sv.String = &str
+		} else {
+			return nil, fmt.Errorf("unexpected value for name parameter %s: %v", name, val)
+		}
+		ss.NameParams[name] = sv
+	}
+
+	for _, spindle := range eng.spindles {
+		ss.Spindles = append(ss.Spindles, savedSpindle{
+			On:        spindle.on,
+			Speed:     savedNumber(spindle.speed),
+			Clockwise: spindle.clockwise,
+		})
+	}
+
+	return json.Marshal(ss)
+}
+
+// UnmarshalState restores the parameters and the modal state saved by MarshalState. The machine
+// is not told about the restored state; for example, SetSpindle is not called for a spindle
+// which is on.
+func (eng *engine) UnmarshalState(data []byte) error {
+	var ss savedState
+	err := json.Unmarshal(data, &ss)
+	if err != nil {
+		return err
+	}
+
+	if ss.CoordinateSystem < 1 || ss.CoordinateSystem > len(eng.coordSysPos) {
+		return fmt.Errorf("expected a coordinate system between 1 and 9: %d", ss.CoordinateSystem)
+	}
+	if ss.Plane != XYPlane && ss.Plane != ZXPlane && ss.Plane != YZPlane {
+		return fmt.Errorf("unexpected plane: %d", ss.Plane)
+	}
+	if ss.MoveMode > noMove {
+		return fmt.Errorf("unexpected move mode: %d", ss.MoveMode)
+	}
+	if ss.PathMode > ExactStopMode {
+		return fmt.Errorf("unexpected path mode: %d", ss.PathMode)
+	}
+	if ss.FeedMode > UnitsPerRevolutionFeed {
+		return fmt.Errorf("unexpected feed mode: %d", ss.FeedMode)
+	}
+
+	nameParams := map[Name]Value{}
+	for name, sv := range ss.NameParams {
+		if sv.Number != nil {
+			nameParams[name] = Number(*sv.Number)
+		} else if sv.Name != nil {
+			nameParams[name] = *sv.Name
+		} else if sv.String != nil {
+			nameParams[name] = *sv.String
+		} else {
+			return fmt.Errorf("missing value for name parameter %s", name)
+		}
+	}
+
+	numParams := map[int]Number{}
+	for num, val := range ss.NumParams {
+		numParams[num] = Number(val)
+	}
+	var coordSysPos [9]Position
+	for cdx, sp := range ss.CoordSysOffsets {
+		coordSysPos[cdx] = sp.position()
+	}
+	var toolOffsets map[uint]float64
+	if ss.ToolOffsets != nil {
+		toolOffsets = map[uint]float64{}
+		for tool, offset := range ss.ToolOffsets {
+			toolOffsets[tool] = float64(offset)
+		}
+	}
+	spindles := []spindleState{{on: false, speed: 0.0, clockwise: true}}
+	if len(ss.Spindles) > 0 {
+		spindles = nil
+		for _, spindle := range ss.Spindles {
+			spindles = append(spindles, spindleState{
+				on:        spindle.On,
+				speed:     float64(spindle.Speed),
+				clockwise: spindle.Clockwise,
+			})
+		}
+	}
+
+	eng.numParams = numParams
+	eng.nameParams = nameParams
+	eng.units = 1.0
+	if ss.Inches {
+		eng.units = mmPerInch
+	}
+	eng.homePos = ss.HomePosition.position()
+	eng.secondPos = ss.SecondPosition.position()
+	eng.curPos = ss.Position.position()
+	eng.curCoordSys = ss.CoordinateSystem - 1
+	eng.coordSysPos = coordSysPos
+	eng.localPos = ss.LocalOffset.position()
+	eng.workPos = ss.WorkOffset.position()
+	eng.useWorkPos = ss.UseWorkOffset
+	eng.toolLengthOffset = float64(ss.ToolLengthOffset)
+	eng.toolOffsets = toolOffsets
+	eng.moveMode = ss.MoveMode
+	eng.cycle = cannedCycle{retractR: ss.RetractR}
+	eng.absoluteMode = ss.Absolute
+	eng.absoluteArcMode = ss.AbsoluteArc
+	eng.diameterMode = ss.Diameter
+	eng.arcPlane = ss.Plane
+	eng.spindles = spindles
+	eng.constantSurface = ss.ConstantSurface
+	eng.surfaceSpeed = float64(ss.SurfaceSpeed)
+	eng.maxSpindleSpeed = float64(ss.MaxSpindleSpeed)
+	eng.mist = ss.Mist
+	eng.flood = ss.Flood
+	eng.curTool = ss.Tool
+	eng.toolSelected = ss.ToolSelected
+	eng.loadedTool = ss.LoadedTool
+	eng.toolChanged = ss.ToolChanged
+	eng.pathMode = ss.PathMode
+	eng.pathTolerance = float64(ss.PathTolerance)
+	eng.naiveCAMTol = float64(ss.NaiveCAMTol)
+	eng.feed = float64(ss.Feed)
+	eng.feedMode = ss.FeedMode
+	eng.programmedFeed = float64(ss.ProgrammedFeed)
+	eng.feedOverride = 1.0
+	if ss.FeedOverride > 0.0 {
+		eng.feedOverride = float64(ss.FeedOverride)
+	}
+	eng.noOverrides = ss.NoOverrides
+	return nil
+}
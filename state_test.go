@@ -0,0 +1,121 @@
+package gcode_test
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/leftmike/gcode"
+)
+
+func TestMarshalState(t *testing.T) {
+	setup := `
+G20
+G10 L2 P2 X1 Y2 Z3
+G55
+G0 X1 Y1 Z1
+G92 X0 Y0
+G52 Z0.5
+G10 L1 P2 Z0.25
+T2 G43
+G91
+G18
+G90.1
+S1000 M4
+#100=5
+#<depth>=[#100 / 10]
+#<where>=<depth>
+G1 F10
+`
+	snippet := `
+X1
+G0 Z[#<depth>]
+G1 X[#100]
+G91.1 G3 X0.1 Z0 I0.05 K0
+M5
+G90 G17
+G28
+G54 G1 X1 Y1
+(debug,#5220 #5400 #5403 #<where>)
+`
+
+	var want, wantOut bytes.Buffer
+	eng := gcode.NewEngine(&machine{}, gcode.AllFeatures, &wantOut, os.Stderr)
+	err := eng.Evaluate(strings.NewReader(setup))
+	if err != nil {
+		t.Fatalf("Evaluate(setup) failed: %s", err)
+	}
+	data, err := eng.MarshalState()
+	if err != nil {
+		t.Fatalf("MarshalState() failed: %s", err)
+	}
+	eng.TraceWriter = &want
+	err = eng.Evaluate(strings.NewReader(snippet))
+	if err != nil {
+		t.Fatalf("Evaluate(snippet) failed: %s", err)
+	}
+
+	var got, gotOut bytes.Buffer
+	eng = gcode.NewEngine(&machine{}, gcode.AllFeatures, &gotOut, os.Stderr)
+	err = eng.UnmarshalState(data)
+	if err != nil {
+		t.Fatalf("UnmarshalState() failed: %s", err)
+	}
+	eng.TraceWriter = &got
+	err = eng.Evaluate(strings.NewReader(snippet))
+	if err != nil {
+		t.Fatalf("Evaluate(snippet) failed: %s", err)
+	}
+	if got.String() != want.String() {
+		t.Errorf("UnmarshalState(): got trace\n%s\nwant\n%s", got.String(), want.String())
+	}
+	if gotOut.String() != wantOut.String() {
+		t.Errorf("UnmarshalState(): got %q want %q", gotOut.String(), wantOut.String())
+	}
+
+	for _, s := range []string{
+		`{"CoordinateSystem":0}`,
+		`{"CoordinateSystem":1,"Plane":3}`,
+		`{"CoordinateSystem":1,"NameParams":{"abc":{}}}`,
+		`{"CoordinateSystem":1,"FeedMode":3}`,
+		`{"CoordinateSystem":1,"Feed":"abc"}`,
+		`{`,
+	} {
+		eng := gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+		err := eng.UnmarshalState([]byte(s))
+		if err == nil {
+			t.Errorf("UnmarshalState(%s) did not fail", s)
+		}
+	}
+}
+
+func TestMarshalStateNotFinite(t *testing.T) {
+	eng := gcode.NewEngine(&machine{}, gcode.AllFeatures, os.Stdout, os.Stderr)
+	eng.BreakBeforeMCodes = []float64{6}
+	err := eng.Evaluate(strings.NewReader(
+		"#1=[LN[0]]\n#2=[SQRT[-1]]\n#<x>=[-LN[0]]\nG10 L2 P1 X[LN[0]]\nF[-LN[0]]\nM6\n"))
+	be, ok := err.(gcode.BreakError)
+	if !ok {
+		t.Fatalf("Evaluate() got %v want a BreakError", err)
+	}
+
+	var out bytes.Buffer
+	eng = gcode.NewEngine(&machine{}, gcode.AllFeatures, &out, os.Stderr)
+	err = eng.UnmarshalState(be.State)
+	if err != nil {
+		t.Fatalf("UnmarshalState() failed: %s", err)
+	}
+	err = eng.Evaluate(strings.NewReader("(debug,#1 #2 #<x> #5221)\n"))
+	if err != nil {
+		t.Fatalf("Evaluate() failed: %s", err)
+	}
+	want := "-Inf NaN +Inf -Inf\n"
+	if out.String() != want {
+		t.Errorf("UnmarshalState(): got %q want %q", out.String(), want)
+	}
+	if st := eng.State(); !math.IsInf(st.Feed, 1) {
+		t.Errorf("State(): got feed %v want +Inf", st.Feed)
+	}
+}
@@ -0,0 +1,173 @@
+package gcode
+
+import (
+	"io"
+	"strconv"
+	"strings"
+)
+
+// GCodeWriter writes lines of codes as G-code.
+type GCodeWriter struct {
+	W io.Writer
+
+	// Compact omits words which would not change the modal state: a G code from the same modal
+	// group as the active one (such as a repeated G1), an unchanged F or S, and, in absolute
+	// distance mode and outside of canned cycles, an unchanged X, Y, Z, A, B, or C. Lines which
+	// are left empty are not written.
+	Compact bool
+
+	modes map[modalGroup]Number
+	words map[Letter]Number
+}
+
+type modalGroup byte
+
+const (
+	motionGroup modalGroup = iota
+	planeGroup
+	unitsGroup
+	distanceGroup
+	arcDistanceGroup
+	feedModeGroup
+)
+
+func gCodeGroup(num Number) (modalGroup, bool) {
+	for _, g := range []struct {
+		group modalGroup
+		nums  []Number
+	}{
+		{motionGroup, []Number{0, 1, 2, 3, 80, 81, 82, 83}},
+		{planeGroup, []Number{17, 18, 19}},
+		{unitsGroup, []Number{20, 21}},
+		{distanceGroup, []Number{90, 91}},
+		{arcDistanceGroup, []Number{90.1, 91.1}},
+		{feedModeGroup, []Number{93, 94, 95}},
+	} {
+		for _, n := range g.nums {
+			if num.Equal(n) {
+				return g.group, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func formatNumber(n Number) string {
+	s := strconv.FormatFloat(float64(n), 'f', 4, 64)
+	s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	if s == "-0" {
+		return "0"
+	}
+	return s
+}
+
+func formatCode(code Code) string {
+	if num, ok := code.Value.AsNumber(); ok {
+		return string(code.Letter) + formatNumber(num)
+	}
+	return code.String()
+}
+
+func (gw *GCodeWriter) compact(codes []Code) []Code {
+	if gw.modes == nil {
+		gw.modes = map[modalGroup]Number{}
+		gw.words = map[Letter]Number{}
+	}
+
+	// Canned cycles (G81 to G83) end at the retract rather than at the programmed position, so
+	// the following axis words must not be omitted while one is active.
+	var out []Code
+	nonModal := gw.cannedCycle()
+	for _, code := range codes {
+		num, ok := code.Value.AsNumber()
+		if !ok {
+			out = append(out, code)
+			continue
+		}
+
+		switch code.Letter {
+		case 'G':
+			group, ok := gCodeGroup(num)
+			if !ok {
+				// Codes such as G28 and G92 change the position or the offsets, so the
+				// following axis words must not be omitted.
+				nonModal = true
+				break
+			}
+			if group == motionGroup && num >= 80 && num <= 83 {
+				// G80 ends a canned cycle, which leaves the tool at the retract.
+				nonModal = true
+			}
+			if mode, ok := gw.modes[group]; ok && mode.Equal(num) {
+				continue
+			}
+			gw.modes[group] = num
+			if group == unitsGroup || group == distanceGroup {
+				gw.words = map[Letter]Number{}
+			}
+			if group == feedModeGroup {
+				// Changing the feed mode clears the feed.
+				delete(gw.words, 'F')
+			}
+		case 'F':
+			if mode, ok := gw.modes[feedModeGroup]; ok && mode.Equal(93) {
+				// In inverse time mode, F is required with every move.
+				break
+			}
+			fallthrough
+		case 'S':
+			if val, ok := gw.words[code.Letter]; ok && val.Equal(num) {
+				continue
+			}
+			gw.words[code.Letter] = num
+		case 'X', 'Y', 'Z', 'A', 'B', 'C':
+			if nonModal {
+				delete(gw.words, code.Letter)
+				break
+			}
+			if mode, ok := gw.modes[distanceGroup]; ok && mode.Equal(91) {
+				break
+			}
+			if val, ok := gw.words[code.Letter]; ok && val.Equal(num) {
+				continue
+			}
+			gw.words[code.Letter] = num
+		}
+
+		out = append(out, code)
+	}
+
+	if nonModal {
+		for _, letter := range []Letter{'X', 'Y', 'Z', 'A', 'B', 'C'} {
+			delete(gw.words, letter)
+		}
+	}
+	return out
+}
+
+func (gw *GCodeWriter) cannedCycle() bool {
+	mode, ok := gw.modes[motionGroup]
+	return ok && mode >= 81 && mode <= 83
+}
+
+// WriteCodes writes one line of codes.
+func (gw *GCodeWriter) WriteCodes(codes []Code) error {
+	if gw.Compact {
+		codes = gw.compact(codes)
+		if len(codes) == 0 {
+			return nil
+		}
+	}
+
+	var sb strings.Builder
+	for cdx, code := range codes {
+		if cdx > 0 {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString(formatCode(code))
+	}
+	sb.WriteByte('\n')
+
+	_, err := io.WriteString(gw.W, sb.String())
+	return err
+}
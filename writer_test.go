@@ -0,0 +1,133 @@
+package gcode
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestGCodeWriter(t *testing.T) {
+	cases := []struct {
+		compact bool
+		lines   [][]Code
+		s       string
+	}{
+		{
+			lines: [][]Code{
+				{{'G', Number(1)}, {'X', Number(1)}, {'Y', Number(2)}, {'F', Number(100)}},
+				{{'G', Number(1)}, {'X', Number(1)}, {'Y', Number(3)}, {'F', Number(100)}},
+			},
+			s: "G1 X1 Y2 F100\nG1 X1 Y3 F100\n",
+		},
+		{
+			compact: true,
+			lines: [][]Code{
+				{{'G', Number(1)}, {'X', Number(1)}, {'Y', Number(2)}, {'F', Number(100)}},
+				{{'G', Number(1)}, {'X', Number(1)}, {'Y', Number(3)}, {'F', Number(100)}},
+				{{'G', Number(1)}, {'X', Number(2)}, {'Y', Number(3)}, {'Z', Number(-0.5)}},
+				{{'G', Number(1)}, {'X', Number(2)}, {'Y', Number(3)}},
+				{{'G', Number(0)}, {'X', Number(2)}, {'Z', Number(5)}},
+			},
+			s: "G1 X1 Y2 F100\nY3\nX2 Z-0.5\nG0 Z5\n",
+		},
+		{
+			compact: true,
+			lines: [][]Code{
+				{{'G', Number(91)}, {'G', Number(1)}, {'X', Number(1)}},
+				{{'G', Number(1)}, {'X', Number(1)}},
+				{{'G', Number(90)}, {'X', Number(1)}},
+				{{'X', Number(1)}},
+			},
+			s: "G91 G1 X1\nX1\nG90 X1\n",
+		},
+		{
+			compact: true,
+			lines: [][]Code{
+				{{'G', Number(0)}, {'X', Number(1)}, {'Y', Number(1)}},
+				{{'G', Number(28)}, {'X', Number(1)}},
+				{{'G', Number(0)}, {'X', Number(1)}, {'Y', Number(1)}},
+			},
+			s: "G0 X1 Y1\nG28 X1\nX1 Y1\n",
+		},
+		{
+			compact: true,
+			lines: [][]Code{
+				{{'G', Number(93)}, {'G', Number(1)}, {'X', Number(1)}, {'F', Number(2)}},
+				{{'X', Number(2)}, {'F', Number(2)}},
+				{{'G', Number(59.1)}, {'S', Number(1000)}, {'M', Number(3)}},
+				{{'S', Number(1000)}, {'M', Number(3)}},
+			},
+			s: "G93 G1 X1 F2\nX2 F2\nG59.1 S1000 M3\nM3\n",
+		},
+		{
+			compact: true,
+			lines: [][]Code{
+				{{'G', Number(0)}, {'Z', Number(5)}},
+				{{'G', Number(81)}, {'X', Number(1)}, {'Y', Number(1)}, {'Z', Number(-1)},
+					{'R', Number(1)}},
+				{{'G', Number(80)}},
+				{{'G', Number(1)}, {'Z', Number(-1)}, {'F', Number(100)}},
+			},
+			s: "G0 Z5\nG81 X1 Y1 Z-1 R1\nG80\nG1 Z-1 F100\n",
+		},
+		{
+			compact: true,
+			lines: [][]Code{
+				{{'G', Number(0)}, {'Z', Number(5)}},
+				{{'G', Number(81)}, {'X', Number(1)}, {'Y', Number(1)}, {'Z', Number(-1)},
+					{'R', Number(1)}},
+				{{'G', Number(81)}, {'X', Number(1)}, {'Y', Number(1)}, {'Z', Number(-1)},
+					{'R', Number(1)}},
+				{{'G', Number(80)}},
+			},
+			s: "G0 Z5\nG81 X1 Y1 Z-1 R1\nX1 Y1 Z-1 R1\nG80\n",
+		},
+		{
+			compact: true,
+			lines: [][]Code{
+				{{'G', Number(94)}, {'F', Number(100)}, {'G', Number(1)}, {'X', Number(1)}},
+				{{'G', Number(93)}, {'G', Number(1)}, {'X', Number(2)}, {'F', Number(5)}},
+				{{'G', Number(94)}, {'G', Number(1)}, {'X', Number(3)}, {'F', Number(100)}},
+				{{'G', Number(1)}, {'X', Number(4)}, {'F', Number(100)}},
+			},
+			s: "G94 F100 G1 X1\nG93 X2 F5\nG94 X3 F100\nX4\n",
+		},
+	}
+
+	for _, c := range cases {
+		var sb strings.Builder
+		gw := GCodeWriter{W: &sb, Compact: c.compact}
+		for _, codes := range c.lines {
+			err := gw.WriteCodes(codes)
+			if err != nil {
+				t.Fatalf("WriteCodes(%v) failed with %s", codes, err)
+			}
+		}
+		if sb.String() != c.s {
+			t.Errorf("GCodeWriter{Compact: %v}: got %q want %q", c.compact, sb.String(), c.s)
+		}
+	}
+}
+
+func TestGCodeWriterFeedMode(t *testing.T) {
+	var sb strings.Builder
+	gw := GCodeWriter{W: &sb, Compact: true}
+	for _, codes := range [][]Code{
+		{{'G', Number(94)}, {'F', Number(100)}, {'G', Number(1)}, {'X', Number(1)}},
+		{{'G', Number(93)}, {'G', Number(1)}, {'X', Number(2)}, {'F', Number(5)}},
+		{{'G', Number(94)}, {'G', Number(1)}, {'X', Number(3)}, {'F', Number(100)}},
+	} {
+		err := gw.WriteCodes(codes)
+		if err != nil {
+			t.Fatalf("WriteCodes(%v) failed with %s", codes, err)
+		}
+	}
+
+	// Changing the feed mode clears the feed, so the compacted output must set it again.
+	eng := NewEngine(&capabilityMachine{}, AllFeatures, ioutil.Discard, ioutil.Discard)
+	eng.RequireFeed = true
+	err := eng.Evaluate(strings.NewReader(sb.String()))
+	if err != nil {
+		t.Errorf("Evaluate(%q) failed: %s", sb.String(), err)
+	}
+}